@@ -12,8 +12,18 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/blevesearch/bleve/index/scorch"
 	"github.com/couchbase/moss"
@@ -21,168 +31,4418 @@ import (
 	log "github.com/couchbase/clog"
 )
 
-type sizeFunc func(interface{}) uint64
+type sizeFunc func(interface{}) (uint64, error)
+
+// sizeBreakdownFunc splits an index's memory into the bytes it holds
+// compressed, which are readily reclaimable, and the uncompressed
+// bytes still in flight.
+type sizeBreakdownFunc func(interface{}) (compressed, uncompressed uint64,
+	err error)
+
+// statsErrPolicy controls how an index whose size can't be read is
+// accounted for against the indexing quota.
+type statsErrPolicy int
+
+const (
+	// statsErrFailOpen counts the index as using no memory.  Indexing
+	// keeps flowing while the engine's stats are broken, at the risk
+	// of overshooting the quota by however much that index really
+	// holds.  This is the default.
+	statsErrFailOpen statsErrPolicy = iota
+
+	// statsErrFailClosed counts the index as using the entire
+	// indexQuota, so indexing blocks until the engine's stats recover.
+	// This never overshoots the quota, but a persistently failing
+	// stats call will stall all indexing on the node.
+	statsErrFailClosed
+)
+
+func parseStatsErrPolicy(s string) (statsErrPolicy, error) {
+	switch s {
+	case "failOpen":
+		return statsErrFailOpen, nil
+	case "failClosed":
+		return statsErrFailClosed, nil
+	}
+	return statsErrFailOpen,
+		fmt.Errorf("app_herder: unknown stats err policy: %q", s)
+}
+
+func (p statsErrPolicy) String() string {
+	if p == statsErrFailClosed {
+		return "failClosed"
+	}
+	return "failOpen"
+}
+
+// wakeMode controls how waiting batches are woken on persister
+// progress.
+type wakeMode int
+
+const (
+	// wakeBroadcast wakes every waiter.  This is the default.
+	wakeBroadcast wakeMode = iota
+
+	// wakeSignal wakes about as many waiters as the freed memory can
+	// admit, see persisterWakeBatchSize.
+	wakeSignal
+)
+
+func parseWakeMode(s string) (wakeMode, error) {
+	switch s {
+	case "broadcast":
+		return wakeBroadcast, nil
+	case "signal":
+		return wakeSignal, nil
+	}
+	return wakeBroadcast, fmt.Errorf("app_herder: unknown wake mode: %q", s)
+}
+
+func (m wakeMode) String() string {
+	if m == wakeSignal {
+		return "signal"
+	}
+	return "broadcast"
+}
+
+// combinedYield controls which side yields when indexing and queries
+// together exceed appQuota while indexing alone is under indexQuota.
+type combinedYield int
+
+const (
+	// yieldIndexing has batches wait until the combined usage is back
+	// under appQuota, so heavy queries can stall indexing.  This is the
+	// default.
+	yieldIndexing combinedYield = iota
+
+	// yieldQueries keeps batches flowing as long as indexing is under
+	// indexQuota, with only query admission held to appQuota, so
+	// indexing is protected from query-induced stalls at the expense
+	// of rejecting more queries.
+	yieldQueries
+)
+
+func parseCombinedYield(s string) (combinedYield, error) {
+	switch s {
+	case "indexing":
+		return yieldIndexing, nil
+	case "queries":
+		return yieldQueries, nil
+	}
+	return yieldIndexing,
+		fmt.Errorf("app_herder: unknown combined yield: %q", s)
+}
+
+func (y combinedYield) String() string {
+	if y == yieldQueries {
+		return "queries"
+	}
+	return "indexing"
+}
+
+// zeroSizePolicy controls what happens to zero size query
+// reservations, which usually mean the caller failed to compute the
+// query's size, so its memory silently goes unaccounted.
+type zeroSizePolicy int
+
+const (
+	// zeroSizeAllow admits them like any other query.  This is the
+	// default.
+	zeroSizeAllow zeroSizePolicy = iota
+
+	// zeroSizeWarn admits them with a warning, as it does zero size
+	// EndQuery calls.
+	zeroSizeWarn
+
+	// zeroSizeReject rejects them, also warning of zero size EndQuery
+	// calls.
+	zeroSizeReject
+)
+
+func parseZeroSizePolicy(s string) (zeroSizePolicy, error) {
+	switch s {
+	case "allow":
+		return zeroSizeAllow, nil
+	case "warn":
+		return zeroSizeWarn, nil
+	case "reject":
+		return zeroSizeReject, nil
+	}
+	return zeroSizeAllow,
+		fmt.Errorf("app_herder: unknown zero size policy: %q", s)
+}
+
+func (p zeroSizePolicy) String() string {
+	switch p {
+	case zeroSizeWarn:
+		return "warn"
+	case zeroSizeReject:
+		return "reject"
+	}
+	return "allow"
+}
+
+type indexEntry struct {
+	size       sizeFunc
+	onStatsErr statsErrPolicy
+
+	// The size last observed for this index, used to compute how much
+	// memory its persister freed.
+	lastSize uint64
+
+	// Set once the index's live size has reached its warmup floor.
+	warmedUp bool
+
+	// The admission time of the most recent batch, or the slot reserved
+	// for the next one when batches are being spaced out, plus counts
+	// for the admission rate.
+	lastAdmit       time.Time
+	firstAdmit      time.Time
+	batchesAdmitted uint64
+
+	// When tracking in-flight memory, the size at the last batch's
+	// admission, and the bytes introduced by batches since the last
+	// persister progress, which is roughly what's still unpersisted.
+	introStartSize uint64
+	introStarted   bool
+	inFlight       uint64
+
+	// When tracking epochs, the memory added by each introduced but
+	// not yet persisted epoch, oldest first, and the size as of the
+	// latest introduced epoch.
+	epochs        []epochBytes
+	epochLastSize uint64
+
+	// Persister progress events for this index, and the memory they
+	// were observed to free.
+	persisterProgress uint64
+	persistedBytes    uint64
+
+	// The size the index's size func last reported, and the times it
+	// jumped by more than sizeJumpFactor.
+	lastReported uint64
+	sizeJumps    uint64
+
+	// The compressed and uncompressed bytes as of the last sample, when
+	// the index has an opts.SizeBreakdown.
+	compressedBytes   uint64
+	uncompressedBytes uint64
+
+	// The cumulative time the index's batches spent waiting on
+	// backpressure, and the number of waits.
+	waitTime time.Duration
+	waits    uint64
+
+	// The estimated memory of the batches waiting in
+	// RegisterAndAwaitBatch, counted towards the index's size until
+	// they're admitted.
+	pendingDelta uint64
+
+	// Set by SetIndexExcluded while the index is being rebuilt, so its
+	// transient size isn't counted against the quotas.
+	excluded bool
+
+	// Set while the index is beyond its alarm threshold, until it drops
+	// back below indexAlarmRearm of it.
+	alarmed bool
+
+	opts indexOptions
+}
+
+// indexOptions are provided for an index through RegisterIndex.
+type indexOptions struct {
+	// Name identifies the index in stats and logs.
+	Name string
+
+	// Exempt indexes never wait in onBatchExecuteStart, though their
+	// memory still counts against the quotas.  It's meant to be used
+	// sparingly, for small, critical internal indexes.
+	Exempt bool
+
+	// WarmupFloor is the minimum size accounted for the index until
+	// its live size first reaches it, so a newly opened index that
+	// briefly reports little or no memory still reserves a reasonable
+	// baseline.  Zero means the herder's default applies.
+	WarmupFloor uint64
+
+	// MinBatchInterval is the minimum time between this index's batch
+	// admissions, with faster batches briefly delayed, so a client
+	// submitting floods of tiny batches can't monopolize the herder.
+	// Zero means the herder's default applies.
+	MinBatchInterval time.Duration
+
+	// Priority is the least priority of the index's batches, such as
+	// batchPriorityHigh while it's catching up on replication.
+	Priority batchPriority
+
+	// SizeBreakdown optionally splits the index's memory into its
+	// compressed and uncompressed bytes, for engines that can tell, so
+	// the compressed bytes can be weighted by compressedWeight.
+	SizeBreakdown sizeBreakdownFunc
+
+	// AlarmBytes and AlarmRatio, of indexQuota, are the sizes beyond
+	// which onIndexAlarm fires for the index, whichever is lower, zero
+	// disabling either, regardless of whether the quotas are exceeded.
+	AlarmBytes uint64
+	AlarmRatio float64
+}
+
+// batchPriority orders batches waiting for indexing memory.
+type batchPriority int
+
+const (
+	batchPriorityNormal batchPriority = iota
+
+	// batchPriorityHigh batches are admitted ahead of normal ones when
+	// memory frees, and may use the highPriorityRatio slice of
+	// indexQuota that normal batches can't.
+	batchPriorityHigh
+)
+
+// batchWaiter tracks a batch blocked in onBatchExecuteStart.
+type batchWaiter struct {
+	index    interface{}
+	since    time.Time
+	priority batchPriority
+
+	// Set when the wait is abandoned, such as when the index closes.
+	err error
+
+	// Set when a wakeSelector picks the waiter to be woken.
+	selected bool
+
+	// The source of the wakeup that last woke the waiter.
+	wokenBy wakeSource
+
+	// The wake burst this waiter was woken by, if any.
+	burst *wakeBurst
+}
+
+// wakeBurst tracks the waiters woken by persister progress until each
+// has either been admitted or gone back to waiting.
+type wakeBurst struct {
+	pending  int
+	admitted int
+
+	// Closed once onWakeBurstStart has returned, so onWakeBurstEnd is
+	// only fired after it.
+	started chan struct{}
+}
+
+// defaultIndexAlarmRearm is the fraction of an index's alarm
+// threshold it must drop below before its alarm can fire again.
+const defaultIndexAlarmRearm = 0.9
+
+// defaultIngestThrottleStart is the fraction of indexQuota beyond
+// which IngestRateHint starts throttling intake.
+const defaultIngestThrottleStart = 0.8
+
+// defaultHealthyStabilization is how long the herder must stay out of
+// pressure for WaitHealthy, unless memHealthyStabilization is set.
+const defaultHealthyStabilization = 5 * time.Second
+
+// herderMutex is the herder's lock, optionally recording how long
+// each acquisition is held, as every admission serializes on it.
+type herderMutex struct {
+	sync.Mutex
+
+	// Optional recorder of the hold times, nil when disabled, with the
+	// time the lock was last acquired and the longest hold, all
+	// protected by the lock itself.
+	holds    *latencyHistogram
+	acquired time.Time
+	maxHold  time.Duration
+}
+
+func (m *herderMutex) Lock() {
+	m.Mutex.Lock()
+	if m.holds != nil {
+		m.acquired = time.Now()
+	}
+}
+
+func (m *herderMutex) Unlock() {
+	if m.holds != nil {
+		held := time.Since(m.acquired)
+		m.holds.record(held)
+		if held > m.maxHold {
+			m.maxHold = held
+		}
+	}
+	m.Mutex.Unlock()
+}
 
 type appHerder struct {
+	// Accessed atomically by the lock-free query fast path, so they're
+	// first, for 64-bit alignment; see refreshFastPathLOCKED.
+	fastBudget   uint64
+	fastUsed     uint64
+	fastQueries  int64
+	fastAdmitted uint64
+
+	// The bytes ever admitted by the fast path, of which those no
+	// longer in fastUsed have ended.
+	fastAdmittedBytes uint64
+
+	// The requested sizes, before queryQuantum, of the queries in
+	// fastUsed.
+	fastRawUsed uint64
+
 	memQuota   uint64
 	appQuota   uint64
 	indexQuota uint64
 	queryQuota uint64
 
-	m        sync.Mutex
-	waitCond *sync.Cond
-	waiting  int
+	// When non-zero, UpdateMemQuota shrinks memQuota by at most this
+	// many bytes per second, ramping it down to memQuotaTarget on each
+	// Tick since memQuotaRampAt, so in-flight work has time to finish.
+	// Growing memQuota is never ramped.
+	memQuotaMaxShrinkRate uint64
+	memQuotaTarget        uint64
+	memQuotaRampAt        time.Time
+	memQuotaRampLoggedAt  time.Time
+
+	// The memQuota inputs by source, such as the cluster manager's
+	// quota and a container's cgroup limit, of which the tightest is
+	// the memQuotaBinding one that sets memQuota.
+	memQuotaSources map[string]uint64
+	memQuotaBinding string
+
+	// When non-zero, memQuota source changes arriving within this
+	// window of the first are coalesced, with memQuotaTimer applying
+	// the latest inputs once it's up, so a flurry of updates only
+	// recomputes the quotas and wakes waiters once.
+	memQuotaCoalesce         time.Duration
+	memQuotaTimer            *time.Timer
+	memQuotaUpdatesCoalesced uint64
+
+	// When non-zero, a rise in queryQuota is admitted against over this
+	// period, with warmQueryQuota stepping up on each Tick from
+	// queryWarmupFrom as of queryWarmupStart, so a burst of newly
+	// admitted queries doesn't shock the allocator.  Otherwise, and
+	// once the warmup is done, warmQueryQuota equals queryQuota.
+	queryQuotaWarmup time.Duration
+	warmQueryQuota   uint64
+	queryWarmupFrom  uint64
+	queryWarmupStart time.Time
+
+	// When shareSlack is enabled, the index and query quotas each
+	// include the sharedSlack, the part of appQuota their ratios leave
+	// unreachable.
+	shareSlack  bool
+	sharedSlack uint64
+
+	// Sub-quota of queryQuota for highlighting, zero when unlimited.
+	highlightQuota uint64
+
+	// The quotas as last logged by recomputeQuotasLOCKED.
+	loggedQuotas quotaSummary
+
+	appRatio       float64
+	indexRatio     float64
+	queryRatio     float64
+	highlightRatio float64
+
+	// When heapDivergence is positive, every Tick compares the heap in
+	// use with the tracked usage, see reconcileHeapLOCKED.  It's only
+	// set at startup, so it's read without the lock.
+	heapDivergence float64
+	heapScaleQuota bool
+	heapInuse      uint64
+	heapDiverged   bool
+	untrackedHeap  uint64
+
+	// When enabled, queries are admitted without the lock while usage
+	// is well under the quotas, see SetQueryFastPath.
+	queryFastPath bool
+
+	// Set while backpressure is turned off by SetEnforcement.
+	unenforced bool
+
+	// Set between PauseIndexing and ResumeIndexing, with queriesHeld
+	// when the pause also holds queries.
+	indexingPaused bool
+	queriesHeld    bool
+
+	// When non-zero, indexQuota is capped at this absolute size, which
+	// is kept across memQuota and ratio changes.
+	indexMaxBytes uint64
+
+	// The query memory guaranteed whatever the indexing memory, which
+	// indexing must leave free in appQuota, bounded by queryQuota.
+	queryQuotaFloor uint64
+
+	// Derives the quotas from memQuota, nil for linearQuotaPolicy.
+	quotaPolicy quotaPolicy
+
+	// In read-only replica mode there's no indexing, so the indexing
+	// accounting is skipped and queries get the whole appQuota.
+	readOnly       bool
+	readOnlyWarned bool
+
+	// Arbitrates between indexing and queries under combined appQuota
+	// pressure, in the range [-1, 1].  A positive weight favors
+	// queries, shrinking the appQuota indexing sees by that fraction
+	// while queries are running; a negative weight favors indexing the
+	// same way.  Zero is first-come, first-served.
+	arbitrationWeight float64
+
+	// The fraction of indexQuota beyond which IngestRateHint starts
+	// throttling intake.
+	ingestThrottleStart float64
+
+	// How long IsUnderPressure must stay false for WaitHealthy.
+	healthyStabilization time.Duration
+
+	// When the combined indexing and query memory crosses the
+	// oomImminentRatio of memQuota, onOOMImminent is called with a
+	// diagnostic snapshot, re-arming once usage drops back below.
+	oomImminentRatio float64
+	onOOMImminent    func(oomSnapshot)
+	oomImminent      bool
+
+	// Optional callback fired when an index grows beyond its alarm
+	// threshold, see indexOptions.AlarmBytes, re-arming once the index
+	// drops back below the indexAlarmRearm fraction of the threshold,
+	// so an index hovering at it doesn't flap.
+	onIndexAlarm    func(c interface{}, size, threshold uint64)
+	indexAlarmRearm float64
+	totIndexAlarms  uint64
+
+	// Which side yields under combined appQuota pressure.
+	combinedYield combinedYield
+
+	// The fraction of indexQuota only high priority batches may use.
+	highPriorityRatio float64
+
+	// The fixed memory each open index is assumed to hold beyond what
+	// its size func reports, such as buffers and goroutines, which is
+	// taken out of indexQuota for every index.
+	perIndexOverhead uint64
+
+	// The default warmup floor for indexes, zero for none.
+	warmupFloor uint64
+
+	// When above 1, an index whose reported size grows or shrinks by
+	// more than this factor between consecutive checks is flagged with
+	// a warning, as that's more likely an engine sizing bug than real.
+	sizeJumpFactor float64
+
+	// The fraction of an index's compressed bytes counted against the
+	// quotas, as they're more readily reclaimed than in-flight ones,
+	// for indexes with a SizeBreakdown.  At 1, the default, the size
+	// func's total is used as is.
+	compressedWeight float64
+
+	// The default minimum time between an index's batch admissions,
+	// zero for no minimum.
+	minBatchInterval time.Duration
+
+	// Optional detector of usage oscillating across the quota
+	// boundary, nil when disabled.
+	thrash *thrashDetector
+
+	// Optional breakdown of recent query rejections by reason, nil
+	// when disabled.
+	rejections *rejectionWindow
+
+	// Optional window of recent query admissions and rejections, for
+	// their rates, nil when disabled.
+	admissions *admissionWindow
+
+	// Optional ring of the most recent batch admissions, with the
+	// count ever recorded, nil when disabled; see
+	// RecentBatchAdmissions.
+	batchAdmissions     []batchAdmission
+	batchAdmissionCount uint64
+
+	// Until graceUntil, quotas are checked and would-be rejections and
+	// waits are logged, but everything is admitted, as estimates are
+	// unreliable while caches are cold right after startup.
+	graceUntil time.Time
+
+	// Graduated responses while indexing memory stays pinned at the
+	// indexQuota ceiling, each taken once it's been at the ceiling for
+	// the given duration, zero disabling that response: the rate hint
+	// drops to 0, then new batches wait even under the quota, then
+	// onMemoryPressure is fired so the engines can be forced to flush.
+	escalateThrottleAfter time.Duration
+	escalatePauseAfter    time.Duration
+	escalateFlushAfter    time.Duration
+	onMemoryPressure      func()
+
+	// The current escalation level, and since when indexing memory has
+	// been at the ceiling, zero when it isn't.
+	escalation   int
+	ceilingSince time.Time
+
+	m        herderMutex
+	waitCond *sync.Cond
+	waiting  int
+
+	// Waiting batches wait on their own cond, so a persister progress
+	// signal can't be taken by a waiting query or misc reservation.
+	batchCond *sync.Cond
+
+	// The part of waiting that's high priority batches.
+	waitingHighPriority int
+
+	// Bumped on every wakeup, so a batch can tell that it missed one
+	// while the lock was released to compute index sizes.
+	wakeGen uint64
+
+	// The batches currently blocked waiting for memory, in arrival
+	// order.
+	waiters []*batchWaiter
+
+	// The largest index when a batch last began waiting.
+	culpritName string
+	culpritSize uint64
+
+	indexes map[interface{}]*indexEntry
+
+	// The memory of the indexes excluded by SetIndexExcluded, as of the
+	// last sample.
+	excludedIndexingMemory uint64
+
+	// The cost of sweeping the size funcs in indexingMemoryLOCKED: the
+	// number of sweeps, their total and latest durations, and how many
+	// size funcs the latest one ran.
+	sizeSweeps       uint64
+	sizeSweepTotal   time.Duration
+	sizeSweepLast    time.Duration
+	sizeSweepIndexes int
+
+	// Per-engine policy for indexes whose size can't be read.  Scorch
+	// reports its memory usage without an error path, so only moss
+	// needs one.
+	mossStatsErrPolicy statsErrPolicy
+
+	// How waiters are woken on persister progress, and for wakeSignal,
+	// the typical batch size used to decide how many to wake.
+	persisterWakeMode      wakeMode
+	persisterWakeBatchSize uint64
+
+	// When set, chooses which waiting batches persister progress wakes,
+	// in place of the persisterWakeMode, see SetWakeSelector.  Waiters
+	// it passes over keep waiting through the selective wake, which
+	// doesn't bump generalWakes, unlike every other wakeup.
+	wakeSelector wakeSelector
+	generalWakes uint64
+
+	// What freed the memory behind the latest wakeup, and the batches
+	// admitted after waiting, by the source of the wakeup that woke
+	// them last.
+	lastWakeSource wakeSource
+	wakeAdmits     [numWakeSources]uint64
+
+	// Tracks the amount of memory used by running queries
+	runningQueryUsed uint64
+
+	// When querySmoothing is in (0, 1], queries are admitted against
+	// an exponential moving average of runningQueryUsed, updated by
+	// that factor on every query start and end, so a transient spike
+	// doesn't reject otherwise fine queries.  Zero, the default,
+	// admits against the instantaneous usage.
+	querySmoothing  float64
+	runningQueryAvg float64
+
+	// When both are positive, queries are admitted against the
+	// indexing memory projected from its rise over the last
+	// indexTrendWindow, scaled by indexTrendSensitivity, rather than
+	// just its current level, so a query isn't admitted into a
+	// combined quota breach that rising indexing is about to cause.
+	// indexTrend holds the sampled indexing memory over the window.
+	indexTrendWindow      time.Duration
+	indexTrendSensitivity float64
+	indexTrend            []indexTrendSample
+
+	// Tracks the part of runningQueryUsed reserved for highlighting,
+	// which is capped by highlightQuota when that's non-zero
+	runningHighlightUsed uint64
+
+	// When non-zero, query sizes are rounded up to a multiple of
+	// queryQuantum, such as 1 MiB, before they're accounted, so slight
+	// variations in estimates don't keep flapping usage across the
+	// quota boundaries.  It's only set at startup, as EndQuery must
+	// round the same as StartQuery did, and is read without the lock.
+	// runningQueryRawUsed totals the sizes as requested instead.
+	queryQuantum        uint64
+	runningQueryRawUsed uint64
+
+	// What to do with zero size queries, and the count of those seen
+	// by a warn or reject policy.  Like queryQuantum, it's only set at
+	// startup.
+	zeroSizePolicy     zeroSizePolicy
+	totZeroSizeQueries uint64
+
+	// Cumulative admission counters
+	totQueryAdmitted uint64
+	totQueryRejected uint64
+	totBatchAdmitted uint64
+
+	// The bytes of the queries admitted under the lock, and the queries
+	// ended and their bytes, to tell leaked reservations apart.
+	totQueryAdmittedBytes uint64
+	totQueryEnded         uint64
+	totQueryEndedBytes    uint64
+
+	// Optional detector of the outstanding queries growing without
+	// ever going back down, as when reservations leak, nil when
+	// disabled.
+	imbalance *imbalanceDetector
+
+	totHighPriorityBatchAdmitted uint64
+
+	// Admitted batches that had to wait on backpressure at least once,
+	// out of totBatchAdmitted.
+	totBatchWaited uint64
+
+	// Reservations released by StartQueryWithContext once their
+	// query's context was done before they were ended.
+	totQueryContextReleased uint64
+
+	// How long StartQueryWithContext holds a reservation after its
+	// context is done, in case the query is still cleaning up with the
+	// memory, before forcibly releasing it.  Zero releases it at once.
+	queryCancelGrace time.Duration
+
+	// Persister progress events, and their per second rate over the
+	// last Tick interval, where a sudden drop while indexing memory is
+	// high is an early sign of a persister problem.
+	totPersisterProgress      uint64
+	persisterProgressRate     float64
+	lastTick                  time.Time
+	lastTickPersisterProgress uint64
+
+	// Times the combined appQuota check was exceeded, with the sum and
+	// the last of indexing's share of the indexing plus query memory at
+	// those times, to tell which one to scale down to relieve it.
+	totCombinedQuotaExceeded uint64
+	combinedIndexShareSum    float64
+	combinedIndexShareLast   float64
+
+	// Tracks the number of running queries, including those whose
+	// memory is accounted for elsewhere
+	runningQueries          int
+	runningQueriesElsewhere int
+
+	// When positive, queries are rejected while this many are
+	// already running, whatever their size.
+	maxConcurrentQueries int
+
+	// When enabled, a query that doesn't fit may preempt lower
+	// priority reservations, see queryOptions.Priority, with the
+	// number preempted counted.
+	queryPreemption bool
+	totPreempted    uint64
+
+	// Memory held by misc reservations, such as for maintenance tasks,
+	// which counts against appQuota for both indexing and querying,
+	// besides what's left of the decaying reservations.
+	miscReserved uint64
+	decaying     []*decayingReservation
+
+	// When non-zero, caps the misc memory, decaying or not.
+	miscMaxBytes uint64
+
+	// The queries blocked waiting for memory, in arrival order.  Only
+	// the head of the queue is woken to recheck, see wakeQueryLOCKED.
+	queryWaiters []*queryWaiter
+
+	// When enabled, the memory of batches introduced but not yet
+	// persisted is tracked per index, see onBatchIntroduced.  It's
+	// only set at startup, so it's read without the lock.
+	trackInFlight bool
+
+	// When enabled, the memory of each unpersisted scorch epoch is
+	// tracked per index from the scorch stats, see onEpochIntroduced.
+	// Like trackInFlight, it's read without the lock.
+	trackEpochs bool
+
+	// Optional callback fired once for every index as the herder starts
+	// tracking it, by its first batch or RegisterIndex, complementing
+	// the engines' close events.  It's called with the lock held, so it
+	// mustn't call back into the herder.
+	onIndexRegistered func(c interface{})
+
+	// Optional callbacks bracketing the cascade of rechecks when
+	// persister progress wakes waiting batches, given the number woken
+	// and, once they've all rechecked, the number admitted.  Like
+	// onIndexAlarm, they're fired on their own goroutines, once the
+	// counts are taken, rather than with the lock held.
+	onWakeBurstStart func(woken int)
+	onWakeBurstEnd   func(admitted int)
+	wakeBurst        *wakeBurst
+
+	// When set, every admission and rejection is recorded to the audit
+	// log, one JSON object per decision, apart from the operational
+	// log.  Queries then always take the locked path.
+	audit *auditLog
+
+	// Optional admission policy consulted once a query has passed the
+	// quota checks, rejecting it with the returned error if non-nil.
+	// It's called with the lock held, given the current stats, so it
+	// mustn't call back into the herder.
+	admit func(size uint64, stats appHerderStats) error
+
+	// Optional flow control system outside the node, see
+	// SetExternalBackpressure.
+	external externalBackpressure
+
+	// The query sub-quotas by queryOptions.Index, see
+	// SetIndexQueryQuota, and the memory used by the queries against
+	// each index.
+	indexQueryQuotas map[string]uint64
+	indexQueryUsed   map[string]uint64
+
+	// Outstanding reservations, and those by their queryOptions.Group.
+	reservations map[*queryReservation]struct{}
+	groups       map[string]map[*queryReservation]struct{}
+
+	// When enabled, the accounting is checked for consistency after
+	// every query start/end and index close.
+	checkInvariants     bool
+	invariantViolations uint64
+
+	// Strict accounting, meant for staging, additionally cross-checks
+	// the counters against the live reservations after every
+	// accounting change, including batch admissions and misc
+	// reservations, and panics on any violation.  It implies
+	// checkInvariants.
+	strictAccounting bool
+
+	// When enabled, onClose verifies the index it's given was tracked,
+	// logging and counting mismatches, which would show an index's key
+	// isn't stable across its lifecycle, such as over engine restarts.
+	verifyCloseKeys    bool
+	closeKeyMismatches uint64
+
+	// Optional recorder of estimated vs actual query memory, nil when
+	// calibration is disabled.
+	calibration *calibrationRecorder
+
+	// Optional admission latency recorders, nil when disabled.
+	queryAdmitLatency *latencyHistogram
+	batchAdmitLatency *latencyHistogram
+}
+
+func newAppHerder(memQuota uint64, appRatio, indexRatio,
+	queryRatio float64) *appHerder {
+	ah := &appHerder{
+		memQuota:   memQuota,
+		appRatio:   appRatio,
+		indexRatio: indexRatio,
+		queryRatio: queryRatio,
+		indexes:    map[interface{}]*indexEntry{},
+
+		memQuotaTarget:  memQuota,
+		memQuotaSources: map[string]uint64{defaultMemQuotaSource: memQuota},
+		memQuotaBinding: defaultMemQuotaSource,
+
+		reservations: map[*queryReservation]struct{}{},
+
+		indexQueryQuotas: map[string]uint64{},
+		indexQueryUsed:   map[string]uint64{},
+
+		ingestThrottleStart: defaultIngestThrottleStart,
+		compressedWeight:    1,
+		indexAlarmRearm:     defaultIndexAlarmRearm,
+
+		healthyStabilization: defaultHealthyStabilization,
+	}
+	ah.recomputeQuotasLOCKED()
+	ah.waitCond = sync.NewCond(&ah.m)
+	ah.batchCond = sync.NewCond(&ah.m)
+	return ah
+}
+
+// newAppHerderForRAMFraction returns an app herder whose memQuota is
+// the given fraction of the system's total RAM, as read at startup.
+func newAppHerderForRAMFraction(ramFraction, appRatio, indexRatio,
+	queryRatio float64) (*appHerder, error) {
+	ram, err := systemMemory()
+	if err != nil {
+		return nil, err
+	}
+	memQuota := uint64(float64(ram) * ramFraction)
+	log.Printf("app_herder: memQuota: %s, from fraction: %f of system"+
+		" memory: %s", fmtBytes(memQuota), ramFraction, fmtBytes(ram))
+	return newAppHerder(memQuota, appRatio, indexRatio, queryRatio), nil
+}
+
+// systemMemory returns the total RAM of the system, as reported by
+// /proc/meminfo.
+func systemMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, fmt.Errorf("app_herder: system memory, err: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("app_herder: parsing MemTotal: %q,"+
+					" err: %v", fields[1], err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, fmt.Errorf("app_herder: reading /proc/meminfo, err: %v", err)
+	}
+	return 0, fmt.Errorf("app_herder: no MemTotal in /proc/meminfo")
+}
+
+// quotaPolicy derives the app, index and query quotas from memQuota,
+// allowing for non-linear policies, such as shrinking the query quota
+// as the index count grows.  Quotas are only derived when memQuota,
+// the ratios or the index count change, not on every admission.
+type quotaPolicy interface {
+	Quotas(memQuota uint64, state quotaPolicyState) (
+		appQuota, indexQuota, queryQuota uint64)
+}
+
+// quotaPolicyState is the herder state a quotaPolicy may depend on.
+type quotaPolicyState struct {
+	AppRatio   float64
+	IndexRatio float64
+	QueryRatio float64
+	Indexes    int
+}
+
+// linearQuotaPolicy is the default quotaPolicy, multiplying memQuota
+// by the app ratio, and the appQuota by the index and query ratios.
+type linearQuotaPolicy struct{}
+
+func (linearQuotaPolicy) Quotas(memQuota uint64, state quotaPolicyState) (
+	appQuota, indexQuota, queryQuota uint64) {
+	appQuota = uint64(float64(memQuota) * state.AppRatio)
+	indexQuota = uint64(float64(appQuota) * state.IndexRatio)
+	queryQuota = uint64(float64(appQuota) * state.QueryRatio)
+	return appQuota, indexQuota, queryQuota
+}
+
+// SetQuotaPolicy replaces the quota policy, nil restoring the default
+// linearQuotaPolicy.
+func (a *appHerder) SetQuotaPolicy(p quotaPolicy) {
+	a.m.Lock()
+	a.quotaPolicy = p
+	a.recomputeQuotasLOCKED()
+	a.broadcastLOCKED()
+	a.m.Unlock()
+}
+
+// externalBackpressure integrates the herder with a flow control
+// system beyond the node, such as one balancing load across a cluster,
+// which is reported the herder's stats on every Tick, without the lock
+// held.
+type externalBackpressure interface {
+	Report(state appHerderStats)
+}
+
+// externalThrottle is optionally implemented by an
+// externalBackpressure that also makes the herder defer to its
+// decisions.  While ShouldThrottle returns true, queries are rejected
+// even if the local quotas have room.  It's called with the lock held,
+// on every query admission, so it should only check state it already
+// has, and mustn't call back into the herder.
+type externalThrottle interface {
+	ShouldThrottle() bool
+}
+
+// SetExternalBackpressure sets the external flow control system the
+// herder reports to, and obeys if it's an externalThrottle, nil
+// disabling the integration.
+func (a *appHerder) SetExternalBackpressure(b externalBackpressure) {
+	a.m.Lock()
+	a.external = b
+	a.refreshFastPathLOCKED()
+	a.m.Unlock()
+}
+
+// SetIndexQueryQuota sets the query sub-quota of an index, or group of
+// indexes, as named by queryOptions.Index, such as to keep a heavy
+// analytical index from crowding out a light interactive one.  Its
+// queries are then rejected once they'd exceed it, even if queryQuota
+// has room.  A zero quota removes the sub-quota.
+func (a *appHerder) SetIndexQueryQuota(index string, quota uint64) {
+	a.m.Lock()
+	if quota > 0 {
+		a.indexQueryQuotas[index] = quota
+	} else {
+		delete(a.indexQueryQuotas, index)
+	}
+	log.Printf("app_herder: index: %s query quota: %s", index,
+		fmtBytes(quota))
+	a.broadcastLOCKED() // Queries waiting on queryQuota may now fit.
+	a.m.Unlock()
+}
+
+// overIndexQueryQuotaLOCKED returns an error if a query of the given
+// size against index would exceed the index's query sub-quota.
+func (a *appHerder) overIndexQueryQuotaLOCKED(index string,
+	size uint64) error {
+	if a.unenforced || index == "" {
+		return nil
+	}
+	quota, exists := a.indexQueryQuotas[index]
+	if !exists || a.indexQueryUsed[index]+size <= quota {
+		return nil
+	}
+	return newQueryRejection(rejectIndexQueryQuota, fmt.Errorf("app_herder:"+
+		" this query %s plus running queries on index: %s, %s, would exceed"+
+		" its query quota: %s", fmtBytes(size), index,
+		fmtBytes(a.indexQueryUsed[index]), fmtBytes(quota)))
+}
+
+// externalThrottledLOCKED returns an error if the external flow
+// control system says to throttle queries.
+func (a *appHerder) externalThrottledLOCKED() error {
+	if a.unenforced {
+		return nil
+	}
+	if t, ok := a.external.(externalThrottle); ok && t.ShouldThrottle() {
+		return newQueryRejection(rejectExternal, fmt.Errorf("app_herder:"+
+			" queries throttled by external backpressure"))
+	}
+	return nil
+}
+
+// indexCountChangedLOCKED rederives the quotas when a custom quota
+// policy may depend on the index count.
+func (a *appHerder) indexCountChangedLOCKED() {
+	if a.quotaPolicy != nil && a.recomputeQuotasLOCKED() {
+		a.broadcastLOCKED()
+	}
+}
+
+// quotaSummary is what recomputeQuotasLOCKED logs.
+type quotaSummary struct {
+	memQuota, appQuota, indexQuota, queryQuota uint64
+	highlightQuota, sharedSlack                uint64
+	readOnly                                   bool
+}
+
+// recomputeQuotasLOCKED derives the app, index and query quotas from
+// the memQuota and ratios, through the quota policy, returning whether
+// they changed.  They're only logged when they do.
+func (a *appHerder) recomputeQuotasLOCKED() bool {
+	return a.updateQuotasLOCKED(true)
+}
+
+// updateQuotasLOCKED is recomputeQuotasLOCKED, logging changed quotas
+// only when logged is set.
+func (a *appHerder) updateQuotasLOCKED(logged bool) bool {
+	policy := a.quotaPolicy
+	if policy == nil {
+		policy = linearQuotaPolicy{}
+	}
+	a.appQuota, a.indexQuota, a.queryQuota = policy.Quotas(a.memQuota,
+		quotaPolicyState{
+			AppRatio:   a.appRatio,
+			IndexRatio: a.indexRatio,
+			QueryRatio: a.queryRatio,
+			Indexes:    len(a.indexes),
+		})
+	if a.readOnly {
+		a.indexQuota = 0
+		a.queryQuota = a.appQuota
+	}
+
+	// when the index and query ratios leave a gap, part of the
+	// appQuota is unreachable by either side unless the gap is shared
+	a.sharedSlack = 0
+	var reachable, slack uint64
+	if reachable = a.indexQuota + a.queryQuota; reachable < a.appQuota {
+		slack = a.appQuota - reachable
+		if a.shareSlack {
+			a.sharedSlack = slack
+			a.indexQuota += slack
+			a.queryQuota += slack
+		}
+	}
+
+	if a.indexMaxBytes > 0 && a.indexQuota > a.indexMaxBytes {
+		a.indexQuota = a.indexMaxBytes
+	}
+
+	a.highlightQuota = uint64(float64(a.queryQuota) * a.highlightRatio)
+
+	quotas := quotaSummary{a.memQuota, a.appQuota, a.indexQuota,
+		a.queryQuota, a.highlightQuota, a.sharedSlack, a.readOnly}
+	if quotas == a.loggedQuotas {
+		a.refreshFastPathLOCKED()
+		return false
+	}
+	a.loggedQuotas = quotas
+
+	if logged && a.sharedSlack > 0 {
+		log.Printf("app_herder: sharing unreachable appQuota: %s"+
+			" between indexing and queries", fmtBytes(slack))
+	} else if logged && slack > 0 {
+		log.Warnf("app_herder: only %s of appQuota: %s is reachable by"+
+			" indexing and queries, enable memShareRatioSlack to share"+
+			" the remaining %s", fmtBytes(reachable), fmtBytes(a.appQuota),
+			fmtBytes(slack))
+	}
+
+	if a.queryQuotaWarmup > 0 && a.queryQuota > a.warmQueryQuota {
+		// restarted from wherever a warmup in progress got to
+		a.queryWarmupFrom, a.queryWarmupStart = a.warmQueryQuota, time.Now()
+		if logged {
+			log.Printf("app_herder: warming queryQuota up from %s to %s",
+				fmtBytes(a.warmQueryQuota), fmtBytes(a.queryQuota))
+		}
+	} else {
+		a.warmQueryQuota, a.queryWarmupStart = a.queryQuota, time.Time{}
+	}
+
+	if logged {
+		log.Printf("app_herder: memQuota: %s, appQuota: %s, indexQutoa: %s, "+
+			"queryQuota: %s, highlightQuota: %s, readOnly: %t",
+			fmtBytes(a.memQuota), fmtBytes(a.appQuota), fmtBytes(a.indexQuota),
+			fmtBytes(a.queryQuota), fmtBytes(a.highlightQuota), a.readOnly)
+	}
+
+	a.refreshFastPathLOCKED()
+	return true
+}
+
+// UpdateMemQuota changes the memQuota, such as when the node's memory
+// allotment is resized, recomputing the derived quotas.  An absolute
+// indexMaxBytes cap still applies to the new indexQuota.  Like all
+// quota changes, it's done under the lock, so the stored ratios and
+// quotas are always consistent with each other, even when updates
+// race.  With a memQuotaMaxShrinkRate, a shrink only sets the target
+// that Tick ramps memQuota down to.  It updates the
+// defaultMemQuotaSource, so any tighter memQuota source still binds.
+func (a *appHerder) UpdateMemQuota(memQuota uint64) {
+	a.UpdateMemQuotaSource(defaultMemQuotaSource, memQuota)
+}
+
+// defaultMemQuotaSource is the memQuota source given to newAppHerder
+// and changed by UpdateMemQuota.
+const defaultMemQuotaSource = "memQuota"
+
+// UpdateMemQuotaSource sets the memQuota input from the named source,
+// adding the source if it's new, with memQuota becoming the minimum
+// across all the sources, so the node respects the tightest of them,
+// such as a cgroup limit the cluster manager doesn't know about.
+func (a *appHerder) UpdateMemQuotaSource(source string, memQuota uint64) {
+	a.m.Lock()
+	a.memQuotaSources[source] = memQuota
+	a.memQuotaSourcesChangedLOCKED()
+	a.m.Unlock()
+}
+
+// RemoveMemQuotaSource drops the named memQuota source, such as when a
+// cgroup limit is lifted, so the remaining sources set memQuota.  The
+// last source can't be removed.
+func (a *appHerder) RemoveMemQuotaSource(source string) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if _, exists := a.memQuotaSources[source]; !exists {
+		return fmt.Errorf("app_herder: unknown memQuota source: %q", source)
+	}
+	if len(a.memQuotaSources) == 1 {
+		return fmt.Errorf("app_herder: can't remove the only memQuota"+
+			" source: %q", source)
+	}
+	delete(a.memQuotaSources, source)
+	a.memQuotaSourcesChangedLOCKED()
+	return nil
+}
+
+// memQuotaSourcesChangedLOCKED applies the memQuota sources, or with
+// memQuotaCoalesce, has them applied once the window is up, whatever
+// further changes arrive meanwhile.
+func (a *appHerder) memQuotaSourcesChangedLOCKED() {
+	if a.memQuotaCoalesce <= 0 {
+		a.applyMemQuotaSourcesLOCKED()
+		return
+	}
+	if a.memQuotaTimer != nil {
+		a.memQuotaUpdatesCoalesced++
+		log.Printf("app_herder: coalescing memQuota update, superseding"+
+			" the pending one, coalesced: %d", a.memQuotaUpdatesCoalesced)
+		return
+	}
+	a.memQuotaTimer = time.AfterFunc(a.memQuotaCoalesce, func() {
+		a.m.Lock()
+		a.memQuotaTimer = nil
+		a.applyMemQuotaSourcesLOCKED()
+		a.m.Unlock()
+	})
+}
+
+// applyMemQuotaSourcesLOCKED sets memQuota to the minimum of the
+// memQuota sources, ties going to the first source by name, so the
+// binding source is stable.
+func (a *appHerder) applyMemQuotaSourcesLOCKED() {
+	binding, memQuota := "", uint64(0)
+	for source, q := range a.memQuotaSources {
+		if binding == "" || q < memQuota ||
+			(q == memQuota && source < binding) {
+			binding, memQuota = source, q
+		}
+	}
+	if binding != a.memQuotaBinding {
+		log.Printf("app_herder: memQuota source: %q now binding,"+
+			" memQuota: %s", binding, fmtBytes(memQuota))
+	}
+	a.memQuotaBinding = binding
+
+	a.memQuotaTarget = memQuota
+	if a.memQuotaMaxShrinkRate > 0 && memQuota < a.memQuota {
+		if a.memQuotaRampAt.IsZero() {
+			a.memQuotaRampAt = time.Now()
+		}
+		log.Printf("app_herder: ramping memQuota down from %s to %s",
+			fmtBytes(a.memQuota), fmtBytes(memQuota))
+	} else {
+		a.memQuota, a.memQuotaRampAt = memQuota, time.Time{}
+		a.recomputeQuotasLOCKED()
+		a.broadcastLOCKED()
+	}
+}
+
+// rampMemQuotaLOCKED shrinks memQuota towards memQuotaTarget by up to
+// memQuotaMaxShrinkRate per second since the last ramp step.
+func (a *appHerder) rampMemQuotaLOCKED(now time.Time) {
+	if a.memQuotaRampAt.IsZero() {
+		return
+	}
+	secs := now.Sub(a.memQuotaRampAt).Seconds()
+	if secs <= 0 {
+		return
+	}
+	step := uint64(secs * float64(a.memQuotaMaxShrinkRate))
+	if step == 0 {
+		return // Too soon to move, so the elapsed time accumulates.
+	}
+	a.memQuotaRampAt = now
+	if a.memQuota-a.memQuotaTarget <= step {
+		a.memQuota, a.memQuotaRampAt = a.memQuotaTarget, time.Time{}
+		log.Printf("app_herder: memQuota ramp down done")
+	} else {
+		a.memQuota -= step
+	}
+
+	// the quotas change on every step, so they're logged at most every
+	// memQuotaRampLogInterval until the ramp is done
+	logged := a.memQuotaRampAt.IsZero() ||
+		now.Sub(a.memQuotaRampLoggedAt) >= memQuotaRampLogInterval
+	if logged {
+		a.memQuotaRampLoggedAt = now
+	}
+	a.updateQuotasLOCKED(logged)
+}
+
+// memQuotaRampLogInterval is how often the quotas are logged while
+// memQuota ramps down.
+var memQuotaRampLogInterval = 10 * time.Second
+
+// warmQueryQuotaLOCKED raises warmQueryQuota linearly towards
+// queryQuota over the queryQuotaWarmup since queryWarmupStart.
+func (a *appHerder) warmQueryQuotaLOCKED(now time.Time) {
+	if a.queryWarmupStart.IsZero() {
+		return
+	}
+	elapsed := now.Sub(a.queryWarmupStart)
+	if elapsed >= a.queryQuotaWarmup {
+		a.warmQueryQuota, a.queryWarmupStart = a.queryQuota, time.Time{}
+		log.Printf("app_herder: queryQuota warmup done")
+	} else if elapsed > 0 {
+		a.warmQueryQuota = a.queryWarmupFrom +
+			uint64(float64(a.queryQuota-a.queryWarmupFrom)*
+				elapsed.Seconds()/a.queryQuotaWarmup.Seconds())
+	}
+	a.broadcastLOCKED() // Let waiting queries use the warmer quota.
+}
+
+// UpdateRatios changes the app, index and query ratios together,
+// recomputing the derived quotas.
+func (a *appHerder) UpdateRatios(appRatio, indexRatio, queryRatio float64) {
+	a.m.Lock()
+	a.appRatio, a.indexRatio, a.queryRatio = appRatio, indexRatio, queryRatio
+	a.recomputeQuotasLOCKED()
+	a.broadcastLOCKED()
+	a.m.Unlock()
+}
+
+// SetIndexMaxBytes caps indexQuota at an absolute size, whatever the
+// memQuota and ratios, with zero removing the cap.
+func (a *appHerder) SetIndexMaxBytes(indexMaxBytes uint64) {
+	a.m.Lock()
+	a.indexMaxBytes = indexMaxBytes
+	a.recomputeQuotasLOCKED()
+	a.broadcastLOCKED()
+	a.m.Unlock()
+}
+
+// SetQueryQuotaFloor guarantees queries up to queryQuotaFloor bytes of
+// memory, bounded by queryQuota, however much of appQuota indexing
+// holds, with zero removing the floor.
+func (a *appHerder) SetQueryQuotaFloor(queryQuotaFloor uint64) {
+	a.m.Lock()
+	a.queryQuotaFloor = queryQuotaFloor
+	a.refreshFastPathLOCKED()
+	a.broadcastLOCKED()
+	a.m.Unlock()
+}
+
+// SetShareSlack controls whether any part of appQuota left
+// unreachable by the index and query ratios is shared as elastic
+// headroom that either side can borrow, still bounded by appQuota.
+func (a *appHerder) SetShareSlack(shareSlack bool) {
+	a.m.Lock()
+	a.shareSlack = shareSlack
+	a.recomputeQuotasLOCKED()
+	a.broadcastLOCKED()
+	a.m.Unlock()
+}
+
+// SetHighlightRatio sets the fraction of queryQuota that highlighting
+// may use, with zero meaning highlighting is only bound by queryQuota.
+func (a *appHerder) SetHighlightRatio(ratio float64) {
+	a.m.Lock()
+	a.highlightRatio = ratio
+	a.recomputeQuotasLOCKED()
+	a.m.Unlock()
+}
+
+// SetReadOnly switches read-only replica mode on or off.  In
+// read-only mode the node does no indexing, so queries are given the
+// whole appQuota and don't pay for summing the index sizes.  Batches
+// arriving in this mode aren't registered or held back; they're
+// logged with a warning as they indicate a misconfigured node.
+func (a *appHerder) SetReadOnly(readOnly bool) {
+	a.m.Lock()
+	a.readOnly = readOnly
+	a.readOnlyWarned = false
+	a.recomputeQuotasLOCKED()
+	a.broadcastLOCKED()
+	a.m.Unlock()
+}
+
+// SetEnforcement turns backpressure on or off, such as for comparing
+// throughput in benchmarks.  While off, queries are always admitted and
+// batches never wait, but quotas are still checked and usage and
+// counters still updated.  It's on by default.
+func (a *appHerder) SetEnforcement(enforce bool) {
+	a.m.Lock()
+	if a.unenforced == !enforce {
+		a.m.Unlock()
+		return
+	}
+	a.unenforced = !enforce
+	a.broadcastLOCKED() // Release any waiters.
+	a.m.Unlock()
+	log.Printf("app_herder: backpressure enforcement: %t", enforce)
+}
+
+// PauseIndexing holds all batches, as if over the quotas, until
+// ResumeIndexing, such as during maintenance.  With holdQueries, such
+// as for a full-node freeze, queries are held too, rejected or, with
+// a MaxWait, waiting for the resume; otherwise, such as for index-only
+// maintenance, queries continue as normal.  Calling it again while
+// paused changes whether queries are held.
+func (a *appHerder) PauseIndexing(holdQueries bool) {
+	a.m.Lock()
+	a.indexingPaused, a.queriesHeld = true, holdQueries
+	a.refreshFastPathLOCKED()
+	a.broadcastLOCKED() // Let held queries resume if no longer held.
+	a.m.Unlock()
+	log.Printf("app_herder: indexing paused, queries held: %t", holdQueries)
+}
+
+// ResumeIndexing ends a PauseIndexing, releasing held batches and
+// queries.
+func (a *appHerder) ResumeIndexing() {
+	a.m.Lock()
+	if !a.indexingPaused {
+		a.m.Unlock()
+		return
+	}
+	a.indexingPaused, a.queriesHeld = false, false
+	a.refreshFastPathLOCKED()
+	a.broadcastLOCKED()
+	a.m.Unlock()
+	log.Printf("app_herder: indexing resumed")
+}
+
+// SetStartupGrace starts a grace window of duration d, beginning now,
+// during which quotas aren't enforced.
+func (a *appHerder) SetStartupGrace(d time.Duration) {
+	a.m.Lock()
+	a.graceUntil = time.Now().Add(d)
+	a.m.Unlock()
+	log.Printf("app_herder: startup grace window: %s", d)
+}
+
+func (a *appHerder) inStartupGraceLOCKED() bool {
+	return a.graceRemainingLOCKED() > 0
+}
+
+// GracePeriodRemaining returns how long until quotas are enforced after
+// a startup grace window, or zero once enforcing, so that traffic can
+// be held back until the herder starts protecting the node.
+func (a *appHerder) GracePeriodRemaining() time.Duration {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.graceRemainingLOCKED()
+}
+
+func (a *appHerder) graceRemainingLOCKED() time.Duration {
+	if a.graceUntil.IsZero() {
+		return 0
+	}
+	rv := time.Until(a.graceUntil)
+	if rv < 0 {
+		return 0
+	}
+	return rv
+}
+
+// *** Periodic Work
+
+// Tick performs the herder's periodic housekeeping as of now.  By
+// default it's driven by a goroutine started with RunTicker, but
+// embedders that don't allow libraries to spawn goroutines, or tests
+// wanting deterministic timing, can instead call it on their own
+// schedule.
+func (a *appHerder) Tick(now time.Time) {
+	// read before locking, as it stops the world
+	var heapInuse uint64
+	if a.heapDivergence > 0 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		heapInuse = ms.HeapInuse
+	}
+
+	a.m.Lock()
+	a.rampMemQuotaLOCKED(now)
+	a.warmQueryQuotaLOCKED(now)
+	if len(a.decaying) > 0 {
+		a.pruneDecayingLOCKED(now)
+		a.broadcastLOCKED() // Let waiters use the decayed memory.
+	}
+	if a.heapDivergence > 0 {
+		a.reconcileHeapLOCKED(heapInuse)
+	}
+	if a.thrash != nil {
+		a.thrash.roll(now)
+	}
+	if a.imbalance != nil {
+		a.checkQueryImbalanceLOCKED(now)
+	}
+	if !a.lastTick.IsZero() {
+		if secs := now.Sub(a.lastTick).Seconds(); secs > 0 {
+			a.persisterProgressRate = float64(a.totPersisterProgress-
+				a.lastTickPersisterProgress) / secs
+		}
+	}
+	a.lastTick, a.lastTickPersisterProgress = now, a.totPersisterProgress
+	if !a.readOnly && (a.escalateThrottleAfter > 0 ||
+		a.escalatePauseAfter > 0 || a.escalateFlushAfter > 0) {
+		a.escalateLOCKED(a.indexingMemoryLOCKED(), now)
+	}
+	a.refreshFastPathLOCKED()
+	external := a.external
+	var report appHerderStats
+	if external != nil {
+		report = a.statsLOCKED(a.lastIndexingMemoryLOCKED())
+	}
+	a.m.Unlock()
+
+	if external != nil {
+		external.Report(report)
+	}
+}
+
+// Escalation levels, see escalateThrottleAfter.
+const (
+	escalationNone = iota
+	escalationThrottle
+	escalationPause
+	escalationFlush
+)
+
+// Indexing memory at or above this fraction of indexQuota counts as
+// being at the ceiling for escalation.
+const escalationCeiling = 0.95
+
+// escalateLOCKED updates the escalation level given the indexing
+// memory as of now.
+func (a *appHerder) escalateLOCKED(indexingMem uint64, now time.Time) {
+	indexQuota := a.effectiveIndexQuotaLOCKED()
+	if indexQuota == 0 ||
+		float64(indexingMem) < escalationCeiling*float64(indexQuota) {
+		if a.escalation != escalationNone {
+			log.Printf("app_herder: indexing memory: %s off the ceiling,"+
+				" ending escalation level: %d", fmtBytes(indexingMem),
+				a.escalation)
+			a.escalation = escalationNone
+			a.broadcastLOCKED() // Resume any paused batches.
+		}
+		a.ceilingSince = time.Time{}
+		return
+	}
+
+	if a.ceilingSince.IsZero() {
+		a.ceilingSince = now
+	}
+	pinned := now.Sub(a.ceilingSince)
+
+	level := escalationNone
+	for i, after := range []time.Duration{a.escalateThrottleAfter,
+		a.escalatePauseAfter, a.escalateFlushAfter} {
+		if after > 0 && pinned >= after {
+			level = escalationThrottle + i
+		}
+	}
+	if level <= a.escalation {
+		return
+	}
+
+	log.Warnf("app_herder: indexing memory: %s at the index quota: %s"+
+		" for %s, escalating to level: %d; the persister may be"+
+		" under-provisioned", fmtBytes(indexingMem),
+		fmtBytes(indexQuota), pinned, level)
+
+	if level >= escalationFlush && a.escalation < escalationFlush &&
+		a.onMemoryPressure != nil {
+		go a.onMemoryPressure()
+	}
+	a.escalation = level
+}
+
+// RunTicker calls Tick every interval, forever.
+func (a *appHerder) RunTicker(interval time.Duration) {
+	log.Printf("app_herder: ticker interval: %s", interval)
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		a.Tick(now)
+	}
+}
+
+// *** Indexing Callbacks
+
+func (a *appHerder) onClose(c interface{}) {
+	a.m.Lock()
+
+	if a.waiting > 0 {
+		log.Printf("app_herder: close progress, waiting: %d", a.waiting)
+	}
+
+	if _, exists := a.indexes[c]; exists {
+		delete(a.indexes, c)
+		a.indexCountChangedLOCKED()
+	} else if a.verifyCloseKeys {
+		a.noteCloseKeyMismatchLOCKED(c)
+	}
+
+	// batches still waiting on the closed index would otherwise only
+	// resume, and be counted, on some later unrelated wakeup, so they
+	// are woken to abandon their wait and leave the waiters
+	abandoned := 0
+	for _, w := range a.waiters {
+		if w.index == c && w.err == nil {
+			w.err = fmt.Errorf("app_herder: index closed while its batch"+
+				" waited %s for memory", time.Since(w.since))
+			abandoned++
+		}
+	}
+	if abandoned > 0 {
+		log.Warnf("app_herder: index closed with batches still waiting"+
+			" for memory, abandoning: %d", abandoned)
+		a.broadcastLOCKED()
+	}
+
+	a.checkInvariantsLOCKED("onClose")
+
+	a.m.Unlock()
+}
+
+// noteCloseKeyMismatchLOCKED logs a close of untracked index c, along
+// with the tracked keys of the same type, one of which was likely
+// meant.  Closing an index that never had a batch is also reported.
+func (a *appHerder) noteCloseKeyMismatchLOCKED(c interface{}) {
+	a.closeKeyMismatches++
+
+	var candidates []string
+	for index, entry := range a.indexes {
+		if fmt.Sprintf("%T", index) == fmt.Sprintf("%T", c) {
+			candidates = append(candidates, indexName(index, entry))
+		}
+	}
+	sort.Strings(candidates)
+
+	log.Warnf("app_herder: close of untracked index: %T@%p, tracked"+
+		" indexes: %d, of the same type: %v", c, c, len(a.indexes),
+		candidates)
+}
+
+// SetIndexExcluded excludes index c from the quotas, or re-includes
+// it, such as while it's rebuilt from scratch, so its transient spike
+// doesn't stall indexing on the healthy indexes.  An excluded index is
+// still sampled, with its size logged and shown in Stats.
+func (a *appHerder) SetIndexExcluded(c interface{}, excluded bool) {
+	a.m.Lock()
+	entry := a.indexEntryLOCKED(c)
+	if entry.excluded != excluded {
+		entry.excluded = excluded
+		log.Printf("app_herder: index: %s excluded from quotas: %t,"+
+			" size: %s", indexName(c, entry), excluded,
+			fmtBytes(entry.lastSize))
+		if excluded {
+			a.broadcastLOCKED() // Its memory may be what others wait on.
+		}
+	}
+	a.m.Unlock()
+}
+
+// indexEntryLOCKED returns the entry of index c, starting to track it
+// if it's new.
+func (a *appHerder) indexEntryLOCKED(c interface{}) *indexEntry {
+	entry, exists := a.indexes[c]
+	if !exists {
+		entry = &indexEntry{}
+		a.indexes[c] = entry
+		a.indexCountChangedLOCKED()
+		if a.onIndexRegistered != nil {
+			a.onIndexRegistered(c)
+		}
+	}
+	return entry
+}
+
+// SetIndexAlarm sets the alarm thresholds of index c, as
+// indexOptions.AlarmBytes and AlarmRatio, re-arming its alarm.
+func (a *appHerder) SetIndexAlarm(c interface{}, alarmBytes uint64,
+	alarmRatio float64) {
+	a.m.Lock()
+	entry := a.indexEntryLOCKED(c)
+	entry.opts.AlarmBytes, entry.opts.AlarmRatio = alarmBytes, alarmRatio
+	entry.alarmed = false
+	a.m.Unlock()
+}
+
+// RegisterIndex starts tracking index c, ahead of its first batch,
+// with the given options.  The index is otherwise registered by its
+// first batch, with default options.
+func (a *appHerder) RegisterIndex(c interface{}, opts indexOptions) {
+	a.m.Lock()
+	entry := a.indexEntryLOCKED(c)
+	entry.opts = opts
+	a.m.Unlock()
+}
+
+func (a *appHerder) onBatchExecuteStart(c interface{}, s sizeFunc,
+	p statsErrPolicy, prio batchPriority) {
+	a.awaitBatch(context.Background(), c, s, p, prio, 0)
+}
+
+// RegisterAndAwaitBatch registers index c, if it's new, and admits its
+// batch, expected to add estimatedDelta bytes, waiting if needed, all
+// under one hold of the lock but for the waits themselves, so no other
+// goroutine sees the index registered without its size func, or its
+// pending batch unaccounted for.  The estimate counts towards the
+// index's size until the batch is admitted.  It returns an error if
+// ctx is done, or the index closes, before the batch is admitted.
+func (a *appHerder) RegisterAndAwaitBatch(ctx context.Context,
+	c interface{}, s sizeFunc, estimatedDelta uint64) error {
+	return a.awaitBatch(ctx, c, s, statsErrFailOpen, batchPriorityNormal,
+		estimatedDelta)
+}
+
+// awaitBatch admits a batch for index c, as onBatchExecuteStart, with
+// the batch's estimated delta counted towards the index until then,
+// or returns an error once ctx is done.
+func (a *appHerder) awaitBatch(ctx context.Context, c interface{},
+	s sizeFunc, p statsErrPolicy, prio batchPriority,
+	delta uint64) error {
+	start := time.Now()
+
+	a.m.Lock()
+
+	if a.readOnly {
+		if !a.readOnlyWarned {
+			log.Warnf("app_herder: batch received in read-only mode," +
+				" not registering or applying backpressure")
+			a.readOnlyWarned = true
+		}
+		a.m.Unlock()
+		return nil
+	}
+
+	entry := a.indexEntryLOCKED(c)
+	entry.size, entry.onStatsErr = s, p
+	entry.pendingDelta += delta
+	if prio < entry.opts.Priority {
+		prio = entry.opts.Priority
+	}
+
+	// sync.Cond can't select on ctx, so a goroutine wakes the waiter
+	// once ctx is done
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				a.m.Lock()
+				a.broadcastLOCKED()
+				a.m.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	err := a.spaceOutBatchLOCKED(ctx, c, entry)
+
+	var waited bool
+	var waitTime time.Duration
+	switch {
+	case err != nil:
+	case entry.opts.Exempt:
+		if a.waiting > 0 {
+			log.Printf("app_herder: exempt index proceeding without"+
+				" backpressure, while others are waiting: %d", a.waiting)
+		}
+	default:
+		waits, waitedBefore := entry.waits, entry.waitTime
+		err = a.awaitIndexingMemoryLOCKED(ctx, c, prio)
+		waited, waitTime = entry.waits > waits, entry.waitTime-waitedBefore
+	}
+	entry.pendingDelta -= delta
+	if err != nil {
+		log.Warnf("app_herder: batch abandoned, err: %v", err)
+		a.m.Unlock()
+		return err
+	}
+
+	if entry.batchesAdmitted == 0 {
+		entry.firstAdmit = time.Now()
+	}
+	entry.batchesAdmitted++
+	a.totBatchAdmitted++
+	if a.trackInFlight {
+		entry.introStartSize, entry.introStarted = entry.lastSize, true
+	}
+	if prio >= batchPriorityHigh {
+		a.totHighPriorityBatchAdmitted++
+	}
+
+	a.batchAdmitLatency.record(time.Since(start))
+	a.auditLOCKED(auditKindBatch, indexName(c, entry), entry.lastSize, nil)
+	if a.batchAdmissions != nil {
+		a.recordBatchAdmissionLOCKED(batchAdmission{
+			Time:           time.Now(),
+			Index:          indexName(c, entry),
+			IndexingMemory: a.lastIndexingMemoryLOCKED(),
+			IndexQuota:     a.indexQuota,
+			Exempt:         entry.opts.Exempt,
+			Priority:       prio,
+			Waited:         waited,
+			WaitTime:       waitTime,
+			Latency:        time.Since(start),
+		})
+	}
+
+	a.checkStrictLOCKED("onBatchExecuteStart")
+
+	a.m.Unlock()
+	return nil
+}
+
+// batchAdmission records why a batch was allowed to proceed, for
+// diagnosing backpressure after the fact.
+type batchAdmission struct {
+	Time  time.Time
+	Index string
+
+	// The indexing memory and indexQuota as of the admission.
+	IndexingMemory uint64
+	IndexQuota     uint64
+
+	Exempt   bool
+	Priority batchPriority
+
+	// Whether the batch waited on backpressure, and for how long, while
+	// Latency also includes any spacing out of the index's batches.
+	Waited   bool
+	WaitTime time.Duration
+	Latency  time.Duration
+}
+
+// recordBatchAdmissionLOCKED adds to the ring of recent batch
+// admissions, overwriting the oldest once it's full.
+func (a *appHerder) recordBatchAdmissionLOCKED(r batchAdmission) {
+	a.batchAdmissions[a.batchAdmissionCount%
+		uint64(len(a.batchAdmissions))] = r
+	a.batchAdmissionCount++
+}
+
+// RecentBatchAdmissions returns the most recent batch admissions,
+// oldest first, up to the memBatchAdmissionHistory, or nil when the
+// history is disabled.
+func (a *appHerder) RecentBatchAdmissions() []batchAdmission {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	size := uint64(len(a.batchAdmissions))
+	if size == 0 {
+		return nil
+	}
+	n, first := a.batchAdmissionCount, uint64(0)
+	if n > size {
+		n, first = size, a.batchAdmissionCount-size
+	}
+	rv := make([]batchAdmission, 0, n)
+	for i := first; i < a.batchAdmissionCount; i++ {
+		rv = append(rv, a.batchAdmissions[i%size])
+	}
+	return rv
+}
+
+// epochBytes is the memory added by an introduced epoch of an index.
+type epochBytes struct {
+	epoch uint64
+	bytes uint64
+}
+
+// onEpochIntroduced records that index c, now of the given size, has
+// introduced epoch, attributing its growth since the previous epoch to
+// that epoch.
+func (a *appHerder) onEpochIntroduced(c interface{}, epoch, size uint64) {
+	a.m.Lock()
+	if entry, exists := a.indexes[c]; exists {
+		var added uint64
+		if size > entry.epochLastSize {
+			added = size - entry.epochLastSize
+		}
+		if n := len(entry.epochs); n > 0 && entry.epochs[n-1].epoch >= epoch {
+			entry.epochs[n-1].bytes += added // No new epoch since.
+		} else {
+			entry.epochs = append(entry.epochs,
+				epochBytes{epoch: epoch, bytes: added})
+		}
+		entry.epochLastSize = size
+	}
+	a.m.Unlock()
+}
+
+// onEpochPersisted drops the epochs of index c up to and including the
+// persisted epoch.
+func (a *appHerder) onEpochPersisted(c interface{}, persisted uint64) {
+	a.m.Lock()
+	if entry, exists := a.indexes[c]; exists {
+		i := 0
+		for i < len(entry.epochs) && entry.epochs[i].epoch <= persisted {
+			i++
+		}
+		entry.epochs = append(entry.epochs[:0], entry.epochs[i:]...)
+	}
+	a.m.Unlock()
+}
+
+// bytesBehind returns the memory held by the index's unpersisted
+// epochs.
+func (entry *indexEntry) bytesBehind() (rv uint64) {
+	for _, e := range entry.epochs {
+		rv += e.bytes
+	}
+	return rv
+}
+
+// onBatchIntroduced tracks the memory a batch for index c added once
+// it's been introduced, when in-flight tracking is enabled.  The batch
+// is deemed persisted by the index's next persister progress.
+func (a *appHerder) onBatchIntroduced(c interface{}, s sizeFunc) {
+	if !a.trackInFlight {
+		return
+	}
+
+	size, err := s(c)
+
+	a.m.Lock()
+	entry, exists := a.indexes[c]
+	if exists && entry.introStarted && err == nil {
+		if size > entry.introStartSize {
+			entry.inFlight += size - entry.introStartSize
+		}
+		entry.introStarted = false
+	}
+	a.m.Unlock()
+}
+
+// spaceOutBatchLOCKED delays a batch for index c, waiting on the
+// waitCond, until the index's minimum batch interval has passed since
+// its previous admission.  Each delayed batch reserves the next slot,
+// so concurrent batches for an index are spaced out too, though never
+// more than an interval ahead, so a burst shares the last slot rather
+// than waiting an interval apiece.  It returns an error if ctx is
+// done, or the index closes, before the slot comes.
+func (a *appHerder) spaceOutBatchLOCKED(ctx context.Context,
+	c interface{}, entry *indexEntry) error {
+	interval := entry.opts.MinBatchInterval
+	if interval <= 0 {
+		interval = a.minBatchInterval
+	}
+
+	now := time.Now()
+	if interval <= 0 || entry.lastAdmit.IsZero() {
+		entry.lastAdmit = now
+		return nil
+	}
+
+	admitAt := entry.lastAdmit.Add(interval)
+	if !admitAt.After(now) {
+		entry.lastAdmit = now
+		return nil
+	}
+	if latest := now.Add(interval); admitAt.After(latest) {
+		admitAt = latest
+	}
+	entry.lastAdmit = admitAt
+
+	// sync.Cond can't wait with a deadline either, so a timer wakes
+	// the batch once its slot comes, while awaitBatch's goroutine wakes
+	// it once ctx is done
+	timer := time.AfterFunc(admitAt.Sub(now), func() {
+		a.m.Lock()
+		a.waitCond.Broadcast()
+		a.m.Unlock()
+	})
+	defer timer.Stop()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("app_herder: batch stopped waiting for its"+
+				" slot, err: %v", err)
+		}
+		if a.indexes[c] != entry {
+			return fmt.Errorf("app_herder: index closed while its batch" +
+				" was spaced out")
+		}
+		if !time.Now().Before(admitAt) {
+			return nil
+		}
+		a.waitCond.Wait()
+	}
+}
+
+// awaitIndexingMemoryLOCKED blocks a batch for index c until
+// indexing is back under its quotas, or ctx is done.  Normal batches
+// also keep waiting while any high priority batch is, so it's admitted
+// first.
+func (a *appHerder) awaitIndexingMemoryLOCKED(ctx context.Context,
+	c interface{}, prio batchPriority) error {
+	high := prio >= batchPriorityHigh
+	if high {
+		// normal batches deferring to this one are woken once it's
+		// done waiting
+		defer func() {
+			if a.waitingHighPriority == 0 && a.waiting > 0 {
+				a.broadcastLOCKED()
+			}
+		}()
+	}
+
+	// the wake burst that woke this batch, settled once it's admitted
+	// or waits again
+	var burst *wakeBurst
+	settle := func(admitted bool) {
+		if burst != nil {
+			a.settleWakeBurstLOCKED(burst, admitted)
+			burst = nil
+		}
+	}
+	defer settle(true)
+
+	waited, wokenBy := false, wakeSourceOther
+	for {
+		wakeGen := a.wakeGen
+		over := a.noteQuotaCheckLOCKED(a.overMemQuotaForIndexingLOCKED(prio))
+		deferred := !high && a.waitingHighPriority > 0
+		if !over && !deferred && !a.indexingPaused &&
+			a.escalation < escalationPause {
+			break
+		}
+
+		if a.inStartupGraceLOCKED() {
+			log.Printf("app_herder: startup grace, not waiting for memory")
+			break
+		}
+
+		if a.unenforced {
+			break
+		}
+
+		if a.wakeGen != wakeGen {
+			// Memory was freed while the index sizes were computed.
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			settle(false)
+			return fmt.Errorf("app_herder: batch stopped waiting for"+
+				" memory, err: %v", err)
+		}
+
+		// If we're over the memory quota, then wait for persister progress.
+
+		a.noteCulpritLOCKED()
+
+		log.Printf("app_herder: waiting for more memory to be available,"+
+			" largest index: %s, size: %s", a.culpritName,
+			fmtBytes(a.culpritSize))
+
+		settle(false)
+
+		w := &batchWaiter{index: c, since: time.Now(), priority: prio}
+		a.waiters = append(a.waiters, w)
+		waited = true
+
+		a.waiting++
+		if high {
+			a.waitingHighPriority++
+		}
+		generalWakes := a.generalWakes
+		for {
+			a.batchCond.Wait()
+			if w.selected || w.err != nil || a.generalWakes != generalWakes ||
+				ctx.Err() != nil {
+				break
+			}
+			// Passed over by the wake selector.
+		}
+		w.selected, w.wokenBy = false, a.lastWakeSource
+		if high {
+			a.waitingHighPriority--
+		}
+		a.waiting--
+
+		a.removeWaiterLOCKED(w)
+		if entry, exists := a.indexes[c]; exists {
+			entry.waitTime += time.Since(w.since)
+			entry.waits++
+		}
+		burst, wokenBy = w.burst, w.wokenBy
+		if w.err != nil {
+			settle(false)
+			return w.err
+		}
+
+		log.Printf("app_herder: resuming upon memory reduction ..")
+	}
+	if waited {
+		a.totBatchWaited++
+		a.wakeAdmits[wokenBy]++
+	}
+	return nil
+}
+
+// noteCulpritLOCKED records the largest index, as of the sizes just
+// sampled by the quota check, as the culprit of a backpressure wait.
+func (a *appHerder) noteCulpritLOCKED() {
+	var culprit interface{}
+	var culpritEntry *indexEntry
+	for c, entry := range a.indexes {
+		if entry.excluded {
+			continue
+		}
+		if culpritEntry == nil || entry.lastSize > culpritEntry.lastSize {
+			culprit, culpritEntry = c, entry
+		}
+	}
+	if culpritEntry != nil {
+		a.culpritName = indexName(culprit, culpritEntry)
+		a.culpritSize = culpritEntry.lastSize
+	}
+}
+
+// LastBackpressureCulprit returns the name and size of the largest
+// index when a batch most recently began waiting for memory, which is
+// usually the index whose growth caused the stall, or an empty name if
+// no batch has waited yet.
+func (a *appHerder) LastBackpressureCulprit() (string, uint64) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.culpritName, a.culpritSize
+}
+
+// IsUnderPressure returns whether the herder is currently holding work
+// back, with batches or queries waiting, escalation under way, or
+// indexing or the app as a whole over its quota.
+func (a *appHerder) IsUnderPressure() bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.waiting > 0 || len(a.queryWaiters) > 0 ||
+		a.escalation > escalationNone {
+		return true
+	}
+
+	var indexingMem uint64
+	if !a.readOnly {
+		indexingMem = a.indexingMemoryLOCKED()
+	}
+	return indexingMem > a.effectiveIndexQuotaLOCKED() ||
+		indexingMem+a.queryUsedLOCKED()+a.miscUsedLOCKED() > a.appQuota
+}
+
+// healthyPollInterval is how often WaitHealthy checks IsUnderPressure,
+// at most, as pressure can clear without the herder being told, such
+// as when an index shrinks.
+const healthyPollInterval = 100 * time.Millisecond
+
+// WaitHealthy waits until IsUnderPressure has been false for the
+// healthyStabilization period, such as for a supervisor to mark the
+// node ready only once the herder has settled after warmup, or returns
+// an error once ctx is done.
+func (a *appHerder) WaitHealthy(ctx context.Context) error {
+	a.m.Lock()
+	stabilization := a.healthyStabilization
+	a.m.Unlock()
+
+	interval := healthyPollInterval
+	if stabilization > 0 && stabilization/10 < interval {
+		interval = stabilization / 10
+	}
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var healthySince time.Time
+	for {
+		now := time.Now()
+		if a.IsUnderPressure() {
+			healthySince = time.Time{}
+		} else {
+			if healthySince.IsZero() {
+				healthySince = now
+			}
+			if now.Sub(healthySince) >= stabilization {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("app_herder: not healthy for %s, err: %v",
+				stabilization, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// IngestRateHint returns a multiplier in [0, 1] the ingestion layer
+// can apply to its fetch rate.  It's 1 until indexing memory reaches
+// the ingestThrottleStart fraction of indexQuota, then falls linearly
+// to 0 as indexing memory reaches indexQuota, throttling intake
+// smoothly before batches have to wait.
+func (a *appHerder) IngestRateHint() float64 {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.readOnly {
+		return 1
+	}
+	return a.ingestRateHintLOCKED(a.indexingMemoryLOCKED())
+}
+
+func (a *appHerder) ingestRateHintLOCKED(indexingMem uint64) float64 {
+	if a.escalation >= escalationThrottle {
+		return 0
+	}
+	indexQuota := a.effectiveIndexQuotaLOCKED()
+	if indexQuota == 0 {
+		if indexingMem > 0 {
+			return 0
+		}
+		return 1
+	}
+
+	used := float64(indexingMem) / float64(indexQuota)
+	if used <= a.ingestThrottleStart {
+		return 1
+	}
+	if used >= 1 || a.ingestThrottleStart >= 1 {
+		return 0
+	}
+	return (1 - used) / (1 - a.ingestThrottleStart)
+}
+
+func (a *appHerder) broadcastLOCKED() {
+	a.wakeGen++
+	a.generalWakes++
+	a.lastWakeSource = wakeSourceOther
+	a.waitCond.Broadcast()
+	a.batchCond.Broadcast()
+	a.wakeQueryLOCKED()
+}
+
+// signalLOCKED wakes the longest waiting batch, and none of the other
+// waiters.
+func (a *appHerder) signalLOCKED() {
+	a.wakeGen++
+	a.generalWakes++
+	a.lastWakeSource = wakeSourceOther
+	a.batchCond.Signal()
+}
+
+// wakeOthersLOCKED wakes the waiting queries and misc reservations,
+// but none of the batches.
+func (a *appHerder) wakeOthersLOCKED() {
+	a.wakeGen++
+	a.waitCond.Broadcast()
+	a.wakeQueryLOCKED()
+}
+
+// wakeQueryLOCKED wakes the query at the head of the queue, if any.
+func (a *appHerder) wakeQueryLOCKED() {
+	if len(a.queryWaiters) > 0 {
+		select {
+		case a.queryWaiters[0].wake <- struct{}{}:
+		default: // Already woken.
+		}
+	}
+}
+
+// wakeSource is what freed the memory behind a wakeup, as the waiters
+// can only run once the lock is released, set after waking them.
+type wakeSource int
+
+const (
+	wakeSourceOther wakeSource = iota
+	wakeSourcePersister
+	wakeSourceQuery
+
+	numWakeSources
+)
+
+// waitingBatch describes a waiting batch to a wakeSelector.
+type waitingBatch struct {
+	Index    string
+	Since    time.Time
+	Priority batchPriority
+}
+
+// wakeSelector chooses which of the waiting batches, oldest first, to
+// wake given the memory the persister just freed, returning their
+// positions in waiting.  It's called with the lock held, so it mustn't
+// call back into the herder.
+type wakeSelector func(waiting []waitingBatch, freed uint64) []int
+
+// SetWakeSelector has persister progress wake the waiting batches the
+// selector picks, such as for per-bucket round-robin fairness, or with
+// nil, restores the persisterWakeMode's first come, first served
+// order.  While high priority batches wait, they're all woken as
+// usual, so a selector can't starve them.
+func (a *appHerder) SetWakeSelector(s wakeSelector) {
+	a.m.Lock()
+	a.wakeSelector = s
+	a.m.Unlock()
+}
+
+// wakeSelectedLOCKED wakes the waiting batches the wakeSelector picks
+// given the freed memory, leaving the others waiting.
+func (a *appHerder) wakeSelectedLOCKED(freed uint64) {
+	waiting := make([]waitingBatch, len(a.waiters))
+	for i, w := range a.waiters {
+		waiting[i] = waitingBatch{Index: indexName(w.index, a.indexes[w.index]),
+			Since: w.since, Priority: w.priority}
+	}
+	var picked []*batchWaiter
+	for _, i := range a.wakeSelector(waiting, freed) {
+		if i >= 0 && i < len(a.waiters) && !a.waiters[i].selected {
+			a.waiters[i].selected = true
+			picked = append(picked, a.waiters[i])
+		}
+	}
+	if len(picked) == 0 {
+		return
+	}
+	a.markWakeBurstLOCKED(picked)
+	a.wakeGen++
+	a.batchCond.Broadcast()
+}
+
+// indexName returns how index c is identified in stats and logs.
+func indexName(c interface{}, entry *indexEntry) string {
+	if entry != nil && entry.opts.Name != "" {
+		return entry.opts.Name
+	}
+	return fmt.Sprintf("%T@%p", c, c)
+}
+
+func (a *appHerder) removeWaiterLOCKED(w *batchWaiter) {
+	for i, x := range a.waiters {
+		if x == w {
+			a.waiters = append(a.waiters[:i], a.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// lastIndexingMemoryLOCKED returns the indexing memory as of the last
+// sample, without running the size funcs.
+func (a *appHerder) lastIndexingMemoryLOCKED() (rv uint64) {
+	for _, entry := range a.indexes {
+		if !entry.excluded {
+			rv += entry.lastSize
+		}
+	}
+	return rv
+}
+
+// indexSizeSample is a snapshot of an index's size func, taken under
+// the lock so that the size func can be run without holding it.
+type indexSizeSample struct {
+	index interface{}
+	entry *indexEntry
+	size  sizeFunc
+	err   error
+	bytes uint64
+
+	breakdown                sizeBreakdownFunc
+	breakdownErr             error
+	compressed, uncompressed uint64
+}
+
+// indexingMemoryLOCKED returns the memory used by all the registered
+// indexes.  The size funcs are run with the lock released, so callers
+// read anything they compare the result against afterwards.
+func (a *appHerder) indexingMemoryLOCKED() (rv uint64) {
+	var excluded uint64
+	samples := make([]indexSizeSample, 0, len(a.indexes))
+	for index, entry := range a.indexes {
+		if entry.size == nil {
+			continue // registered, but no batches yet
+		}
+		samples = append(samples, indexSizeSample{index: index, entry: entry,
+			size: entry.size, breakdown: entry.opts.SizeBreakdown})
+	}
+
+	a.m.Unlock()
+	start := time.Now()
+	for i := range samples {
+		s := &samples[i]
+		s.bytes, s.err = s.size(s.index)
+		if s.breakdown != nil {
+			s.compressed, s.uncompressed, s.breakdownErr = s.breakdown(s.index)
+		}
+	}
+	sweep := time.Since(start)
+	a.m.Lock()
+	now := time.Now()
+
+	a.sizeSweeps++
+	a.sizeSweepTotal += sweep
+	a.sizeSweepLast, a.sizeSweepIndexes = sweep, len(samples)
+
+	for _, sample := range samples {
+		size := sample.bytes
+		if sample.err == nil {
+			a.checkSizeJumpLOCKED(sample.index, sample.entry, size)
+			size = a.weighCompressedLOCKED(sample, size)
+		} else {
+			if sample.entry.onStatsErr == statsErrFailClosed {
+				log.Warnf("app_herder: index size unavailable, failing closed,"+
+					" err: %v", sample.err)
+				size = a.indexQuota
+			} else {
+				log.Warnf("app_herder: index size unavailable, failing open,"+
+					" err: %v", sample.err)
+				size = 0
+			}
+		}
+		size = a.applyWarmupFloorLOCKED(sample.entry, size)
+		size += sample.entry.pendingDelta
+		sample.entry.lastSize = size
+		if sample.err == nil {
+			a.checkIndexAlarmLOCKED(sample.index, sample.entry, size)
+		}
+		if sample.entry.excluded {
+			excluded += size
+			continue
+		}
+		rv += size
+	}
+	a.excludedIndexingMemory = excluded
+	a.noteIndexTrendLOCKED(now, rv)
+	return
+}
+
+// weighCompressedLOCKED records the sample's compressed and
+// uncompressed bytes, returning the index's size with its compressed
+// bytes counted at compressedWeight.
+func (a *appHerder) weighCompressedLOCKED(sample indexSizeSample,
+	size uint64) uint64 {
+	if sample.breakdown == nil {
+		return size
+	}
+	if sample.breakdownErr != nil {
+		log.Warnf("app_herder: index size breakdown unavailable,"+
+			" counting its full size, index: %s, err: %v",
+			indexName(sample.index, sample.entry), sample.breakdownErr)
+		return size
+	}
+	sample.entry.compressedBytes = sample.compressed
+	sample.entry.uncompressedBytes = sample.uncompressed
+
+	if a.compressedWeight >= 1 {
+		return size
+	}
+	compressed := sample.compressed
+	if compressed > size {
+		compressed = size
+	}
+	return size - uint64(float64(compressed)*(1-a.compressedWeight))
+}
+
+// indexTrendSample is the indexing memory as sampled at a point in
+// time, see indexTrendWindow.
+type indexTrendSample struct {
+	at    time.Time
+	bytes uint64
+}
+
+// noteIndexTrendLOCKED adds a sample of the indexing memory to the
+// trend history, dropping samples older than the trend window.
+func (a *appHerder) noteIndexTrendLOCKED(now time.Time, indexingMem uint64) {
+	if a.indexTrendWindow <= 0 || a.indexTrendSensitivity <= 0 {
+		return
+	}
+	cutoff := now.Add(-a.indexTrendWindow)
+	i := 0
+	for i < len(a.indexTrend) && a.indexTrend[i].at.Before(cutoff) {
+		i++
+	}
+	a.indexTrend = append(a.indexTrend[i:],
+		indexTrendSample{at: now, bytes: indexingMem})
+}
+
+// indexTrendRateLOCKED returns the rate in bytes per second at which
+// indexing memory rose over the trend window, zero when it's not
+// rising or there's too little history.
+func (a *appHerder) indexTrendRateLOCKED() float64 {
+	if len(a.indexTrend) < 2 {
+		return 0
+	}
+	first, last := a.indexTrend[0], a.indexTrend[len(a.indexTrend)-1]
+	secs := last.at.Sub(first.at).Seconds()
+	if secs <= 0 || last.bytes <= first.bytes {
+		return 0
+	}
+	return float64(last.bytes-first.bytes) / secs
+}
+
+// projectedIndexingMemoryLOCKED returns the indexing memory queries
+// are admitted against given its current level, which is projected
+// ahead by the trend when it's rising.
+func (a *appHerder) projectedIndexingMemoryLOCKED(indexingMem uint64) uint64 {
+	rate := a.indexTrendRateLOCKED()
+	if rate <= 0 {
+		return indexingMem
+	}
+	return indexingMem + uint64(rate*a.indexTrendWindow.Seconds()*
+		a.indexTrendSensitivity)
+}
+
+// checkSizeJumpLOCKED flags an implausible change from the size last
+// reported for an index, when sizeJumpFactor is set.
+func (a *appHerder) checkSizeJumpLOCKED(c interface{}, entry *indexEntry,
+	size uint64) {
+	prev := entry.lastReported
+	entry.lastReported = size
+	if a.sizeJumpFactor <= 1 || prev == 0 {
+		return
+	}
+	if float64(size) > float64(prev)*a.sizeJumpFactor ||
+		float64(size)*a.sizeJumpFactor < float64(prev) {
+		entry.sizeJumps++
+		log.Warnf("app_herder: index: %s size jumped from %s to %s,"+
+			" beyond factor: %v, possible engine sizing bug",
+			indexName(c, entry), fmtBytes(prev), fmtBytes(size),
+			a.sizeJumpFactor)
+	}
+}
+
+// indexAlarmThresholdLOCKED returns the alarm threshold of the index,
+// zero for none.
+func (a *appHerder) indexAlarmThresholdLOCKED(entry *indexEntry) uint64 {
+	threshold := entry.opts.AlarmBytes
+	if entry.opts.AlarmRatio > 0 {
+		t := uint64(float64(a.indexQuota) * entry.opts.AlarmRatio)
+		if threshold == 0 || t < threshold {
+			threshold = t
+		}
+	}
+	return threshold
+}
+
+// checkIndexAlarmLOCKED fires onIndexAlarm as the index crosses its
+// alarm threshold, and re-arms the alarm once it drops back below
+// indexAlarmRearm of the threshold.
+func (a *appHerder) checkIndexAlarmLOCKED(c interface{}, entry *indexEntry,
+	size uint64) {
+	threshold := a.indexAlarmThresholdLOCKED(entry)
+	if threshold == 0 {
+		return
+	}
+	if entry.alarmed {
+		if float64(size) < float64(threshold)*a.indexAlarmRearm {
+			entry.alarmed = false
+		}
+		return
+	}
+	if size <= threshold {
+		return
+	}
+	entry.alarmed = true
+	a.totIndexAlarms++
+
+	log.Warnf("app_herder: index: %s size: %s beyond its alarm"+
+		" threshold: %s", indexName(c, entry), fmtBytes(size),
+		fmtBytes(threshold))
+
+	if a.onIndexAlarm != nil {
+		go a.onIndexAlarm(c, size, threshold)
+	}
+}
+
+// applyWarmupFloorLOCKED returns the size to account for an index
+// whose live size func reported size.  A warming index can briefly
+// report implausibly little memory, so until its live size first
+// reaches its warmup floor, the floor is used instead.
+func (a *appHerder) applyWarmupFloorLOCKED(entry *indexEntry,
+	size uint64) uint64 {
+	if entry.warmedUp {
+		return size
+	}
+	floor := entry.opts.WarmupFloor
+	if floor == 0 {
+		floor = a.warmupFloor
+	}
+	if size >= floor {
+		entry.warmedUp = true
+		return size
+	}
+	return floor
+}
+
+// noteUsageLOCKED checks the combined indexing and query memory
+// against the OOM-imminent threshold, firing OnOOMImminent once per
+// crossing with a diagnostic snapshot.  The snapshot is taken, and the
+// callback run, on another goroutine as the lock is held here.
+func (a *appHerder) noteUsageLOCKED(used uint64) {
+	if a.onOOMImminent == nil || a.oomImminentRatio <= 0 {
+		return
+	}
+
+	threshold := uint64(float64(a.memQuota) * a.oomImminentRatio)
+	if used < threshold {
+		a.oomImminent = false
+		return
+	}
+	if a.oomImminent {
+		return
+	}
+	a.oomImminent = true
+
+	log.Warnf("app_herder: OOM imminent, indexing plus query mem: %s,"+
+		" threshold: %s, memQuota: %s", fmtBytes(used),
+		fmtBytes(threshold), fmtBytes(a.memQuota))
+
+	go func(onOOMImminent func(oomSnapshot)) {
+		onOOMImminent(a.oomSnapshot())
+	}(a.onOOMImminent)
+}
+
+// zeroSizeQueryLOCKED applies the zeroSizePolicy to a query of the
+// given size, returning an error if it's to be rejected.
+func (a *appHerder) zeroSizeQueryLOCKED(size uint64, id string) error {
+	if size > 0 || a.zeroSizePolicy == zeroSizeAllow {
+		return nil
+	}
+	a.totZeroSizeQueries++
+	if a.zeroSizePolicy == zeroSizeWarn {
+		log.Warnf("app_herder: zero size query: %q admitted, its memory"+
+			" goes unaccounted", id)
+		return nil
+	}
+	return newQueryRejection(rejectZeroSize, fmt.Errorf("app_herder:"+
+		" zero size query: %q rejected, its size must be computed", id))
+}
+
+// queryBalanceLOCKED returns the queries ever started and ended, and
+// their bytes, including those of the fast path.
+func (a *appHerder) queryBalanceLOCKED() (started, ended, startedBytes,
+	endedBytes uint64) {
+	// the fast path claims fastUsed before it counts the admission, so
+	// its usage may run ahead of its admissions for a moment
+	fastQueries := uint64(atomic.LoadInt64(&a.fastQueries))
+	fastAdmitted := atomic.LoadUint64(&a.fastAdmitted)
+	fastUsed := atomic.LoadUint64(&a.fastUsed)
+	fastAdmittedBytes := atomic.LoadUint64(&a.fastAdmittedBytes)
+
+	started = a.totQueryAdmitted + fastAdmitted
+	ended = a.totQueryEnded
+	if fastAdmitted > fastQueries {
+		ended += fastAdmitted - fastQueries
+	}
+	startedBytes = a.totQueryAdmittedBytes + fastAdmittedBytes
+	endedBytes = a.totQueryEndedBytes
+	if fastAdmittedBytes > fastUsed {
+		endedBytes += fastAdmittedBytes - fastUsed
+	}
+	return started, ended, startedBytes, endedBytes
+}
+
+// outstandingQueries returns the queries started but not ended, zero
+// should more have ended, as on a mismatched EndQuery.
+func outstandingQueries(started, ended uint64) uint64 {
+	if ended > started {
+		return 0
+	}
+	return started - ended
+}
+
+// checkQueryImbalanceLOCKED feeds the outstanding queries to the
+// imbalance detector, warning when they grew throughout its window.
+func (a *appHerder) checkQueryImbalanceLOCKED(now time.Time) {
+	started, ended, startedBytes, endedBytes := a.queryBalanceLOCKED()
+	outstanding := outstandingQueries(started, ended)
+	baseline := a.imbalance.baseline
+	if a.imbalance.observe(outstanding, now) {
+		log.Warnf("app_herder: outstanding queries grew from %d to %d"+
+			" over %s without dropping back, started: %d (%s), ended:"+
+			" %d (%s); reservations may be leaking, missing their"+
+			" EndQuery", baseline, outstanding,
+			a.imbalance.window, started, fmtBytes(startedBytes), ended,
+			fmtBytes(endedBytes))
+	}
+}
+
+// noteQuotaCheckLOCKED feeds the outcome of a quota check to the
+// thrashing detector, returning over unchanged.
+func (a *appHerder) noteQuotaCheckLOCKED(over bool) bool {
+	if a.thrash != nil && a.thrash.observe(over, time.Now()) {
+		log.Warnf("app_herder: quota thrashing, %d boundary crossings"+
+			" within %s, usage is hovering at the quota; consider"+
+			" raising memQuota, lowering the indexing/querying"+
+			" fractions, or reducing batch and query sizes",
+			a.thrash.crossings, a.thrash.interval)
+	}
+	return over
+}
+
+func (a *appHerder) overMemQuotaForIndexingLOCKED(prio batchPriority) bool {
+	memUsed := a.indexingMemoryLOCKED()
+	a.noteUsageLOCKED(memUsed + a.queryUsedLOCKED() + a.miscUsedLOCKED())
+	a.refreshFastPathLOCKED()
+
+	// first make sure indexing (on it's own) doesn't exceed the
+	// index portion of the quota, less the high priority lane for
+	// normal batches
+	indexQuota := a.effectiveIndexQuotaLOCKED()
+	if prio < batchPriorityHigh {
+		indexQuota = a.normalIndexQuotaLOCKED()
+	}
+	if memUsed > indexQuota {
+		log.Printf("app_herder: indexing mem used %s over indexing quota %s",
+			fmtBytes(memUsed), fmtBytes(indexQuota))
+		return true
+	}
+
+	// second add in running queries and misc reservations and check
+	// combined app quota
+	indexingMem, queryUsed := memUsed, a.queryUsedLOCKED()
+	// indexing leaves room for the query floor, even when unused
+	if floor := a.queryFloorLOCKED(); queryUsed < floor {
+		memUsed += floor - queryUsed
+	}
+	memUsed += queryUsed + a.miscUsedLOCKED()
+	appQuota := a.appQuotaForIndexingLOCKED()
+	if memUsed > appQuota {
+		a.noteCombinedQuotaExceededLOCKED(indexingMem, queryUsed)
+		if a.combinedYield == yieldQueries {
+			log.Printf("app_herder: indexing mem plus query %s now over app"+
+				" quota %s, queries yielding", fmtBytes(memUsed),
+				fmtBytes(appQuota))
+			return false
+		}
+		log.Printf("app_herder: indexing mem plus query %s now over app quota %s",
+			fmtBytes(memUsed), fmtBytes(appQuota))
+	}
+	return memUsed > appQuota
+}
+
+// noteCombinedQuotaExceededLOCKED records indexing's share of the
+// indexing plus query memory when the combined appQuota is exceeded.
+func (a *appHerder) noteCombinedQuotaExceededLOCKED(indexingMem,
+	queryMem uint64) {
+	var share float64
+	if total := indexingMem + queryMem; total > 0 {
+		share = float64(indexingMem) / float64(total)
+	}
+	a.totCombinedQuotaExceeded++
+	a.combinedIndexShareSum += share
+	a.combinedIndexShareLast = share
+}
+
+// effectiveIndexQuotaLOCKED returns the indexQuota left once the
+// fixed overhead of every open index is taken out.
+func (a *appHerder) effectiveIndexQuotaLOCKED() uint64 {
+	return headroom(a.indexQuota,
+		a.perIndexOverhead*uint64(len(a.indexes)))
+}
+
+// normalIndexQuotaLOCKED returns the part of the effective indexQuota
+// normal priority batches may use, excluding the high priority lane.
+func (a *appHerder) normalIndexQuotaLOCKED() uint64 {
+	indexQuota := a.effectiveIndexQuotaLOCKED()
+	return indexQuota - uint64(float64(indexQuota)*a.highPriorityRatio)
+}
+
+// appQuotaForIndexingLOCKED returns the appQuota that indexing checks
+// the combined usage against, which shrinks while queries are running
+// if the arbitration weight favors queries.
+func (a *appHerder) appQuotaForIndexingLOCKED() uint64 {
+	appQuota := a.trackedAppQuotaLOCKED()
+	if a.arbitrationWeight > 0 && a.queryUsedLOCKED() > 0 {
+		return uint64(float64(appQuota) * (1 - a.arbitrationWeight))
+	}
+	return appQuota
+}
+
+// appQuotaForQueryLOCKED returns the appQuota that queries check the
+// combined usage against, which shrinks while indexing holds memory if
+// the arbitration weight favors indexing.
+func (a *appHerder) appQuotaForQueryLOCKED(indexingMem uint64) uint64 {
+	appQuota := a.trackedAppQuotaLOCKED()
+	if a.arbitrationWeight < 0 && indexingMem > 0 {
+		return uint64(float64(appQuota) * (1 + a.arbitrationWeight))
+	}
+	return appQuota
+}
+
+// trackedAppQuotaLOCKED returns the part of appQuota available to the
+// tracked usage, net of any untracked heap being accounted for.
+func (a *appHerder) trackedAppQuotaLOCKED() uint64 {
+	return headroom(a.appQuota, a.untrackedHeap)
+}
+
+// reconcileHeapLOCKED compares the heap in use with the usage tracked
+// by the herder plus the memQuota left outside of appQuota for the
+// rest of the process, warning when the heap is more than the
+// heapDivergence fraction of the tracked usage beyond that, and, if
+// heapScaleQuota is set, taking that untracked delta out of appQuota
+// until the two converge again.
+func (a *appHerder) reconcileHeapLOCKED(heapInuse uint64) {
+	a.heapInuse = heapInuse
+
+	tracked := a.lastIndexingMemoryLOCKED() + a.queryUsedLOCKED() +
+		a.miscUsedLOCKED()
+	untracked := headroom(heapInuse, tracked+headroom(a.memQuota, a.appQuota))
+	diverged := float64(untracked) > a.heapDivergence*float64(tracked)
+	if !diverged {
+		if a.untrackedHeap > 0 {
+			a.broadcastLOCKED()
+		}
+		a.heapDiverged, a.untrackedHeap = false, 0
+		return
+	}
+
+	if !a.heapDiverged {
+		log.Warnf("app_herder: heap in use: %s diverges from tracked"+
+			" usage: %s, untracked: %s, scaling quota: %t",
+			fmtBytes(heapInuse), fmtBytes(tracked),
+			fmtBytes(untracked), a.heapScaleQuota)
+		a.heapDiverged = true
+	}
+	if a.heapScaleQuota {
+		a.untrackedHeap = untracked
+	}
+}
+
+func (a *appHerder) onPersisterProgress(c interface{}) {
+	a.m.Lock()
+
+	a.totPersisterProgress++
+	freed := a.notePersistedLOCKED(c)
+
+	if a.waiting > 0 {
+		log.Printf("app_herder: persistence progress, waiting: %d", a.waiting)
+	}
+
+	// a signal could wake a normal batch that would just defer to a
+	// waiting high priority one, losing the wakeup; selective wakes
+	// only reach batches, so queries and misc reservations are woken
+	// to recheck separately
+	if a.wakeSelector != nil && a.waitingHighPriority == 0 {
+		a.wakeSelectedLOCKED(freed)
+		a.wakeOthersLOCKED()
+	} else if a.persisterWakeMode == wakeSignal && a.waitingHighPriority == 0 {
+		wake := a.persisterWakeCountLOCKED(freed)
+		a.startWakeBurstLOCKED(wake)
+		for i := 0; i < wake; i++ {
+			a.signalLOCKED()
+		}
+		a.wakeOthersLOCKED()
+	} else {
+		a.startWakeBurstLOCKED(a.waiting)
+		a.broadcastLOCKED()
+	}
+	a.lastWakeSource = wakeSourcePersister
+
+	a.m.Unlock()
+}
+
+// startWakeBurstLOCKED marks the longest waiting batches not already
+// in a burst, up to n of them, as about to be woken, firing
+// onWakeBurstStart unless a burst is still in progress, which they
+// then join.  The batchCond wakes waiters in the order they started
+// waiting, which is also the order of a.waiters.
+func (a *appHerder) startWakeBurstLOCKED(n int) {
+	if a.onWakeBurstStart == nil && a.onWakeBurstEnd == nil {
+		return
+	}
+	var ws []*batchWaiter
+	for _, w := range a.waiters {
+		if len(ws) >= n {
+			break
+		}
+		if w.burst == nil {
+			ws = append(ws, w)
+		}
+	}
+	a.markWakeBurstLOCKED(ws)
+}
+
+// markWakeBurstLOCKED adds the waiters about to be woken to the wake
+// burst, as startWakeBurstLOCKED, skipping any already in one.
+func (a *appHerder) markWakeBurstLOCKED(ws []*batchWaiter) {
+	if a.onWakeBurstStart == nil && a.onWakeBurstEnd == nil {
+		return
+	}
+	b := a.wakeBurst
+	if b == nil {
+		b = &wakeBurst{}
+	}
+	marked := 0
+	for _, w := range ws {
+		if w.burst == nil {
+			w.burst = b
+			marked++
+		}
+	}
+	if marked == 0 || a.wakeBurst != nil {
+		b.pending += marked
+		return
+	}
+	a.wakeBurst, b.pending = b, marked
+	b.started = make(chan struct{})
+	go func(onStart func(int), started chan struct{}) {
+		if onStart != nil {
+			onStart(marked)
+		}
+		close(started)
+	}(a.onWakeBurstStart, b.started)
+}
+
+// settleWakeBurstLOCKED records that a batch woken by burst b was
+// admitted or went back to waiting, firing onWakeBurstEnd once all of
+// its batches have.
+func (a *appHerder) settleWakeBurstLOCKED(b *wakeBurst, admitted bool) {
+	if admitted {
+		b.admitted++
+	}
+	b.pending--
+	if b.pending > 0 {
+		return
+	}
+	if a.wakeBurst == b {
+		a.wakeBurst = nil
+	}
+	if onEnd := a.onWakeBurstEnd; onEnd != nil {
+		go func(started chan struct{}, admitted int) {
+			<-started
+			onEnd(admitted)
+		}(b.started, b.admitted)
+	}
+}
+
+// notePersistedLOCKED accounts for persister progress of index c,
+// returning the memory freed since its size was last observed, or zero
+// if that can't be determined.  The size func is run unlocked.
+func (a *appHerder) notePersistedLOCKED(c interface{}) uint64 {
+	entry, exists := a.indexes[c]
+	if !exists {
+		return 0
+	}
+	entry.inFlight = 0
+	entry.persisterProgress++
+
+	s := entry.size
+	if s == nil {
+		return 0
+	}
+	a.m.Unlock()
+	size, err := s(c)
+	a.m.Lock()
+
+	// the index may have closed meanwhile; a sweep may also have seen
+	// a newer size, in which case freed is at worst an underestimate
+	if err != nil || a.indexes[c] != entry {
+		return 0
+	}
+	var freed uint64
+	if size < entry.lastSize {
+		freed = entry.lastSize - size
+	}
+	entry.lastSize = size
+	entry.persistedBytes += freed
+	return freed
+}
+
+// persisterWakeCountLOCKED returns how many waiters to wake given the
+// memory freed by the persister, at least one.
+func (a *appHerder) persisterWakeCountLOCKED(freed uint64) int {
+	wake := 1
+	if a.persisterWakeBatchSize > 0 {
+		wake += int(freed / a.persisterWakeBatchSize)
+	}
+	if wake > a.waiting {
+		wake = a.waiting
+	}
+	return wake
+}
+
+// *** Query Interface
+
+// queryOptions adjust how an individual query is admitted.
+type queryOptions struct {
+	// BypassQuota admits the query regardless of the quotas, while
+	// still counting its memory.  It's meant for critical internal
+	// queries, such as health probes, that must not be rejected, and
+	// every use is logged.
+	BypassQuota bool
+
+	// HighlightSize is the memory needed for highlighting/snippeting,
+	// on top of the query's base size, and is additionally checked
+	// against the highlight sub-quota.  When that's exhausted the
+	// query is still admitted, without the highlight memory, and
+	// OnHighlightDenied is called so it can skip highlighting.  If
+	// OnHighlightDenied is nil the query is rejected instead.
+	HighlightSize     uint64
+	OnHighlightDenied func()
+
+	// MaxWait, when positive, has a query that doesn't fit wait up to
+	// that long for memory to free up before being rejected, with
+	// waiting queries admitted in arrival order.
+	MaxWait time.Duration
+
+	// Group, when non-empty, tags the reservation so it can be
+	// released along with the rest of its group by ReleaseGroup, such
+	// as when a multi-step operation is aborted.
+	Group string
+
+	// ID optionally identifies the query in ActiveReservations.
+	ID string
+
+	// Index optionally names the index, or group of indexes, the query
+	// targets, so its memory is also checked against that index's query
+	// sub-quota, see SetIndexQueryQuota, and its usage shown in Stats.
+	Index string
+
+	// Protected marks the query, such as a critical admin operation,
+	// as never to be aborted by query eviction or any other memory
+	// relief mechanism, which must skip protected reservations.  Its
+	// memory is reported as pinned in the stats.
+	Protected bool
+
+	// Priority orders queries for preemption: with queryPreemption, a
+	// query that doesn't fit may abort enough lower priority queries
+	// to make room, calling their Cancel funcs, rather than be
+	// rejected.  Only queries with a Cancel func can be preempted, and
+	// their reservations are released for them, so ending one after
+	// its preemption returns an error.
+	Priority queryPriority
+	Cancel   func()
+}
+
+// queryPriority orders queries for preemption, see queryOptions.
+type queryPriority int
+
+const (
+	queryPriorityBackground queryPriority = iota - 1
+	queryPriorityNormal
+	queryPriorityCritical
+)
+
+// queryReservation is the memory held by a query admitted through
+// StartQueryWithOptions, released by calling End.  It remembers the
+// herder it was made by, so releasing it against another herder is
+// caught rather than corrupting both herders' accounting.
+type queryReservation struct {
+	herder    *appHerder
+	size      uint64
+	rawSize   uint64 // The size before queryQuantum.
+	highlight uint64
+	group     string
+	id        string
+	index     string
+	since     time.Time
+	protected bool
+	priority  queryPriority
+	cancel    func()
+	released  bool // Protected by herder.m.
+
+	// Set for reservations from the lock-free fast path, which are
+	// released atomically instead.
+	fast         bool
+	fastReleased uint32
+
+	// Closed once the reservation is released, when it's watched by
+	// StartQueryWithContext.
+	ended chan struct{}
+}
+
+// Highlight returns whether the query was granted its highlight
+// memory.
+func (r *queryReservation) Highlight() bool {
+	return r.highlight > 0
+}
+
+// Size returns the query's budget before the queryQuantum, which for a
+// best effort query may be less than asked for.
+func (r *queryReservation) Size() uint64 {
+	return r.rawSize
+}
+
+// Protected returns whether the query must never be evicted, see
+// queryOptions.Protected.
+func (r *queryReservation) Protected() bool {
+	return r.protected
+}
+
+func (r *queryReservation) End() error {
+	return r.herder.release(r, 0, false)
+}
+
+// EndWithActual is like End, also reporting the memory the query
+// actually used for the query cost calibration.
+func (r *queryReservation) EndWithActual(actual uint64) error {
+	return r.herder.release(r, actual, true)
+}
+
+// Release ends the query holding reservation r, returning an error,
+// and leaving the accounting untouched, if r was made by another
+// herder or has already been released.
+func (a *appHerder) Release(r *queryReservation) error {
+	return a.release(r, 0, false)
+}
+
+func (a *appHerder) release(r *queryReservation, actual uint64,
+	hasActual bool) error {
+	if r.herder != a {
+		log.Warnf("app_herder: release of a reservation: %s made by"+
+			" another herder, ignoring", fmtBytes(r.size+r.highlight))
+		return fmt.Errorf("app_herder: reservation belongs to another herder")
+	}
+
+	if r.fast {
+		if !atomic.CompareAndSwapUint32(&r.fastReleased, 0, 1) {
+			return fmt.Errorf("app_herder: reservation already released")
+		}
+		a.fastEndQuery(r.size)
+		atomic.AddUint64(&a.fastRawUsed, ^(r.rawSize - 1))
+		if r.ended != nil {
+			close(r.ended)
+		}
+		// while the fast path is enabled its whole budget counts as
+		// used, so only once it's disabled does this free memory
+		if atomic.LoadUint64(&a.fastBudget) == 0 {
+			a.m.Lock()
+			a.queriesEndedLOCKED()
+			a.m.Unlock()
+		}
+		return nil
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if r.released {
+		return fmt.Errorf("app_herder: reservation already released")
+	}
+	r.released = true
+
+	if hasActual {
+		a.calibration.record(r.size+r.highlight, actual)
+	}
+	a.releaseLOCKED(r)
+	a.queriesEndedLOCKED()
+	return nil
+}
+
+// ReleaseGroup releases every outstanding reservation made with the
+// given queryOptions.Group at once, waking waiters a single time, and
+// returns the number released.
+func (a *appHerder) ReleaseGroup(group string) int {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	n := 0
+	for r := range a.groups[group] {
+		a.releaseLOCKED(r)
+		n++
+	}
+	if n > 0 {
+		log.Printf("app_herder: released reservation group: %q,"+
+			" reservations: %d", group, n)
+		a.queriesEndedLOCKED()
+	}
+	a.checkInvariantsLOCKED("ReleaseGroup")
+	return n
+}
+
+// reservationInfo describes an outstanding query reservation.
+type reservationInfo struct {
+	ID        string
+	Group     string
+	Size      uint64 // Including Highlight.
+	Highlight uint64
+	Age       time.Duration
+	Protected bool
+}
+
+// ActiveReservations returns the outstanding query reservations,
+// oldest first, such as for tracking down a leaked reservation, along
+// with the number of queries running on the lock-free fast path.
+// Those aren't tracked one by one, to keep the lock off their path,
+// so they're counted in RunningQueries but missing from the list.
+func (a *appHerder) ActiveReservations() ([]reservationInfo, int) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	now := time.Now()
+	rv := make([]reservationInfo, 0, len(a.reservations))
+	for r := range a.reservations {
+		rv = append(rv, reservationInfo{
+			ID:        r.id,
+			Group:     r.group,
+			Size:      r.size + r.highlight,
+			Highlight: r.highlight,
+			Age:       now.Sub(r.since),
+			Protected: r.protected,
+		})
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Age > rv[j].Age })
+	return rv, int(atomic.LoadInt64(&a.fastQueries))
+}
+
+// releaseLOCKED drops reservation r from the accounting, without
+// waking any waiters.
+func (a *appHerder) releaseLOCKED(r *queryReservation) {
+	r.released = true
+	if r.ended != nil {
+		close(r.ended)
+	}
+	delete(a.reservations, r)
+	if r.group != "" {
+		delete(a.groups[r.group], r)
+		if len(a.groups[r.group]) == 0 {
+			delete(a.groups, r.group)
+		}
+	}
+	a.runningHighlightUsed -= r.highlight
+	a.runningQueryRawUsed -= r.rawSize + r.highlight
+	if r.index != "" {
+		a.indexQueryUsed[r.index] -= r.size + r.highlight
+		if a.indexQueryUsed[r.index] == 0 {
+			delete(a.indexQueryUsed, r.index)
+		}
+	}
+	a.dropQueryLOCKED(r.size + r.highlight)
+}
+
+// StartQuery admits a query of the given size, which is later ended by
+// size with EndQuery.  As such queries have no handle, they aren't
+// listed by ActiveReservations.
+func (a *appHerder) StartQuery(size uint64) error {
+	_, err := a.startQuery(size, queryOptions{}, false, false)
+	return err
+}
+
+func (a *appHerder) StartQueryWithOptions(size uint64,
+	opts queryOptions) (*queryReservation, error) {
+	if opts.HighlightSize == 0 && !opts.BypassQuota && opts.Group == "" &&
+		opts.ID == "" && opts.Index == "" && !opts.Protected &&
+		opts.Cancel == nil && opts.Priority == queryPriorityNormal &&
+		(size > 0 || a.zeroSizePolicy == zeroSizeAllow) {
+		if quantized := a.quantizeQuerySize(size); a.tryFastStartQuery(
+			quantized) {
+			atomic.AddUint64(&a.fastRawUsed, size)
+			return &queryReservation{herder: a, size: quantized,
+				rawSize: size, fast: true}, nil
+		}
+	}
+	return a.startQuery(size, opts, true, false)
+}
+
+// StartQueryWithContext is like StartQueryWithOptions, except that the
+// reservation is released automatically once ctx is done, such as on
+// a request's timeout or cancellation, should the caller not have
+// ended it by then, tying the reservation to the request's lifetime.
+// The release waits out the queryCancelGrace, so a query cleaning up
+// after its cancellation can still end it normally.
+func (a *appHerder) StartQueryWithContext(ctx context.Context,
+	size uint64, opts queryOptions) (*queryReservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("app_herder: query context done, err: %v",
+			err)
+	}
+
+	r, err := a.StartQueryWithOptions(size, opts)
+	if err != nil || ctx.Done() == nil {
+		return r, err
+	}
+
+	// a grouped reservation may be released by ReleaseGroup as soon as
+	// it's admitted, so the watch is set up under the lock
+	a.m.Lock()
+	if r.released {
+		a.m.Unlock()
+		return r, nil
+	}
+	r.ended = make(chan struct{})
+	grace := a.queryCancelGrace
+	a.m.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-r.ended:
+			return
+		}
+
+		if grace > 0 {
+			t := time.NewTimer(grace)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-r.ended:
+				return
+			}
+		}
+
+		if a.release(r, 0, false) == nil {
+			log.Warnf("app_herder: query context done before the query"+
+				" ended, released its reservation: %s, grace: %s, err: %v",
+				fmtBytes(r.size+r.highlight), grace, ctx.Err())
+			a.m.Lock()
+			a.totQueryContextReleased++
+			a.m.Unlock()
+		}
+	}()
+
+	return r, nil
+}
+
+// startQuery admits a query, tracking its reservation as active when
+// the caller holds on to it.  A best effort query that doesn't fit in
+// memory is granted whatever smaller budget the limits leave instead.
+func (a *appHerder) startQuery(size uint64, opts queryOptions,
+	tracked, bestEffort bool) (rv *queryReservation, err error) {
+	start := time.Now()
+	raw := size
+	size = a.quantizeQuerySize(size)
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	defer func() { a.queryAdmitLatency.record(time.Since(start)) }()
+
+	// the fast path is suspended so this query can use its budget
+	a.suspendFastPathLOCKED()
+	defer a.refreshFastPathLOCKED()
+
+	defer func() {
+		a.auditLOCKED(auditKindQuery, opts.ID, size+opts.HighlightSize, err)
+	}()
+
+	if err = a.zeroSizeQueryLOCKED(raw, opts.ID); err != nil {
+		return nil, a.rejectQueryLOCKED(err)
+	}
+
+	highlight := opts.HighlightSize
+
+	// waiting queries are admitted in arrival order, so a waiting
+	// query doesn't skip the queue even if it fits
+	queued := !a.unenforced && opts.MaxWait > 0 && len(a.queryWaiters) > 0
+	if !queued {
+		err = a.overQueryLimitsLOCKED(size + highlight)
+		a.noteQuotaCheckLOCKED(err != nil)
+		if err != nil && a.queryPreemption && !a.unenforced {
+			err = a.preemptForLOCKED(size+highlight, opts.Priority, opts.ID,
+				err)
+		}
+	}
+	if a.unenforced {
+		err = nil
+	}
+	if (queued || err != nil) && opts.MaxWait > 0 &&
+		!opts.BypassQuota && !a.inStartupGraceLOCKED() {
+		err = a.awaitQueryMemoryLOCKED(size+highlight, opts.MaxWait)
+	}
+	if err != nil && bestEffort && !opts.BypassQuota &&
+		!a.inStartupGraceLOCKED() {
+		size, raw, err = a.bestEffortGrantLOCKED(size, raw, highlight,
+			opts.Index, err)
+	}
+	if err != nil {
+		if opts.BypassQuota {
+			log.Printf("app_herder: quota bypass, admitting query %s anyway,"+
+				" err: %v", fmtBytes(size), err)
+		} else if a.inStartupGraceLOCKED() {
+			log.Printf("app_herder: startup grace, admitting query anyway,"+
+				" err: %v", err)
+		} else {
+			return nil, a.rejectQueryLOCKED(err)
+		}
+	} else if opts.BypassQuota {
+		log.Printf("app_herder: quota bypass used by query %s", fmtBytes(size))
+	} else if err = a.externalThrottledLOCKED(); err != nil {
+		return nil, a.rejectQueryLOCKED(err)
+	} else {
+		err = a.overIndexQueryQuotaLOCKED(opts.Index, size+highlight)
+		if err != nil && bestEffort {
+			size, raw, err = a.bestEffortGrantLOCKED(size, raw, highlight,
+				opts.Index, err)
+		}
+		if err != nil {
+			return nil, a.rejectQueryLOCKED(err)
+		}
+		if a.admit != nil && !a.unenforced {
+			// the policy sees the granted size
+			err = a.admit(size+highlight,
+				a.statsLOCKED(a.lastIndexingMemoryLOCKED()))
+			if err != nil {
+				// the policy's own error is returned as is
+				return nil, a.rejectQueryForLOCKED(rejectPolicy, err)
+			}
+		}
+	}
+
+	// the quota check may release the lock, so the highlight sub-quota
+	// is checked afterwards; dropping the highlight only shrinks the
+	// query, so it still fits
+	if !a.unenforced && highlight > 0 && a.highlightQuota > 0 &&
+		a.runningHighlightUsed+highlight > a.highlightQuota {
+		if opts.OnHighlightDenied == nil {
+			return nil, a.rejectQueryLOCKED(newQueryRejection(
+				rejectHighlightQuota, fmt.Errorf("app_herder: this"+
+					" query's highlighting %s plus running highlighting: %s"+
+					" would exceed highlight quota: %s", fmtBytes(highlight),
+					fmtBytes(a.runningHighlightUsed),
+					fmtBytes(a.highlightQuota))))
+		}
+		highlight = 0
+		opts.OnHighlightDenied()
+	}
+
+	// record the addition
+	a.runningQueryUsed += size + highlight
+	a.noteQueryUsedLOCKED()
+	a.runningHighlightUsed += highlight
+	a.runningQueries++
+	a.totQueryAdmitted++
+	a.totQueryAdmittedBytes += size + highlight
+	a.recordAdmissionsLOCKED(1, 0)
+
+	a.runningQueryRawUsed += raw + highlight
+
+	r := &queryReservation{herder: a, size: size, rawSize: raw,
+		highlight: highlight, group: opts.Group, id: opts.ID,
+		index: opts.Index, since: time.Now(),
+		protected: opts.Protected, priority: opts.Priority,
+		cancel: opts.Cancel}
+	if tracked {
+		a.reservations[r] = struct{}{}
+	}
+	if r.index != "" {
+		a.indexQueryUsed[r.index] += size + highlight
+	}
+	if r.group != "" {
+		if a.groups == nil {
+			a.groups = map[string]map[*queryReservation]struct{}{}
+		}
+		if a.groups[r.group] == nil {
+			a.groups[r.group] = map[*queryReservation]struct{}{}
+		}
+		a.groups[r.group][r] = struct{}{}
+	}
+
+	a.checkInvariantsLOCKED("StartQuery")
+
+	return r, nil
+}
+
+// preemptForLOCKED tries to make room for a query of the given size
+// and priority, rejected with err, by aborting unprotected
+// reservations of lower priority that have a cancel func, largest
+// first.  Nothing is aborted unless that would free enough memory.
+// It returns the error from rechecking the query, or err when nothing
+// was preempted.
+func (a *appHerder) preemptForLOCKED(size uint64, prio queryPriority,
+	id string, err error) error {
+	switch queryRejectReasonOf(err) {
+	case rejectQueryQuota, rejectAppQuota:
+	default:
+		return err // Preempting frees memory, not other limits.
+	}
+
+	// sampled first, as it releases the lock
+	admissible := a.maxAdmissibleQuerySizeLOCKED()
+	if admissible >= size {
+		return a.overQueryLimitsLOCKED(size) // Room freed meanwhile.
+	}
+	need := size - admissible
+
+	var victims []*queryReservation
+	for r := range a.reservations {
+		if r.priority < prio && r.cancel != nil && !r.protected {
+			victims = append(victims, r)
+		}
+	}
+	sort.Slice(victims, func(i, j int) bool {
+		return victims[i].size+victims[i].highlight >
+			victims[j].size+victims[j].highlight
+	})
+	var freed uint64
+	for i, r := range victims {
+		freed += r.size + r.highlight
+		if freed >= need {
+			victims = victims[:i+1]
+			break
+		}
+	}
+	if freed < need {
+		return err
+	}
+
+	for _, r := range victims {
+		log.Warnf("app_herder: preempting query: %q, priority: %d, size: %s,"+
+			" for query: %q, priority: %d, size: %s, err: %v", r.id,
+			r.priority, fmtBytes(r.size+r.highlight), id, prio,
+			fmtBytes(size), err)
+		a.releaseLOCKED(r)
+		a.totPreempted++
+		// the cancel func may well end the query, which needs the lock
+		go r.cancel()
+	}
+	a.broadcastLOCKED()
+
+	return a.overQueryLimitsLOCKED(size)
+}
+
+// StartQueryBestEffort is like StartQuery, except that a query that
+// doesn't fit is granted whatever smaller budget is available rather
+// than rejected, such as for a search that can return fewer hits or
+// skip facets instead of failing.  It returns the granted budget, which
+// the caller must adapt its plan to and later pass to EndQuery, or an
+// error when nothing is available.
+func (a *appHerder) StartQueryBestEffort(size uint64) (uint64, error) {
+	r, err := a.startQuery(size, queryOptions{}, false, true)
+	if err != nil {
+		return 0, err
+	}
+	return r.rawSize, nil
+}
+
+// StartQueryBestEffortWithOptions is like StartQueryBestEffort for a
+// query with options, such as a per-index sub-quota, returning its
+// reservation, whose Size is the granted budget.
+func (a *appHerder) StartQueryBestEffortWithOptions(size uint64,
+	opts queryOptions) (*queryReservation, error) {
+	return a.startQuery(size, opts, true, true)
+}
+
+// bestEffortGrantLOCKED returns the size, raw size and error a best
+// effort query of the given size, rejected with err, is admitted with
+// instead: the largest budget the query, app and index sub-quotas
+// leave, rounded down to the queryQuantum so it's accounted as is.
+// Only memory rejections are reduced, and one leaving no budget stands.
+// It's computed after the quota check's sampling, and reserved before
+// the lock is released again.
+func (a *appHerder) bestEffortGrantLOCKED(size, raw, highlight uint64,
+	index string, err error) (uint64, uint64, error) {
+	switch queryRejectReasonOf(err) {
+	case rejectQueryQuota, rejectAppQuota, rejectIndexQueryQuota:
+	default:
+		return size, raw, err
+	}
 
-	indexes map[interface{}]sizeFunc
+	granted := a.maxAdmissibleQuerySizeLOCKED()
+	if quota, exists := a.indexQueryQuotas[index]; exists && index != "" {
+		if room := headroom(quota, a.indexQueryUsed[index]); room < granted {
+			granted = room
+		}
+	}
+	granted = headroom(granted, highlight)
+	if a.queryQuantum > 0 {
+		granted -= granted % a.queryQuantum
+	}
+	if granted > raw {
+		granted = raw
+	}
+	if granted == 0 {
+		return size, raw, err
+	}
 
-	// Tracks the amount of memory used by running queries
-	runningQueryUsed uint64
+	log.Printf("app_herder: query %s granted a reduced budget: %s, err: %v",
+		fmtBytes(raw), fmtBytes(granted), err)
+	return granted, granted, nil
 }
 
-func newAppHerder(memQuota uint64, appRatio, indexRatio,
-	queryRatio float64) *appHerder {
-	ah := &appHerder{
-		memQuota: memQuota,
-		indexes:  map[interface{}]sizeFunc{},
+// overQueryLimitsLOCKED returns an error if queries are held, or a
+// query of the given size would exceed the concurrency cap or the
+// memory quotas.
+func (a *appHerder) overQueryLimitsLOCKED(size uint64) error {
+	if err := a.queriesHeldLOCKED(); err != nil {
+		return err
 	}
-	ah.appQuota = uint64(float64(ah.memQuota) * appRatio)
-	ah.indexQuota = uint64(float64(ah.appQuota) * indexRatio)
-	ah.queryQuota = uint64(float64(ah.appQuota) * queryRatio)
-	ah.waitCond = sync.NewCond(&ah.m)
-	log.Printf("app_herder: memQuota: %d, appQuota: %d, indexQutoa: %d, "+
-		"queryQuota: %d", memQuota, ah.appQuota, ah.indexQuota, ah.queryQuota)
-	return ah
+	if err := a.overMaxConcurrentQueriesLOCKED(); err != nil {
+		return err
+	}
+	return a.overMemQuotaForQueryLOCKED(size)
 }
 
-// *** Indexing Callbacks
+// queryWaiter tracks a query blocked in StartQueryWithOptions.
+type queryWaiter struct {
+	size  uint64
+	since time.Time
+	wake  chan struct{} // Buffered, so a wakeup is never lost.
+}
 
-func (a *appHerder) onClose(c interface{}) {
-	a.m.Lock()
+// awaitQueryMemoryLOCKED queues a query of the given size, admitting
+// it once it's at the head of the queue and fits, or returning an
+// error once it's waited maxWait.
+func (a *appHerder) awaitQueryMemoryLOCKED(size uint64,
+	maxWait time.Duration) error {
+	w := &queryWaiter{size: size, since: time.Now(),
+		wake: make(chan struct{}, 1)}
+	a.queryWaiters = append(a.queryWaiters, w)
 
-	if a.waiting > 0 {
-		log.Printf("app_herder: close progress, waiting: %d", a.waiting)
+	timer := time.NewTimer(maxWait)
+	defer func() {
+		timer.Stop()
+		for i, x := range a.queryWaiters {
+			if x == w {
+				a.queryWaiters = append(a.queryWaiters[:i],
+					a.queryWaiters[i+1:]...)
+				break
+			}
+		}
+		a.wakeQueryLOCKED() // Let the next waiter recheck.
+	}()
+
+	err := newQueryRejection(rejectQueued,
+		fmt.Errorf("app_herder: query queued behind: %d others",
+			len(a.queryWaiters)-1))
+	for {
+		if a.unenforced {
+			return nil
+		}
+		if a.queryWaiters[0] == w {
+			err = a.overQueryLimitsLOCKED(size)
+			if err == nil {
+				return nil
+			}
+		}
+
+		// a wakeup while the index sizes were sampled stays buffered,
+		// so it's seen here
+		a.m.Unlock()
+		select {
+		case <-w.wake:
+			a.m.Lock()
+		case <-timer.C:
+			a.m.Lock()
+			return newQueryRejection(queryRejectReasonOf(err),
+				fmt.Errorf("app_herder: query %s waited %s for"+
+					" memory, err: %v", fmtBytes(size), maxWait, err))
+		}
 	}
+}
 
-	delete(a.indexes, c)
+// rejectQueryLOCKED accounts for a rejected query, returning the
+// rejection err.
+func (a *appHerder) rejectQueryLOCKED(err error) error {
+	return a.rejectQueryForLOCKED(queryRejectReasonOf(err), err)
+}
 
-	a.m.Unlock()
+// rejectQueryForLOCKED is like rejectQueryLOCKED, for a rejection err
+// that doesn't carry its reason.
+func (a *appHerder) rejectQueryForLOCKED(reason queryRejectReason,
+	err error) error {
+	a.totQueryRejected++
+	if a.rejections != nil {
+		a.rejections.record(reason, time.Now())
+	}
+	a.recordAdmissionsLOCKED(0, 1)
+	return err
 }
 
-func (a *appHerder) onBatchExecuteStart(c interface{}, s sizeFunc) {
+// recordAdmissionsLOCKED adds to the admission rate window, along with
+// any fast path admissions since it was last updated.
+func (a *appHerder) recordAdmissionsLOCKED(admitted, rejected uint64) {
+	if a.admissions == nil {
+		return
+	}
+	fast := atomic.LoadUint64(&a.fastAdmitted)
+	admitted += fast - a.admissions.fastSeen
+	a.admissions.fastSeen = fast
+	a.admissions.record(admitted, rejected, time.Now())
+}
 
-	a.m.Lock()
+// queryRejectReason classifies why a query was rejected.
+type queryRejectReason int
 
-	a.indexes[c] = s
+const (
+	rejectOther queryRejectReason = iota
+	rejectQueryQuota
+	rejectAppQuota
+	rejectHighlightQuota
+	rejectConcurrency
+	rejectHeld
+	rejectPolicy // By the admit hook.
+	rejectQueued // While behind other waiting queries.
+	rejectExternal
+	rejectIndexQueryQuota
+	rejectZeroSize
 
-	for a.overMemQuotaForIndexingLOCKED() {
-		// If we're over the memory quota, then wait for persister progress.
+	numQueryRejectReasons
+)
 
-		log.Printf("app_herder: waiting for more memory to be available")
+func (r queryRejectReason) String() string {
+	switch r {
+	case rejectQueryQuota:
+		return "queryQuota"
+	case rejectAppQuota:
+		return "appQuota"
+	case rejectHighlightQuota:
+		return "highlightQuota"
+	case rejectConcurrency:
+		return "concurrency"
+	case rejectHeld:
+		return "held"
+	case rejectPolicy:
+		return "policy"
+	case rejectQueued:
+		return "queued"
+	case rejectExternal:
+		return "external"
+	case rejectIndexQueryQuota:
+		return "indexQueryQuota"
+	case rejectZeroSize:
+		return "zeroSize"
+	}
+	return "other"
+}
 
-		a.waiting++
-		a.waitCond.Wait()
-		a.waiting--
+// queryRejection is an admission error carrying its reason.
+type queryRejection struct {
+	reason queryRejectReason
+	err    error
+}
 
-		log.Printf("app_herder: resuming upon memory reduction ..")
+func newQueryRejection(reason queryRejectReason, err error) error {
+	return &queryRejection{reason: reason, err: err}
+}
+
+func (r *queryRejection) Error() string {
+	return r.err.Error()
+}
+
+// queryRejectReasonOf returns the reason of a rejection err.
+func queryRejectReasonOf(err error) queryRejectReason {
+	if r, ok := err.(*queryRejection); ok {
+		return r.reason
 	}
+	return rejectOther
+}
 
-	a.m.Unlock()
+// queriesHeldLOCKED returns an error if queries are held by a
+// PauseIndexing.
+func (a *appHerder) queriesHeldLOCKED() error {
+	if a.queriesHeld {
+		return newQueryRejection(rejectHeld,
+			fmt.Errorf("app_herder: queries held while indexing is paused"))
+	}
+	return nil
 }
 
-func (a *appHerder) indexingMemoryLOCKED() (rv uint64) {
-	for index, indexSizeFunc := range a.indexes {
-		rv += indexSizeFunc(index)
+// overMaxConcurrentQueriesLOCKED returns an error if starting another
+// query would exceed maxConcurrentQueries.
+func (a *appHerder) overMaxConcurrentQueriesLOCKED() error {
+	if a.maxConcurrentQueries > 0 &&
+		a.runningQueries >= a.maxConcurrentQueries {
+		return newQueryRejection(rejectConcurrency,
+			fmt.Errorf("app_herder: running queries: %d would exceed"+
+				" max concurrent queries: %d", a.runningQueries,
+				a.maxConcurrentQueries))
 	}
-	return
+	return nil
 }
 
-func (a *appHerder) overMemQuotaForIndexingLOCKED() bool {
-	memUsed := a.indexingMemoryLOCKED()
+// overMemQuotaForQueryLOCKED returns an error describing which quota
+// a query of the given size would exceed, or nil if it fits.
+func (a *appHerder) overMemQuotaForQueryLOCKED(size uint64) error {
+	// first make sure querying (on it's own) doesn't exceed the
+	// query portion of the quota, both before and after sampling the
+	// index sizes, as running queries may change while they're sampled
+	if err := a.overQueryQuotaLOCKED(size); err != nil {
+		return err
+	}
 
-	// first make sure indexing (on it's own) doesn't exceed the
-	// index portion of the quota
-	if memUsed > a.indexQuota {
-		log.Printf("app_herder: indexing mem used %d over indexing quota %d",
-			memUsed, a.indexQuota)
-		return true
+	var indexingMem uint64
+	if !a.readOnly {
+		indexingMem = a.indexingMemoryLOCKED()
+		if err := a.overQueryQuotaLOCKED(size); err != nil {
+			return err
+		}
+	}
+
+	a.noteUsageLOCKED(a.queryUsedLOCKED() + indexingMem + a.miscUsedLOCKED())
+
+	// second add in indexing, as projected by its trend, and misc
+	// reservations and check combined app quota
+	if !a.readOnly {
+		indexingMem = a.projectedIndexingMemoryLOCKED(indexingMem)
+	}
+	queryUsed := a.queryUsedForAdmissionLOCKED()
+	err := a.queryOverAppQuotaLOCKED(size, queryUsed, indexingMem)
+	if err != nil {
+		a.noteCombinedQuotaExceededLOCKED(indexingMem, queryUsed+size)
+	}
+	return err
+}
+
+func (a *appHerder) overQueryQuotaLOCKED(size uint64) error {
+	return a.queryOverQueryQuotaLOCKED(size,
+		a.queryUsedForAdmissionLOCKED())
+}
+
+// queryOverQueryQuotaLOCKED returns an error if a query of the given
+// size would exceed the query quota given the running query usage.
+func (a *appHerder) queryOverQueryQuotaLOCKED(size, queryUsed uint64) error {
+	if queryUsed+size > a.warmQueryQuota {
+		return newQueryRejection(rejectQueryQuota,
+			fmt.Errorf("app_herder: this query %s plus running queries: %s "+
+				"would exceed query quota: %s",
+				fmtBytes(size), fmtBytes(queryUsed), fmtBytes(a.warmQueryQuota)))
+	}
+	return nil
+}
+
+// queryOverAppQuotaLOCKED returns an error if a query of the given
+// size would exceed the app quota given the running query usage, the
+// indexing memory and the misc reservations.
+func (a *appHerder) queryOverAppQuotaLOCKED(size, queryUsed,
+	indexingMem uint64) error {
+	if queryUsed+size <= a.queryFloorLOCKED() {
+		return nil // Guaranteed whatever the indexing memory.
+	}
+	miscUsed := a.miscUsedLOCKED()
+	memUsed := queryUsed + size + indexingMem + miscUsed
+	appQuota := a.appQuotaForQueryLOCKED(indexingMem)
+	if memUsed > appQuota {
+		return newQueryRejection(rejectAppQuota,
+			fmt.Errorf("app_herder: this query %s plus running queries: %s "+
+				"plus indexing: %s plus misc: %s would exceed app quota: %s",
+				fmtBytes(size), fmtBytes(queryUsed),
+				fmtBytes(indexingMem), fmtBytes(miscUsed),
+				fmtBytes(appQuota)))
 	}
+	return nil
+}
+
+// queryFloorLOCKED returns the guaranteed query memory, see
+// queryQuotaFloor.
+func (a *appHerder) queryFloorLOCKED() uint64 {
+	if a.queryQuotaFloor > a.queryQuota {
+		return a.queryQuota
+	}
+	return a.queryQuotaFloor
+}
 
-	// second add in running queries and check combined app quota
-	memUsed += a.runningQueryUsed
-	if memUsed > a.appQuota {
-		log.Printf("app_herder: indexing mem plus query %d now over app quota %d",
-			memUsed, a.appQuota)
+// effectiveQueryQuotaLOCKED returns the query memory queries could
+// use in total given the indexing memory, which is queryQuota less
+// what indexing and misc reservations hold of appQuota, but no less
+// than the query floor.
+func (a *appHerder) effectiveQueryQuotaLOCKED(indexingMem uint64) uint64 {
+	rv := headroom(a.appQuotaForQueryLOCKED(indexingMem),
+		indexingMem+a.miscUsedLOCKED())
+	if rv > a.warmQueryQuota {
+		rv = a.warmQueryQuota
+	}
+	if floor := a.queryFloorLOCKED(); rv < floor {
+		rv = floor
 	}
-	return memUsed > a.appQuota
+	return rv
 }
 
-func (a *appHerder) onPersisterProgress() {
+// Evaluate returns whether a query of size reqSize would be admitted by
+// the memory quotas as they are now, were the indexing memory and the
+// running query usage as given, with the reason, for what-if capacity
+// planning.  It leaves the live accounting untouched, and takes the
+// current misc reservations and untracked heap into account, but not
+// the concurrency cap, highlight memory or queued queries.
+func (a *appHerder) Evaluate(indexing, query,
+	reqSize uint64) (admitted bool, reason string) {
 	a.m.Lock()
+	defer a.m.Unlock()
 
-	if a.waiting > 0 {
-		log.Printf("app_herder: persistence progress, waiting: %d", a.waiting)
+	if a.readOnly {
+		indexing = 0
 	}
 
-	a.waitCond.Broadcast()
+	err := a.queryOverQueryQuotaLOCKED(reqSize, query)
+	if err == nil {
+		err = a.queryOverAppQuotaLOCKED(reqSize, query, indexing)
+	}
+	if err != nil {
+		return false, err.Error()
+	}
+	return true, fmt.Sprintf("app_herder: this query %s fits query quota: %s"+
+		" and app quota: %s", fmtBytes(reqSize), fmtBytes(a.warmQueryQuota),
+		fmtBytes(a.appQuotaForQueryLOCKED(indexing)))
+}
+
+// queryUsedForAdmissionLOCKED returns the running query usage that
+// queries are admitted against, see querySmoothing.
+func (a *appHerder) queryUsedForAdmissionLOCKED() uint64 {
+	if a.querySmoothing > 0 {
+		return uint64(a.runningQueryAvg)
+	}
+	return a.queryUsedLOCKED()
+}
+
+// queryUsedLOCKED returns the memory of running queries, including the
+// fast path's budget, all of which may be claimed without the lock.
+func (a *appHerder) queryUsedLOCKED() uint64 {
+	return a.runningQueryUsed + a.fastReserved()
+}
+
+// fastReserved returns the query memory held by the fast path: its
+// whole budget while it's enabled, and whatever its queries still hold
+// once it's not.
+func (a *appHerder) fastReserved() uint64 {
+	budget := atomic.LoadUint64(&a.fastBudget)
+	if used := atomic.LoadUint64(&a.fastUsed); used > budget {
+		return used
+	}
+	return budget
+}
+
+// tryFastStartQuery admits a query of the given size from the fast
+// path's budget without taking the lock, returning false if it doesn't
+// fit, in which case the caller takes the locked path.
+func (a *appHerder) tryFastStartQuery(size uint64) bool {
+	if atomic.LoadUint64(&a.fastBudget) < size {
+		return false
+	}
+	// the budget is reread after claiming, as it may have just been
+	// lowered by refreshFastPathLOCKED under the lock
+	if atomic.AddUint64(&a.fastUsed, size) >
+		atomic.LoadUint64(&a.fastBudget) {
+		atomic.AddUint64(&a.fastUsed, ^(size - 1))
+		return false
+	}
+	atomic.AddInt64(&a.fastQueries, 1)
+	atomic.AddUint64(&a.fastAdmitted, 1)
+	atomic.AddUint64(&a.fastAdmittedBytes, size)
+	return true
+}
+
+// suspendFastPathLOCKED disables the fast path until the next refresh,
+// so its unused budget is available to a locked admission.
+func (a *appHerder) suspendFastPathLOCKED() {
+	if a.queryFastPath {
+		atomic.StoreUint64(&a.fastBudget, 0)
+	}
+}
 
+// SetQueryFastPath enables or disables the lock-free fast path for
+// small queries, once the rest of the herder is configured.
+func (a *appHerder) SetQueryFastPath(enabled bool) {
+	a.m.Lock()
+	a.suspendFastPathLOCKED()
+	a.queryFastPath = enabled
+	a.refreshFastPathLOCKED()
 	a.m.Unlock()
+	log.Printf("app_herder: query fast path: %t", enabled)
 }
 
-// *** Query Interface
+func (a *appHerder) fastEndQuery(size uint64) {
+	atomic.AddUint64(&a.fastUsed, ^(size - 1))
+	atomic.AddInt64(&a.fastQueries, -1)
+}
 
-func (a *appHerder) StartQuery(size uint64) error {
+// lockedAdmissionNeeds are the features that must see each query
+// admission under the lock while they're in use, so the fast path is
+// disabled meanwhile.  A feature with such a need adds its own entry.
+var lockedAdmissionNeeds = []struct {
+	feature string
+	needs   func(a *appHerder) bool
+}{
+	{"readOnly", func(a *appHerder) bool { return a.readOnly }},
+	{"queriesHeld", func(a *appHerder) bool { return a.queriesHeld }},
+	{"external", func(a *appHerder) bool { return a.external != nil }},
+	{"maxConcurrentQueries",
+		func(a *appHerder) bool { return a.maxConcurrentQueries > 0 }},
+	{"admit", func(a *appHerder) bool { return a.admit != nil }},
+	{"querySmoothing", func(a *appHerder) bool { return a.querySmoothing > 0 }},
+	{"calibration", func(a *appHerder) bool { return a.calibration != nil }},
+	{"checkInvariants", func(a *appHerder) bool { return a.checkInvariants }},
+	{"audit", func(a *appHerder) bool { return a.audit != nil }},
+	{"queryWaiters", func(a *appHerder) bool { return len(a.queryWaiters) > 0 }},
+	{"indexQueryQuotas",
+		func(a *appHerder) bool { return len(a.indexQueryQuotas) > 0 }},
+	{"zeroSizePolicy",
+		func(a *appHerder) bool { return a.zeroSizePolicy != zeroSizeAllow }},
+	{"queryPreemption", func(a *appHerder) bool { return a.queryPreemption }},
+	{"strictAccounting", func(a *appHerder) bool { return a.strictAccounting }},
+	{"unenforced", func(a *appHerder) bool { return a.unenforced }},
+	{"startupGrace", (*appHerder).inStartupGraceLOCKED},
+	{"queryQuantum", func(a *appHerder) bool { return a.queryQuantum > 0 }},
+}
+
+// lockedAdmissionNeededLOCKED returns the first feature that currently
+// needs locked query admissions, or "" when the fast path may be used.
+func (a *appHerder) lockedAdmissionNeededLOCKED() string {
+	for _, n := range lockedAdmissionNeeds {
+		if n.needs(a) {
+			return n.feature
+		}
+	}
+	return ""
+}
+
+// refreshFastPathLOCKED recomputes the fast path's budget, which keeps
+// usage below half of the query and app quotas, and is zero when a
+// feature needs to see each admission under the lock.  The locked
+// checks count the whole budget as used.
+func (a *appHerder) refreshFastPathLOCKED() {
+	if !a.queryFastPath {
+		return
+	}
+
+	var budget uint64
+	if a.lockedAdmissionNeededLOCKED() == "" {
+		fastUsed := atomic.LoadUint64(&a.fastUsed)
+		queryUsed := a.runningQueryUsed + fastUsed
+		indexingMem := a.projectedIndexingMemoryLOCKED(
+			a.lastIndexingMemoryLOCKED())
+		appUsed := queryUsed + indexingMem + a.miscUsedLOCKED()
+		appQuota := a.appQuotaForQueryLOCKED(indexingMem)
+		if queryUsed < a.warmQueryQuota/2 && appUsed < appQuota/2 {
+			budget = a.warmQueryQuota/2 - queryUsed
+			if appRoom := appQuota/2 - appUsed; appRoom < budget {
+				budget = appRoom
+			}
+			budget += fastUsed
+		}
+	}
+	atomic.StoreUint64(&a.fastBudget, budget)
+}
+
+// noteQueryUsedLOCKED folds a change of runningQueryUsed into its
+// moving average.
+func (a *appHerder) noteQueryUsedLOCKED() {
+	a.runningQueryAvg = a.querySmoothing*float64(a.runningQueryUsed) +
+		(1-a.querySmoothing)*a.runningQueryAvg
+}
+
+// MaxAdmissibleQuerySize returns the largest query size StartQuery
+// would currently admit, given the running queries and indexing.
+func (a *appHerder) MaxAdmissibleQuerySize() uint64 {
 	a.m.Lock()
 	defer a.m.Unlock()
-	memUsed := a.runningQueryUsed + size
+	return a.maxAdmissibleQuerySizeLOCKED()
+}
 
-	// first make sure querying (on it's own) doesn't exceed the
-	// query portion of the quota
-	if memUsed > a.queryQuota {
-		return fmt.Errorf("app_herder: this query %d plus running queries: %d "+
-			"would exceed query quota: %d",
-			size, a.runningQueryUsed, a.queryQuota)
+func (a *appHerder) maxAdmissibleQuerySizeLOCKED() uint64 {
+	var indexingMem uint64
+	if !a.readOnly {
+		indexingMem = a.indexingMemoryLOCKED()
 	}
 
-	// second add in indexing and check combined app quota
-	indexingMem := a.indexingMemoryLOCKED()
-	memUsed += indexingMem
-	if memUsed > a.appQuota {
-		return fmt.Errorf("app_herder: this query %d plus running queries: %d "+
-			"plus indexing: %d would exceed app quota: %d",
-			size, a.runningQueryUsed, indexingMem, a.appQuota)
+	queryUsed := a.queryUsedForAdmissionLOCKED()
+	rv := headroom(a.warmQueryQuota, queryUsed)
+	appRoom := headroom(a.appQuotaForQueryLOCKED(indexingMem),
+		queryUsed+indexingMem+a.miscUsedLOCKED())
+	if appRoom < rv {
+		rv = appRoom
 	}
+	return rv
+}
 
-	// record the addition
-	a.runningQueryUsed += size
-	return nil
+// fmtBytes formats a byte count for logging, as the raw count followed
+// by a human-readable size, e.g. "1073741824 (1.0 GiB)".
+func fmtBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d (%d B)", b, b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit && exp < 5; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%d (%.1f %ciB)", b,
+		float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// headroom returns how much of quota is left once used is taken out.
+func headroom(quota, used uint64) uint64 {
+	if used >= quota {
+		return 0
+	}
+	return quota - used
 }
 
 func (a *appHerder) EndQuery(size uint64) {
 	a.m.Lock()
+	a.endQueryLOCKED(size)
+	a.m.Unlock()
+}
+
+// EndQueryWithActual ends a query started with an estimated size,
+// also reporting the memory it actually used, which feeds the query
+// cost calibration when that's enabled.
+func (a *appHerder) EndQueryWithActual(size, actual uint64) {
+	a.m.Lock()
+	a.calibration.record(size, actual)
+	a.endQueryLOCKED(size)
+	a.m.Unlock()
+}
+
+func (a *appHerder) endQueryLOCKED(size uint64) {
+	if size == 0 && a.zeroSizePolicy != zeroSizeAllow {
+		log.Warnf("app_herder: query ended with zero size")
+	}
+	a.runningQueryRawUsed -= size
+	a.dropQueryLOCKED(a.quantizeQuerySize(size))
+	a.queriesEndedLOCKED()
+}
+
+// quantizeQuerySize returns the query size rounded up to the
+// queryQuantum, as it's accounted.
+func (a *appHerder) quantizeQuerySize(size uint64) uint64 {
+	q := a.queryQuantum
+	if q == 0 || size%q == 0 {
+		return size
+	}
+	return (size/q + 1) * q
+}
+
+func (a *appHerder) dropQueryLOCKED(size uint64) {
+	if a.checkInvariants && size > a.runningQueryUsed {
+		a.invariantViolatedLOCKED("EndQuery", fmt.Sprintf("ending query %d"+
+			" with only %d running", size, a.runningQueryUsed))
+	}
+
 	a.runningQueryUsed -= size
+	a.noteQueryUsedLOCKED()
+	a.totQueryEnded++
+	a.totQueryEndedBytes += size
 
+	a.queryEndedLOCKED("EndQuery")
+}
+
+// queryEndedLOCKED takes a query out of the running count, after
+// operation op, leaving its memory to the caller.
+func (a *appHerder) queryEndedLOCKED(op string) {
+	a.runningQueries--
+	a.checkInvariantsLOCKED(op)
+}
+
+// queriesEndedLOCKED wakes waiters after one or more queries ended.
+func (a *appHerder) queriesEndedLOCKED() {
 	if a.waiting > 0 {
 		log.Printf("app_herder: query ended, waiting: %d", a.waiting)
 	}
 
-	a.waitCond.Broadcast()
+	a.refreshFastPathLOCKED()
+
+	a.broadcastLOCKED()
+	a.lastWakeSource = wakeSourceQuery
+}
 
+// StartQueryAccountedElsewhere tracks a query whose memory has already
+// been reserved by another subsystem.  The query shows up in the
+// running query count, but its size isn't checked against or counted
+// towards the query quota, so it isn't double counted.
+func (a *appHerder) StartQueryAccountedElsewhere() {
+	a.m.Lock()
+	a.runningQueries++
+	a.runningQueriesElsewhere++
 	a.m.Unlock()
 }
 
+// EndQueryAccountedElsewhere ends a query started with
+// StartQueryAccountedElsewhere, waking any queries waiting on the
+// concurrency cap.  An unpaired end is logged and ignored.
+func (a *appHerder) EndQueryAccountedElsewhere() {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.runningQueriesElsewhere <= 0 {
+		log.Warnf("app_herder: EndQueryAccountedElsewhere without a" +
+			" running query accounted elsewhere, ignoring")
+		return
+	}
+	a.runningQueriesElsewhere--
+	a.queryEndedLOCKED("EndQueryAccountedElsewhere")
+	a.queriesEndedLOCKED()
+}
+
+// *** Misc Reservations
+
+// miscReservation is a handle on memory held outside of indexing and
+// querying, returned by ReserveMisc and ReserveRemaining.
+type miscReservation struct {
+	herder   *appHerder
+	size     uint64
+	released bool // Protected by herder.m.
+}
+
+// Size returns the memory held by the reservation.
+func (r *miscReservation) Size() uint64 {
+	return r.size
+}
+
+// Release gives the reserved memory back, waking any waiters.
+func (r *miscReservation) Release() error {
+	a := r.herder
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if r.released {
+		return fmt.Errorf("app_herder: misc reservation already released")
+	}
+	r.released = true
+
+	a.miscReserved -= r.size
+	log.Printf("app_herder: released misc reservation: %s", fmtBytes(r.size))
+	a.checkStrictLOCKED("miscRelease")
+	a.refreshFastPathLOCKED()
+	a.broadcastLOCKED()
+	return nil
+}
+
+// ReserveMisc reserves size bytes of app memory for a task outside of
+// indexing and querying, such as a rebalance snapshot, waiting until
+// it fits in appQuota and the miscMaxBytes cap, or returning an error
+// once ctx is done.  One larger than the cap is rejected at once.
+func (a *appHerder) ReserveMisc(ctx context.Context,
+	size uint64) (*miscReservation, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	a.suspendFastPathLOCKED()
+	defer a.refreshFastPathLOCKED()
+
+	// sync.Cond can't select on ctx, so a goroutine wakes the waiter
+	// once ctx is done
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				a.m.Lock()
+				a.broadcastLOCKED()
+				a.m.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	if a.miscMaxBytes > 0 && size > a.miscMaxBytes {
+		err := fmt.Errorf("app_herder: misc reservation %s would exceed"+
+			" misc cap: %s", fmtBytes(size), fmtBytes(a.miscMaxBytes))
+		a.auditLOCKED(auditKindMisc, "", size, err)
+		return nil, err
+	}
+
+	for {
+		wakeGen := a.wakeGen
+
+		var indexingMem uint64
+		if !a.readOnly {
+			indexingMem = a.indexingMemoryLOCKED()
+		}
+		used := a.queryUsedLOCKED() + indexingMem + a.miscUsedLOCKED()
+		appQuota := a.trackedAppQuotaLOCKED()
+		err := a.overMiscCapLOCKED(size)
+		if err == nil && used+size > appQuota {
+			err = fmt.Errorf("app_herder: misc reservation %s plus"+
+				" used: %s would exceed app quota: %s",
+				fmtBytes(size), fmtBytes(used), fmtBytes(appQuota))
+		}
+		if err == nil {
+			a.miscReserved += size
+			log.Printf("app_herder: reserved misc memory: %s", fmtBytes(size))
+			a.auditLOCKED(auditKindMisc, "", size, nil)
+			a.checkStrictLOCKED("ReserveMisc")
+			return &miscReservation{herder: a, size: size}, nil
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = fmt.Errorf("%v, err: %v", err, ctxErr)
+			a.auditLOCKED(auditKindMisc, "", size, err)
+			return nil, err
+		}
+
+		if a.wakeGen != wakeGen {
+			// Memory was freed while the index sizes were computed.
+			continue
+		}
+
+		a.waitCond.Wait()
+	}
+}
+
+// ReserveRemaining reserves all of the app memory not currently used
+// by indexing, queries or other misc reservations, such as for an
+// online backup, so indexing and queries back off until it's released.
+// It may be empty if no memory is free.
+func (a *appHerder) ReserveRemaining() *miscReservation {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	a.suspendFastPathLOCKED()
+	defer a.refreshFastPathLOCKED()
+
+	var indexingMem uint64
+	if !a.readOnly {
+		indexingMem = a.indexingMemoryLOCKED()
+	}
+
+	// sampling the index sizes releases the lock, so the free memory
+	// is computed against the query and misc usage as of now, and
+	// reserved before the lock is released again
+	size := headroom(a.trackedAppQuotaLOCKED(),
+		a.queryUsedLOCKED()+indexingMem+a.miscUsedLOCKED())
+	if capRoom := a.miscCapRoomLOCKED(); capRoom < size {
+		size = capRoom
+	}
+	a.miscReserved += size
+
+	log.Printf("app_herder: reserved remaining memory: %s", fmtBytes(size))
+	a.auditLOCKED(auditKindMisc, "", size, nil)
+	a.checkStrictLOCKED("ReserveRemaining")
+
+	return &miscReservation{herder: a, size: size}
+}
+
+// miscCapRoomLOCKED returns how much more misc memory, decaying or
+// not, the miscMaxBytes cap allows.
+func (a *appHerder) miscCapRoomLOCKED() uint64 {
+	if a.miscMaxBytes == 0 {
+		return math.MaxUint64
+	}
+	return headroom(a.miscMaxBytes, a.miscUsedLOCKED())
+}
+
+// overMiscCapLOCKED returns an error if a misc reservation of the
+// given size would exceed the miscMaxBytes cap.
+func (a *appHerder) overMiscCapLOCKED(size uint64) error {
+	if size <= a.miscCapRoomLOCKED() {
+		return nil
+	}
+	return fmt.Errorf("app_herder: misc reservation %s plus misc: %s"+
+		" would exceed misc cap: %s", fmtBytes(size),
+		fmtBytes(a.miscUsedLOCKED()), fmtBytes(a.miscMaxBytes))
+}
+
+// miscUsedLOCKED returns the memory held by misc reservations,
+// including what's left of the decaying ones.
+func (a *appHerder) miscUsedLOCKED() uint64 {
+	return a.miscReserved + a.decayingReservedLOCKED(time.Now())
+}
+
+// *** Invariants
+
+// maxSaneQueryUsed is well beyond any real amount of query memory, so a
+// runningQueryUsed above it means the counter has wrapped around.
+const maxSaneQueryUsed = math.MaxUint64 / 2
+
+// checkInvariantsLOCKED verifies the accounting is self-consistent
+// after operation op, when invariant checking is enabled, loudly
+// logging any violations.
+func (a *appHerder) checkInvariantsLOCKED(op string) {
+	if !a.checkInvariants {
+		return
+	}
+
+	if a.runningQueryUsed > maxSaneQueryUsed {
+		a.invariantViolatedLOCKED(op, fmt.Sprintf("runningQueryUsed wrapped: %d",
+			a.runningQueryUsed))
+	}
+	if a.runningHighlightUsed > a.runningQueryUsed {
+		a.invariantViolatedLOCKED(op, fmt.Sprintf("runningHighlightUsed: %d"+
+			" exceeds runningQueryUsed: %d",
+			a.runningHighlightUsed, a.runningQueryUsed))
+	}
+	if a.runningQueries < 0 || a.runningQueriesElsewhere < 0 ||
+		a.runningQueriesElsewhere > a.runningQueries {
+		a.invariantViolatedLOCKED(op, fmt.Sprintf("runningQueries: %d,"+
+			" runningQueriesElsewhere: %d",
+			a.runningQueries, a.runningQueriesElsewhere))
+	}
+	if a.waiting < 0 || a.waiting != len(a.waiters) {
+		a.invariantViolatedLOCKED(op, fmt.Sprintf("waiting: %d, waiters: %d",
+			a.waiting, len(a.waiters)))
+	}
+	for index, entry := range a.indexes {
+		if index == nil || entry == nil {
+			a.invariantViolatedLOCKED(op, fmt.Sprintf("index map has"+
+				" index: %v, entry: %v", index, entry))
+		}
+	}
+
+	a.checkStrictLOCKED(op)
+}
+
+// checkStrictLOCKED cross-checks the counters against the outstanding
+// reservations after operation op, in strict accounting mode.  As
+// size-based queries have no reservation, the running counters must
+// cover the reservations rather than match them, except for the
+// highlight memory, which only reservations hold.
+func (a *appHerder) checkStrictLOCKED(op string) {
+	if !a.strictAccounting {
+		return
+	}
+
+	var used, highlight uint64
+	indexUsed := map[string]uint64{}
+	for r := range a.reservations {
+		if r.released || r.fast {
+			a.invariantViolatedLOCKED(op, fmt.Sprintf("outstanding"+
+				" reservation: %s released: %t, fast: %t",
+				fmtBytes(r.size), r.released, r.fast))
+		}
+		used += r.size + r.highlight
+		highlight += r.highlight
+		if r.index != "" {
+			indexUsed[r.index] += r.size + r.highlight
+		}
+	}
+	for index, n := range a.indexQueryUsed {
+		if indexUsed[index] != n {
+			a.invariantViolatedLOCKED(op, fmt.Sprintf("index: %s query"+
+				" used: %d, reservations: %d", index, n, indexUsed[index]))
+		}
+	}
+	if used > a.runningQueryUsed {
+		a.invariantViolatedLOCKED(op, fmt.Sprintf("reservations: %d exceed"+
+			" runningQueryUsed: %d", used, a.runningQueryUsed))
+	}
+	if highlight != a.runningHighlightUsed {
+		a.invariantViolatedLOCKED(op, fmt.Sprintf("reservations' highlight:"+
+			" %d, runningHighlightUsed: %d", highlight, a.runningHighlightUsed))
+	}
+	if len(a.reservations) > a.runningQueries {
+		a.invariantViolatedLOCKED(op, fmt.Sprintf("reservations: %d exceed"+
+			" runningQueries: %d", len(a.reservations), a.runningQueries))
+	}
+	for group, rs := range a.groups {
+		for r := range rs {
+			if r.group != group {
+				a.invariantViolatedLOCKED(op, fmt.Sprintf("reservation of"+
+					" group: %q listed in group: %q", r.group, group))
+			}
+			if _, exists := a.reservations[r]; !exists && !r.released {
+				a.invariantViolatedLOCKED(op, fmt.Sprintf("group: %q has"+
+					" an untracked reservation", group))
+			}
+		}
+	}
+	if a.miscReserved > maxSaneQueryUsed {
+		a.invariantViolatedLOCKED(op, fmt.Sprintf("miscReserved wrapped: %d",
+			a.miscReserved))
+	}
+	if a.waitingHighPriority < 0 || a.waitingHighPriority > a.waiting {
+		a.invariantViolatedLOCKED(op, fmt.Sprintf("waitingHighPriority: %d,"+
+			" waiting: %d", a.waitingHighPriority, a.waiting))
+	}
+}
+
+func (a *appHerder) invariantViolatedLOCKED(op, msg string) {
+	a.invariantViolations++
+	log.Errorf("app_herder: INVARIANT VIOLATED after %s: %s", op, msg)
+	if a.strictAccounting {
+		panic("app_herder: strict accounting, invariant violated after " +
+			op + ": " + msg)
+	}
+}
+
+// *** Event Callback Wiring
+
+// AttachMoss hooks the herder into the given moss collection options,
+// so every collection opened with them is tracked.  Any OnEvent
+// callback already set on the options is still invoked.
+func (a *appHerder) AttachMoss(options *moss.CollectionOptions) {
+	onEvent := a.MossHerderOnEvent()
+	if prev := options.OnEvent; prev != nil {
+		options.OnEvent = func(event moss.Event) {
+			onEvent(event)
+			prev(event)
+		}
+		return
+	}
+	options.OnEvent = onEvent
+}
+
+// AttachScorch registers the herder's event callback with scorch
+// under the given name and, when a scorch config is provided, points
+// it at that callback.
+func (a *appHerder) AttachScorch(name string, config map[string]interface{}) {
+	scorch.RegistryEventCallbacks[name] = a.ScorchHerderOnEvent()
+	if config != nil {
+		config["eventCallbackName"] = name
+	}
+}
+
 // *** Moss Wrapper
 
 func (a *appHerder) MossHerderOnEvent() func(moss.Event) {
 	return func(event moss.Event) { a.onMossEvent(event) }
 }
 
-func mossSize(c interface{}) uint64 {
+func mossSize(c interface{}) (uint64, error) {
 	s, err := c.(moss.Collection).Stats()
 	if err != nil {
-		log.Warnf("app_herder: moss stats, err: %v", err)
-		return 0
+		return 0, fmt.Errorf("app_herder: moss stats, err: %v", err)
 	}
-	return s.CurDirtyBytes
+	return s.CurDirtyBytes, nil
 }
 
 func (a *appHerder) onMossEvent(event moss.Event) {
@@ -194,12 +4454,21 @@ func (a *appHerder) onMossEvent(event moss.Event) {
 		a.onClose(event.Collection)
 
 	case moss.EventKindBatchExecuteStart:
-		a.onBatchExecuteStart(event.Collection, mossSize)
+		a.onBatchExecuteStart(event.Collection, mossSize,
+			a.mossStatsErrPolicy, batchPriorityNormal)
+
+	case moss.EventKindBatchExecute:
+		a.onBatchIntroduced(event.Collection, mossSize)
 
 	case moss.EventKindPersisterProgress:
-		a.onPersisterProgress()
+		a.onPersisterProgress(event.Collection)
 
 	default:
+		// Moss fires no compaction start or stop events, only
+		// EventKindMergerProgress after the fact, so there's nothing to
+		// bracket a compaction with.  Its memory stays in the dirty
+		// bytes mossSize already counts until the persister reports
+		// progress.
 		return
 	}
 }
@@ -209,8 +4478,38 @@ func (a *appHerder) ScorchHerderOnEvent() func(scorch.Event) {
 	return func(event scorch.Event) { a.onScorchEvent(event) }
 }
 
-func scorchSize(s interface{}) uint64 {
-	return s.(*scorch.Scorch).MemoryUsed()
+func scorchSize(s interface{}) (uint64, error) {
+	return s.(*scorch.Scorch).MemoryUsed(), nil
+}
+
+// The scorch stats read for epoch tracking, as keyed by StatsMap.
+const (
+	scorchStatCurRootEpoch       = "CurRootEpoch"
+	scorchStatLastPersistedEpoch = "LastPersistedEpoch"
+)
+
+// scorchEpochs returns the current root and last persisted epochs from
+// a scorch StatsMap.
+func scorchEpochs(stats map[string]interface{}) (cur, persisted uint64,
+	ok bool) {
+	cur, curOk := stats[scorchStatCurRootEpoch].(uint64)
+	persisted, persistedOk := stats[scorchStatLastPersistedEpoch].(uint64)
+	return cur, persisted, curOk && persistedOk
+}
+
+// noteScorchEpochs attributes the growth of index c, now of the
+// given size, to its current root epoch, then drops the persisted
+// epochs, given its stats as of a persister progress.  Reading the
+// stats only then, rather than on every introduction, keeps their cost
+// off the batch path, at the price of coarser epochs.
+func (a *appHerder) noteScorchEpochs(c interface{},
+	stats map[string]interface{}, size uint64) {
+	cur, persisted, ok := scorchEpochs(stats)
+	if !ok {
+		return
+	}
+	a.onEpochIntroduced(c, cur, size)
+	a.onEpochPersisted(c, persisted)
 }
 
 func (a *appHerder) onScorchEvent(event scorch.Event) {
@@ -219,12 +4518,25 @@ func (a *appHerder) onScorchEvent(event scorch.Event) {
 		a.onClose(event.Scorch)
 
 	case scorch.EventKindBatchIntroductionStart:
-		a.onBatchExecuteStart(event.Scorch, scorchSize)
+		a.onBatchExecuteStart(event.Scorch, scorchSize, statsErrFailOpen,
+			batchPriorityNormal)
+
+	case scorch.EventKindBatchIntroduction:
+		a.onBatchIntroduced(event.Scorch, scorchSize)
 
 	case scorch.EventKindPersisterProgress:
-		a.onPersisterProgress()
+		if a.trackEpochs {
+			a.noteScorchEpochs(event.Scorch, event.Scorch.StatsMap(),
+				event.Scorch.MemoryUsed())
+		}
+		a.onPersisterProgress(event.Scorch)
 
 	default:
+		// The vendored scorch emits no merge task start or stop
+		// events, only CloseStart, Close, MergerProgress,
+		// PersisterProgress and the batch introduction ones, nor any
+		// event carrying the size of an in-flight merge.  A merge's
+		// transient memory is left to MemoryUsed until it does.
 		return
 	}
 }
@@ -0,0 +1,179 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// The kinds of admission decisions in the audit log.
+const (
+	auditKindQuery = "query"
+	auditKindBatch = "batch"
+	auditKindMisc  = "misc"
+)
+
+// auditRecord is one admission decision in the audit log, with the
+// usage resulting from it.  Reason is the error of a rejection, and
+// for queries, RejectReason is its classification.
+type auditRecord struct {
+	Time         time.Time
+	Kind         string
+	ID           string
+	Size         uint64
+	Admitted     bool
+	Reason       string
+	RejectReason string
+
+	QueryUsed      uint64
+	IndexingMemory uint64
+	MiscReserved   uint64
+}
+
+// auditLogBuffer is how many records may be queued for the audit
+// log's writer before further ones are dropped, and counted as errors,
+// rather than holding up admissions.
+const auditLogBuffer = 1024
+
+// auditLog is the audit sink.  Records are handed to its writer
+// goroutine, so neither their encoding nor the write happens under the
+// herder's lock.  When writing to a file, it's synced whenever the
+// queue drains, and on Close.
+type auditLog struct {
+	w    io.Writer
+	file *os.File // Nil unless writing to a file.
+
+	records chan auditRecord
+	done    chan struct{}
+	errors  uint64 // Accessed atomically.
+}
+
+func newAuditLog(w io.Writer) *auditLog {
+	l := &auditLog{
+		w:       w,
+		records: make(chan auditRecord, auditLogBuffer),
+		done:    make(chan struct{}),
+	}
+	l.file, _ = w.(*os.File)
+	go l.run()
+	return l
+}
+
+// openAuditLog opens the audit log at path for appending, creating
+// it if needed.
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return newAuditLog(f), nil
+}
+
+func (l *auditLog) run() {
+	defer close(l.done)
+	for rec := range l.records {
+		b, err := json.Marshal(rec)
+		if err == nil {
+			_, err = l.w.Write(append(b, '\n'))
+		}
+		if err == nil && l.file != nil && len(l.records) == 0 {
+			err = l.file.Sync()
+		}
+		if err != nil {
+			l.failed(err)
+		}
+	}
+}
+
+// record queues rec for the writer, dropping it if the queue is full.
+func (l *auditLog) record(rec auditRecord) {
+	select {
+	case l.records <- rec:
+	default:
+		l.failed(fmt.Errorf("app_herder: audit queue full, record dropped"))
+	}
+}
+
+func (l *auditLog) failed(err error) {
+	errors := atomic.AddUint64(&l.errors, 1)
+	log.Warnf("app_herder: audit record, errors: %d, err: %v", errors, err)
+}
+
+// Errors returns the records that couldn't be written.
+func (l *auditLog) Errors() uint64 {
+	return atomic.LoadUint64(&l.errors)
+}
+
+// Close waits for the queued records to be written, then syncs and
+// closes the file, if any.  Nothing may be recorded once it's called.
+func (l *auditLog) Close() error {
+	close(l.records)
+	<-l.done
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Sync()
+	if errClose := l.file.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// CloseAuditLog stops auditing, returning once the records so far
+// are written and the audit log is closed.
+func (a *appHerder) CloseAuditLog() error {
+	a.m.Lock()
+	l := a.audit
+	a.audit = nil
+	a.refreshFastPathLOCKED()
+	a.m.Unlock()
+	if l == nil {
+		return nil
+	}
+	return l.Close()
+}
+
+// auditLOCKED records the admission decision for a request of size
+// bytes from requester id, rejected if err is non-nil, to the audit
+// log when there is one.  Failed writes are counted and logged, but
+// never fail the request.
+func (a *appHerder) auditLOCKED(kind, id string, size uint64, err error) {
+	if a.audit == nil {
+		return
+	}
+
+	rec := auditRecord{
+		Time:     time.Now(),
+		Kind:     kind,
+		ID:       id,
+		Size:     size,
+		Admitted: err == nil,
+
+		QueryUsed:      a.queryUsedLOCKED(),
+		IndexingMemory: a.lastIndexingMemoryLOCKED(),
+		MiscReserved:   a.miscUsedLOCKED(),
+	}
+	if err != nil {
+		rec.Reason = err.Error()
+		if kind == auditKindQuery {
+			rec.RejectReason = queryRejectReasonOf(err).String()
+		}
+	}
+	a.audit.record(rec)
+}
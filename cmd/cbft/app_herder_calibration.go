@@ -0,0 +1,64 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"sort"
+)
+
+// calibrationWindow is the number of recent queries whose estimate
+// ratios are kept for percentiles.
+const calibrationWindow = 1024
+
+// calibrationRecorder tracks how the actual memory used by queries
+// compares with the estimates they were admitted with, so operators
+// can recalibrate their estimates.  It relies on the herder's lock.
+type calibrationRecorder struct {
+	count  uint64
+	sum    float64
+	recent [calibrationWindow]float64
+}
+
+func newCalibrationRecorder() *calibrationRecorder {
+	return &calibrationRecorder{}
+}
+
+func (c *calibrationRecorder) record(estimate, actual uint64) {
+	if c == nil || estimate == 0 {
+		return
+	}
+	ratio := float64(actual) / float64(estimate)
+	c.recent[c.count%calibrationWindow] = ratio
+	c.count++
+	c.sum += ratio
+}
+
+func (c *calibrationRecorder) mean() float64 {
+	if c.count == 0 {
+		return 0
+	}
+	return c.sum / float64(c.count)
+}
+
+func (c *calibrationRecorder) percentile(p float64) float64 {
+	n := c.count
+	if n > calibrationWindow {
+		n = calibrationWindow
+	}
+	if n == 0 {
+		return 0
+	}
+	sorted := make([]float64, n)
+	copy(sorted, c.recent[:n])
+	sort.Float64s(sorted)
+	return sorted[int(p*float64(n-1))]
+}
@@ -0,0 +1,120 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// decayingReservation is misc memory that frees itself linearly over
+// its decay period, for transient uses such as warmup buffers that are
+// hard to release precisely.  What's left of it is computed when read,
+// so it needs no goroutine of its own.
+type decayingReservation struct {
+	herder   *appHerder
+	size     uint64
+	start    time.Time
+	decay    time.Duration
+	released bool // Protected by herder.m.
+}
+
+// ReserveDecaying reserves size bytes of app memory, decaying linearly
+// to nothing over the decay period, without waiting for room, so the
+// caller needn't release it, though Release frees what's left early.
+// Waiters recheck on every Tick while memory is decaying.
+func (a *appHerder) ReserveDecaying(size uint64,
+	decay time.Duration) (*decayingReservation, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if err := a.overMiscCapLOCKED(size); err != nil {
+		a.auditLOCKED(auditKindMisc, "", size, err)
+		return nil, err
+	}
+
+	r := &decayingReservation{herder: a, size: size, start: time.Now(),
+		decay: decay}
+	if decay > 0 {
+		a.decaying = append(a.decaying, r)
+	}
+	a.refreshFastPathLOCKED()
+
+	log.Printf("app_herder: reserved decaying memory: %s, over: %s",
+		fmtBytes(size), decay)
+	a.auditLOCKED(auditKindMisc, "", size, nil)
+
+	return r, nil
+}
+
+// remaining returns the memory still held by the reservation as of now.
+func (r *decayingReservation) remaining(now time.Time) uint64 {
+	elapsed := now.Sub(r.start)
+	if r.released || elapsed >= r.decay {
+		return 0
+	}
+	if elapsed <= 0 {
+		return r.size
+	}
+	return uint64(float64(r.size) * (1 - float64(elapsed)/float64(r.decay)))
+}
+
+// Remaining returns the memory the reservation still holds.
+func (r *decayingReservation) Remaining() uint64 {
+	a := r.herder
+	a.m.Lock()
+	defer a.m.Unlock()
+	return r.remaining(time.Now())
+}
+
+// Release frees whatever the reservation still holds, waking any
+// waiters.
+func (r *decayingReservation) Release() error {
+	a := r.herder
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if r.released {
+		return fmt.Errorf("app_herder: decaying reservation already released")
+	}
+	r.released = true
+	a.pruneDecayingLOCKED(time.Now())
+
+	a.refreshFastPathLOCKED()
+	a.broadcastLOCKED()
+	return nil
+}
+
+func (a *appHerder) decayingReservedLOCKED(now time.Time) (rv uint64) {
+	for _, r := range a.decaying {
+		rv += r.remaining(now)
+	}
+	return rv
+}
+
+// pruneDecayingLOCKED drops the released and fully decayed
+// reservations.
+func (a *appHerder) pruneDecayingLOCKED(now time.Time) {
+	kept := a.decaying[:0]
+	for _, r := range a.decaying {
+		if r.remaining(now) > 0 {
+			kept = append(kept, r)
+		}
+	}
+	for i := len(kept); i < len(a.decaying); i++ {
+		a.decaying[i] = nil
+	}
+	a.decaying = kept
+}
@@ -0,0 +1,65 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"time"
+)
+
+// latencyHistogramBuckets covers 1us through ~33s in power-of-two
+// steps, with a final bucket for anything slower.
+const latencyHistogramBuckets = 26
+
+// latencyHistogram is a simple bucketed latency recorder.  Percentile
+// values are reported as the upper bound of the bucket they fall in,
+// so they're accurate to within a factor of two, which is plenty for
+// tracking admission SLOs.  It isn't concurrency safe and relies on
+// the herder's lock.
+type latencyHistogram struct {
+	counts [latencyHistogramBuckets]uint64
+	total  uint64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{}
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	if h == nil {
+		return
+	}
+	i := 0
+	for bound := time.Microsecond; d > bound &&
+		i < latencyHistogramBuckets-1; bound *= 2 {
+		i++
+	}
+	h.counts[i]++
+	h.total++
+}
+
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h == nil || h.total == 0 {
+		return 0
+	}
+	target := uint64(p * float64(h.total))
+	if target < 1 {
+		target = 1
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= target {
+			return time.Microsecond << uint(i)
+		}
+	}
+	return time.Microsecond << uint(latencyHistogramBuckets-1)
+}
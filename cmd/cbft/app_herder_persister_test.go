@@ -0,0 +1,1135 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// simulatedPersister stands in for an engine's persister, draining a
+// testIndex and reporting progress to the herder only when the test
+// says so, either one Step at a time or at a fixed rate via Start.
+type simulatedPersister struct {
+	a   *appHerder
+	idx *testIndex
+
+	m     sync.Mutex
+	steps int
+}
+
+func newSimulatedPersister(a *appHerder, idx *testIndex) *simulatedPersister {
+	return &simulatedPersister{a: a, idx: idx}
+}
+
+// Step persists up to n bytes of the index and reports the progress.
+func (p *simulatedPersister) Step(n uint64) {
+	p.idx.persist(n)
+
+	p.m.Lock()
+	p.steps++
+	p.m.Unlock()
+
+	p.a.onPersisterProgress(p.idx)
+}
+
+// Steps returns the number of progress reports so far.
+func (p *simulatedPersister) Steps() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.steps
+}
+
+// Start persists n bytes every interval until the returned func is
+// called, which waits for the persister to stop.
+func (p *simulatedPersister) Start(n uint64,
+	interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				p.Step(n)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// startBatch runs a batch for idx in the background, returning a
+// channel closed once the herder admits it.
+func startBatch(a *appHerder, idx *testIndex) chan struct{} {
+	admitted := make(chan struct{})
+	go func() {
+		a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+			batchPriorityNormal)
+		close(admitted)
+	}()
+	return admitted
+}
+
+// waitForWaiting waits for the herder to have n batches waiting.
+func waitForWaiting(t *testing.T, a *appHerder, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().Waiting != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected waiting: %d, got: %d", n, a.Stats().Waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAppHerderWaitsForPersisterProgress(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	idx := &testIndex{size: 1500}
+	p := newSimulatedPersister(a, idx)
+
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+
+	// progress that leaves indexing over its quota shouldn't admit
+	p.Step(300)
+	waitForWaiting(t, a, 1)
+	select {
+	case <-admitted:
+		t.Fatalf("expected batch to wait with indexing over quota")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	p.Step(300)
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected batch to be admitted once under quota")
+	}
+	waitForWaiting(t, a, 0)
+
+	is := a.Stats().PerIndex[0]
+	if is.PersisterProgress != 2 || is.PersistedBytes != 600 {
+		t.Errorf("expected 2 progress events persisting 600 bytes,"+
+			" got: %d, %d", is.PersisterProgress, is.PersistedBytes)
+	}
+	if is.Waits != 2 || is.WaitTime < 10*time.Millisecond {
+		t.Errorf("expected 2 waits of at least 10ms in total, got: %d, %s",
+			is.Waits, is.WaitTime)
+	}
+
+	// the next batch fits, so it doesn't wait
+	<-startBatch(a, idx)
+	if s := a.Stats(); s.TotBatchWaited != 1 || s.BatchWaitRatio != 0.5 ||
+		s.WakeAdmitsPersister != 1 {
+		t.Errorf("expected 1 of 2 batches to have waited, woken by the"+
+			" persister, got: %d, ratio: %v, persister: %d",
+			s.TotBatchWaited, s.BatchWaitRatio, s.WakeAdmitsPersister)
+	}
+}
+
+func TestAppHerderWaitsOutPersisterLag(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	idx := &testIndex{size: 2000}
+	p := newSimulatedPersister(a, idx)
+
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+
+	// a slow persister needs several steps before memory frees up
+	stop := p.Start(100, time.Millisecond)
+	defer stop()
+
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected batch to be admitted as the persister caught up")
+	}
+	if steps := p.Steps(); steps < 10 {
+		t.Errorf("expected at least 10 persister steps before admission,"+
+			" got: %d", steps)
+	}
+}
+
+func TestAppHerderWakeBurst(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	idx := &testIndex{size: 1500}
+	p := newSimulatedPersister(a, idx)
+
+	started := make(chan int, 1)
+	ended := make(chan int, 1)
+	// the hooks are fired without the lock, so may call back in
+	a.onWakeBurstStart = func(woken int) {
+		a.Stats()
+		started <- woken
+	}
+	a.onWakeBurstEnd = func(admitted int) {
+		a.Stats()
+		ended <- admitted
+	}
+
+	var admitted []chan struct{}
+	for i := 0; i < 3; i++ {
+		admitted = append(admitted, startBatch(a, idx))
+	}
+	waitForWaiting(t, a, 3)
+
+	p.Step(600)
+	for _, ch := range admitted {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected batches to be admitted once under quota")
+		}
+	}
+	if woken := <-started; woken != 3 {
+		t.Errorf("expected burst of 3 woken, got: %d", woken)
+	}
+	select {
+	case n := <-ended:
+		if n != 3 {
+			t.Errorf("expected burst to end with 3 admitted, got: %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected burst to end")
+	}
+}
+
+func TestAppHerderWaitHealthy(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	a.healthyStabilization = 20 * time.Millisecond
+	idx := &testIndex{size: 1500}
+	p := newSimulatedPersister(a, idx)
+
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+	if !a.IsUnderPressure() {
+		t.Fatalf("expected pressure with a batch waiting")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	if err := a.WaitHealthy(ctx); err == nil {
+		t.Errorf("expected WaitHealthy to give up under pressure")
+	}
+
+	start := time.Now()
+	p.Step(1000)
+	<-admitted
+	if err := a.WaitHealthy(context.Background()); err != nil {
+		t.Fatalf("expected healthy once persisted, got err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("expected to wait out the stabilization, waited: %s",
+			elapsed)
+	}
+}
+
+func TestAppHerderIndexExcluded(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	healthy := &testIndex{size: 400}
+	rebuilding := &testIndex{size: 900}
+	a.onBatchExecuteStart(rebuilding, rebuilding.sizeFunc,
+		statsErrFailOpen, batchPriorityNormal)
+
+	// the rebuild's spike stalls the healthy index until excluded
+	waiting := startBatch(a, healthy)
+	waitForWaiting(t, a, 1)
+
+	a.SetIndexExcluded(rebuilding, true)
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected batch to be admitted with the rebuild excluded")
+	}
+	if s := a.Stats(); s.IndexingMemory != 400 ||
+		s.ExcludedIndexingMemory != 900 {
+		t.Errorf("expected 400 counted and 900 excluded, got: %d, %d",
+			s.IndexingMemory, s.ExcludedIndexingMemory)
+	}
+
+	a.SetIndexExcluded(rebuilding, false)
+	if s := a.Stats(); s.IndexingMemory != 1300 ||
+		s.ExcludedIndexingMemory != 0 {
+		t.Errorf("expected rebuild to count again, got: %d, excluded: %d",
+			s.IndexingMemory, s.ExcludedIndexingMemory)
+	}
+}
+
+func TestAppHerderWakeSelector(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	big := &testIndex{size: 900}
+	p := newSimulatedPersister(a, big)
+	a.onBatchExecuteStart(big, big.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+
+	var freedSeen uint64
+	a.SetWakeSelector(func(waiting []waitingBatch, freed uint64) []int {
+		freedSeen = freed
+		return []int{len(waiting) - 1} // Newest first.
+	})
+
+	var admitted []chan struct{}
+	for i := 0; i < 3; i++ {
+		admitted = append(admitted, startBatch(a, &testIndex{size: 200}))
+		waitForWaiting(t, a, i+1)
+	}
+
+	p.Step(600)
+	select {
+	case <-admitted[2]:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the selected batch to be admitted")
+	}
+	waitForWaiting(t, a, 2)
+	select {
+	case <-admitted[0]:
+		t.Errorf("expected the passed over batches to keep waiting")
+	case <-time.After(10 * time.Millisecond):
+	}
+	a.m.Lock()
+	if freedSeen != 600 {
+		t.Errorf("expected selector to see 600 freed, got: %d", freedSeen)
+	}
+	a.m.Unlock()
+
+	// any other wakeup rechecks them all
+	a.SetWakeSelector(nil)
+	p.Step(0)
+	for _, ch := range admitted[:2] {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected batches to be admitted")
+		}
+	}
+}
+
+func TestAppHerderRegisterAndAwaitBatch(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	idx := &testIndex{size: 800}
+	p := newSimulatedPersister(a, idx)
+
+	// the estimated delta alone takes the new index over its quota
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- a.RegisterAndAwaitBatch(ctx, idx, idx.sizeFunc, 300) }()
+	waitForWaiting(t, a, 1)
+	if s := a.Stats(); s.IndexingMemory != 1100 {
+		t.Errorf("expected the delta counted while waiting, got: %d",
+			s.IndexingMemory)
+	}
+	cancel()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Errorf("expected an error once ctx was canceled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the wait to end with ctx")
+	}
+	waitForWaiting(t, a, 0)
+
+	go func() {
+		errCh <- a.RegisterAndAwaitBatch(context.Background(), idx,
+			idx.sizeFunc, 300)
+	}()
+	waitForWaiting(t, a, 1)
+	p.Step(200)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("expected admission, got err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected batch to be admitted with room for its delta")
+	}
+	if s := a.Stats(); s.IndexingMemory != 600 {
+		t.Errorf("expected the delta dropped once admitted, got: %d",
+			s.IndexingMemory)
+	}
+}
+
+func TestAppHerderRecentBatchAdmissions(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	a.batchAdmissions = make([]batchAdmission, 2)
+	idx := &testIndex{size: 1500}
+	p := newSimulatedPersister(a, idx)
+
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+	time.Sleep(10 * time.Millisecond)
+	p.Step(600)
+	<-admitted
+
+	<-startBatch(a, idx)
+	<-startBatch(a, idx)
+
+	// only the last 2 of 3 are kept, the one that waited dropping out
+	recent := a.RecentBatchAdmissions()
+	if len(recent) != 2 {
+		t.Fatalf("expected 2 recent admissions, got: %d", len(recent))
+	}
+	for _, r := range recent {
+		if r.Waited || r.WaitTime != 0 || r.IndexingMemory != 900 {
+			t.Errorf("expected immediate admission at 900, got: %+v", r)
+		}
+	}
+
+	a.batchAdmissions = make([]batchAdmission, 4)
+	a.batchAdmissionCount = 0
+	idx.grow(600)
+	admitted = startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+	time.Sleep(10 * time.Millisecond)
+	p.Step(600)
+	<-admitted
+	recent = a.RecentBatchAdmissions()
+	if len(recent) != 1 || !recent[0].Waited ||
+		recent[0].WaitTime < 10*time.Millisecond {
+		t.Errorf("expected an admission after waiting 10ms, got: %+v", recent)
+	}
+}
+
+// TestAppHerderSignalMixedWaiters checks that a persister progress
+// signal reaches a waiting batch even while a query is also waiting,
+// having started to wait first.
+func TestAppHerderSignalMixedWaiters(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.5, 0.5)
+	a.persisterWakeMode = wakeSignal
+	idx := &testIndex{size: 600}
+	p := newSimulatedPersister(a, idx)
+
+	if err := a.StartQuery(400); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	queried := make(chan error, 1)
+	go func() {
+		r, err := a.StartQueryWithOptions(200,
+			queryOptions{MaxWait: 5 * time.Second})
+		if err == nil {
+			r.End()
+		}
+		queried <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().QueryWaiting != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a waiting query")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+
+	// frees enough for the batch, but not for the query
+	p.Step(300)
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the signal to admit the waiting batch")
+	}
+
+	a.EndQuery(400)
+	if err := <-queried; err != nil {
+		t.Errorf("expected waiting query to be admitted, err: %v", err)
+	}
+}
+
+func TestAppHerderWaiterAges(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	idx := &testIndex{size: 1500}
+	p := newSimulatedPersister(a, idx)
+
+	if s := a.Stats(); s.WaiterAges != nil || s.MaxWaiterAge != 0 {
+		t.Errorf("expected no waiter ages, got: %v", s.WaiterAges)
+	}
+
+	first := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+	time.Sleep(10 * time.Millisecond)
+	second := startBatch(a, idx)
+	waitForWaiting(t, a, 2)
+
+	s := a.Stats()
+	if len(s.WaiterAges) != 2 || s.WaiterAges[0] < s.WaiterAges[1] ||
+		s.MaxWaiterAge != s.WaiterAges[0] ||
+		s.WaiterAges[0]-s.WaiterAges[1] < 10*time.Millisecond {
+		t.Errorf("expected the longest waiter first, got: %v, max: %s",
+			s.WaiterAges, s.MaxWaiterAge)
+	}
+
+	p.Step(1000)
+	<-first
+	<-second
+	if s = a.Stats(); s.WaiterAges != nil {
+		t.Errorf("expected no waiter ages once admitted, got: %v",
+			s.WaiterAges)
+	}
+}
+
+// blockingSize wraps idx's size func so that, once armed, the next call
+// blocks until released, then reports the given size rather than the
+// index's.
+type blockingSize struct {
+	idx *testIndex
+
+	m       sync.Mutex
+	armed   bool
+	sizing  chan struct{}
+	proceed chan uint64
+}
+
+func (b *blockingSize) arm() {
+	b.m.Lock()
+	b.armed = true
+	b.sizing, b.proceed = make(chan struct{}), make(chan uint64)
+	b.m.Unlock()
+}
+
+func (b *blockingSize) sizeFunc(c interface{}) (uint64, error) {
+	b.m.Lock()
+	armed := b.armed
+	b.armed = false
+	sizing, proceed := b.sizing, b.proceed
+	b.m.Unlock()
+	if !armed {
+		return b.idx.sizeFunc(c)
+	}
+	close(sizing)
+	return <-proceed, nil
+}
+
+// startProgress reports persister progress for bs's index in the
+// background once bs is armed, returning a channel closed once done,
+// after the size func has been entered.
+func startProgress(t *testing.T, a *appHerder,
+	bs *blockingSize) chan struct{} {
+	bs.arm()
+	done := make(chan struct{})
+	go func() {
+		a.onPersisterProgress(bs.idx)
+		close(done)
+	}()
+	select {
+	case <-bs.sizing:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected persister progress to size the index")
+	}
+	return done
+}
+
+func TestAppHerderPersistedSizingUnlocked(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.checkInvariants = true
+	idx := &testIndex{size: 500}
+	bs := &blockingSize{idx: idx}
+	a.onBatchExecuteStart(idx, bs.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+
+	// the herder stays usable while the size func runs
+	done := startProgress(t, a, bs)
+	queried := make(chan error, 1)
+	go func() { queried <- a.StartQuery(100) }()
+	select {
+	case err := <-queried:
+		if err != nil {
+			t.Errorf("expected query to be admitted, err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the lock to be released while sizing")
+	}
+	a.EndQuery(100)
+
+	// a sweep meanwhile sees the index shrink, so the stale size the
+	// persister's call then reports frees nothing
+	idx.persist(200)
+	if n := a.MaxAdmissibleQuerySize(); n != 700 {
+		t.Errorf("expected the sweep to see 300 bytes, got: %d", 1000-n)
+	}
+	bs.proceed <- 500
+	<-done
+	if is := a.Stats().PerIndex[0]; is.PersistedBytes != 0 ||
+		is.PersisterProgress != 1 {
+		t.Errorf("expected a progress event freeing nothing, got: %d, %d",
+			is.PersisterProgress, is.PersistedBytes)
+	}
+
+	// later progress is measured from the last observed size
+	idx.persist(100)
+	a.onPersisterProgress(idx)
+	if is := a.Stats().PerIndex[0]; is.PersistedBytes != 100 {
+		t.Errorf("expected 100 bytes persisted, got: %d", is.PersistedBytes)
+	}
+
+	// an index closed while being sized is left closed
+	done = startProgress(t, a, bs)
+	a.onClose(idx)
+	bs.proceed <- 0
+	<-done
+	if s := a.Stats(); len(s.PerIndex) != 0 || s.InvariantViolations != 0 {
+		t.Errorf("expected the closed index to stay gone, got: %+v",
+			s.PerIndex)
+	}
+}
+
+func TestAppHerderExemptIndex(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.5, 0.5)
+	system := &testIndex{size: 1000}
+	a.RegisterIndex(system, indexOptions{Name: "system", Exempt: true})
+
+	// exempt batches proceed over the quota, but are still counted
+	<-startBatch(a, system)
+	idx := &testIndex{size: 10}
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+	<-startBatch(a, system)
+	if s := a.Stats(); s.Waiting != 1 {
+		t.Errorf("expected the normal batch to keep waiting, got: %d",
+			s.Waiting)
+	}
+
+	a.onClose(system)
+	a.onPersisterProgress(idx)
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected batch to be admitted once the exempt index closed")
+	}
+}
+
+func TestAppHerderMinBatchInterval(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	idx := &testIndex{size: 100}
+	a.RegisterIndex(idx, indexOptions{MinBatchInterval: 20 * time.Millisecond})
+	other := &testIndex{size: 100}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		<-startBatch(a, idx)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected batches spaced out by 20ms, took: %s", elapsed)
+	}
+
+	// other indexes aren't held back
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		<-startBatch(a, other)
+	}
+	if elapsed := time.Since(start); elapsed >= 40*time.Millisecond {
+		t.Errorf("expected other batches not to be spaced out, took: %s",
+			elapsed)
+	}
+
+	for _, is := range a.Stats().PerIndex {
+		if is.BatchAdmitRate <= 0 {
+			t.Errorf("expected a batch admission rate, got: %+v", is)
+		}
+	}
+}
+
+// startSpacedBatch starts a batch for idx via RegisterAndAwaitBatch,
+// returning once it's being spaced out, with its result.
+func startSpacedBatch(t *testing.T, a *appHerder, ctx context.Context,
+	idx *testIndex) chan error {
+	rv := make(chan error, 1)
+	go func() { rv <- a.RegisterAndAwaitBatch(ctx, idx, idx.sizeFunc, 1) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.m.Lock()
+		entry := a.indexes[idx]
+		pending := entry != nil && entry.pendingDelta > 0
+		a.m.Unlock()
+		if pending {
+			return rv
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the batch to be spaced out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAppHerderMinBatchIntervalWait(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.minBatchInterval = time.Hour
+	idx := &testIndex{size: 100}
+	<-startBatch(a, idx)
+
+	// a spaced out batch returns once its ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	done := startSpacedBatch(t, a, ctx, idx)
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected an error once ctx was done")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the spaced out batch to return once ctx was done")
+	}
+
+	// or once the index closed before its slot came
+	a.minBatchInterval = 50 * time.Millisecond
+	a.m.Lock()
+	a.indexes[idx].lastAdmit = time.Now()
+	a.m.Unlock()
+	done = startSpacedBatch(t, a, context.Background(), idx)
+	a.onClose(idx)
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "index closed") {
+			t.Errorf("expected an index closed error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the spaced out batch to return once the index" +
+			" closed")
+	}
+
+	// a burst waits for at most an interval, rather than one apiece
+	a.minBatchInterval = 100 * time.Millisecond
+	<-startBatch(a, idx)
+	start := time.Now()
+	var burst []chan struct{}
+	for i := 0; i < 5; i++ {
+		burst = append(burst, startBatch(a, idx))
+	}
+	for _, admitted := range burst {
+		<-admitted
+	}
+	if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+		t.Errorf("expected the burst admitted within about an interval,"+
+			" took: %s", elapsed)
+	}
+}
+
+func TestAppHerderEscalation(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.escalateThrottleAfter = time.Second
+	a.escalatePauseAfter = 2 * time.Second
+	a.escalateFlushAfter = 3 * time.Second
+	flushed := make(chan struct{}, 1)
+	a.onMemoryPressure = func() { flushed <- struct{}{} }
+	idx := &testIndex{size: 960}
+	<-startBatch(a, idx)
+
+	t0 := time.Now()
+	a.Tick(t0)
+	a.Tick(t0.Add(time.Second))
+	if s := a.Stats(); s.EscalationLevel != escalationThrottle ||
+		s.IngestRateHint != 0 {
+		t.Errorf("expected intake throttled, got: %d, %v",
+			s.EscalationLevel, s.IngestRateHint)
+	}
+
+	// pinned beyond the pause and flush durations, new batches wait
+	a.Tick(t0.Add(3 * time.Second))
+	if s := a.Stats(); s.EscalationLevel != escalationFlush {
+		t.Errorf("expected flush level, got: %d", s.EscalationLevel)
+	}
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected OnMemoryPressure to fire")
+	}
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+
+	// dropping off the ceiling ends the escalation
+	idx.persist(500)
+	a.Tick(t0.Add(4 * time.Second))
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected batch to be admitted once off the ceiling")
+	}
+	if s := a.Stats(); s.EscalationLevel != escalationNone {
+		t.Errorf("expected no escalation, got: %d", s.EscalationLevel)
+	}
+}
+
+func TestAppHerderCloseWithWaiters(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.5, 0.5)
+	idx := &testIndex{size: 1500}
+	other := &testIndex{}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- a.RegisterAndAwaitBatch(context.Background(), idx,
+			idx.sizeFunc, 0)
+	}()
+	waitForWaiting(t, a, 1)
+	admitted := startBatch(a, other)
+	waitForWaiting(t, a, 2)
+
+	// the closed index's batch is woken with an error, and the wakeup
+	// lets the other batch use the memory the close freed
+	a.onClose(idx)
+	select {
+	case err := <-closed:
+		if err == nil || !strings.Contains(err.Error(), "index closed") {
+			t.Errorf("expected index closed error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the closed index's batch to be woken")
+	}
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the other batch to be admitted")
+	}
+
+	waitForWaiting(t, a, 0)
+	a.m.Lock()
+	waiters := len(a.waiters)
+	a.m.Unlock()
+	if waiters != 0 {
+		t.Errorf("expected no waiters left, got: %d", waiters)
+	}
+	if s := a.Stats(); len(s.PerIndex) != 1 {
+		t.Errorf("expected only the other index, got: %+v", s.PerIndex)
+	}
+}
+
+func TestAppHerderPerIndexOverhead(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.5, 0.5)
+	a.perIndexOverhead = 100
+	idx := &testIndex{size: 250}
+	<-startBatch(a, idx)
+	if s := a.Stats(); s.EffectiveIndexQuota != 400 {
+		t.Errorf("expected 400 bytes for 1 index, got: %d",
+			s.EffectiveIndexQuota)
+	}
+
+	// each index opened takes its overhead out of indexQuota
+	a.RegisterIndex(&testIndex{}, indexOptions{})
+	if s := a.Stats(); s.EffectiveIndexQuota != 300 {
+		t.Errorf("expected 300 bytes for 2 indexes, got: %d",
+			s.EffectiveIndexQuota)
+	}
+	idx.grow(100)
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+
+	idx.persist(100)
+	a.onPersisterProgress(idx)
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected batch to be admitted under the effective quota")
+	}
+}
+
+func TestAppHerderPersisterProgressCounters(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	idx := &testIndex{size: 300}
+	p := newSimulatedPersister(a, idx)
+	<-startBatch(a, idx)
+
+	t0 := time.Now()
+	a.Tick(t0)
+	prev := a.Stats()
+	for i := 0; i < 4; i++ {
+		p.Step(50)
+	}
+	a.Tick(t0.Add(2 * time.Second))
+
+	s := a.Stats()
+	if s.TotPersisterProgress != 4 || s.PersisterProgressRate != 2 {
+		t.Errorf("expected 4 progress events at 2/s, got: %d, %v",
+			s.TotPersisterProgress, s.PersisterProgressRate)
+	}
+	if is := s.PerIndex[0]; is.PersisterProgress != 4 {
+		t.Errorf("expected 4 progress events for the index, got: %d",
+			is.PersisterProgress)
+	}
+	if d := s.DeltaFrom(prev); d.TotPersisterProgress != 4 {
+		t.Errorf("expected a delta of 4 progress events, got: %d",
+			d.TotPersisterProgress)
+	}
+}
+
+func TestAppHerderInFlight(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.trackInFlight = true
+	idx := &testIndex{size: 100}
+	p := newSimulatedPersister(a, idx)
+
+	// the batch's growth from its introduction start is in flight
+	<-startBatch(a, idx)
+	idx.grow(200)
+	a.onBatchIntroduced(idx, idx.sizeFunc)
+	<-startBatch(a, idx)
+	idx.grow(50)
+	a.onBatchIntroduced(idx, idx.sizeFunc)
+	s := a.Stats()
+	if s.InFlightMemory != 250 || s.PerIndex[0].InFlight != 250 {
+		t.Errorf("expected 250 bytes in flight, got: %d, %d",
+			s.InFlightMemory, s.PerIndex[0].InFlight)
+	}
+	if s.IndexingMemory != 350 {
+		t.Errorf("expected in-flight bytes within the total, got: %d",
+			s.IndexingMemory)
+	}
+
+	// until the next persister progress
+	p.Step(250)
+	if s := a.Stats(); s.InFlightMemory != 0 {
+		t.Errorf("expected nothing in flight once persisted, got: %d",
+			s.InFlightMemory)
+	}
+}
+
+func TestAppHerderSetEnforcement(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.5, 0.5)
+	idx := &testIndex{size: 1500}
+
+	// while off, nothing waits or is rejected, but usage is counted
+	a.SetEnforcement(false)
+	<-startBatch(a, idx)
+	if err := a.StartQuery(800); err != nil {
+		t.Errorf("expected query to be admitted while off, err: %v", err)
+	}
+	s := a.Stats()
+	if s.RunningQueryUsed != 800 || s.IndexingMemory != 1500 ||
+		s.TotBatchAdmitted != 1 || s.TotQueryAdmitted != 1 {
+		t.Errorf("expected the usage counted while off, got: %+v", s)
+	}
+	a.EndQuery(800)
+
+	// while on, the same load is held back
+	a.SetEnforcement(true)
+	if err := a.StartQuery(800); err == nil {
+		t.Errorf("expected query over queryQuota to be rejected while on")
+	}
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+
+	// turning it off releases the waiters
+	a.SetEnforcement(false)
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the waiting batch to be released")
+	}
+}
+
+func TestAppHerderBackpressureCulprit(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	if name, _ := a.LastBackpressureCulprit(); name != "" {
+		t.Errorf("expected no culprit before any wait, got: %q", name)
+	}
+
+	big, small := &testIndex{size: 600}, &testIndex{size: 500}
+	a.RegisterIndex(big, indexOptions{Name: "big"})
+	a.RegisterIndex(small, indexOptions{Name: "small"})
+	<-startBatch(a, big)
+
+	// the largest index is blamed, not the one whose batch waits
+	admitted := startBatch(a, small)
+	waitForWaiting(t, a, 1)
+	if name, size := a.LastBackpressureCulprit(); name != "big" ||
+		size != 600 {
+		t.Errorf("expected the big index to be blamed, got: %q, %d",
+			name, size)
+	}
+
+	big.persist(300)
+	a.onPersisterProgress(big)
+	<-admitted
+}
+
+func TestAppHerderCombinedYield(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.8, 0.8)
+	idx := &testIndex{size: 300}
+	<-startBatch(a, idx)
+	if err := a.StartQuery(600); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	idx.grow(200)
+
+	// by default, indexing under its quota waits out heavy queries
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+
+	// unless queries yield, where batches keep flowing while query
+	// admission is still held to appQuota
+	a.m.Lock()
+	a.combinedYield = yieldQueries
+	a.m.Unlock()
+	a.onPersisterProgress(idx)
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected batch to be admitted with queries yielding")
+	}
+	<-startBatch(a, idx)
+	if err := a.StartQuery(100); err == nil {
+		t.Errorf("expected query over appQuota to be rejected")
+	}
+	if s := a.Stats(); s.TotCombinedQuotaExceeded == 0 {
+		t.Errorf("expected the combined quota to be exceeded")
+	}
+
+	for _, s := range []string{"indexing", "queries"} {
+		y, err := parseCombinedYield(s)
+		if err != nil || y.String() != s {
+			t.Errorf("expected %q to round trip, got: %v, err: %v", s, y, err)
+		}
+	}
+	if _, err := parseCombinedYield("nobody"); err == nil {
+		t.Errorf("expected unknown yield to be rejected")
+	}
+}
+
+func TestAppHerderIndexRegistered(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	var registered []interface{}
+	a.onIndexRegistered = func(c interface{}) {
+		registered = append(registered, c)
+	}
+
+	x, y := &testIndex{size: 10}, &testIndex{size: 10}
+	a.RegisterIndex(x, indexOptions{})
+	<-startBatch(a, x)
+	<-startBatch(a, y)
+	<-startBatch(a, y)
+	if len(registered) != 2 || registered[0] != x || registered[1] != y {
+		t.Errorf("expected each index registered once, got: %v", registered)
+	}
+
+	// a closed index is registered anew by its next batch
+	a.onClose(x)
+	<-startBatch(a, x)
+	if len(registered) != 3 || registered[2] != x {
+		t.Errorf("expected the reopened index registered again, got: %v",
+			registered)
+	}
+}
+
+func TestAppHerderScorchEpochs(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.trackEpochs = true
+	idx := &testIndex{size: 100}
+	<-startBatch(a, idx)
+
+	// keyed as scorch's StatsMap keys its Stats fields
+	progress := func(cur, persisted, size uint64) {
+		a.noteScorchEpochs(idx, map[string]interface{}{
+			"CurRootEpoch":       cur,
+			"LastPersistedEpoch": persisted,
+			"TotBatches":         uint64(7),
+		}, size)
+	}
+	expect := func(epochs int, behind uint64) {
+		t.Helper()
+		is := a.Stats().PerIndex[0]
+		if is.UnpersistedEpochs != epochs || is.BytesBehind != behind {
+			t.Errorf("expected %d epochs, %d bytes behind, got: %d, %d",
+				epochs, behind, is.UnpersistedEpochs, is.BytesBehind)
+		}
+	}
+
+	progress(3, 1, 300)
+	expect(1, 300)
+	progress(5, 3, 450)
+	expect(1, 150)
+	progress(5, 4, 500) // No new epoch, so it's grown.
+	expect(1, 200)
+	progress(5, 5, 200)
+	expect(0, 0)
+
+	// stats without both epochs are ignored
+	a.noteScorchEpochs(idx, map[string]interface{}{
+		"CurRootEpoch": uint64(9)}, 900)
+	expect(0, 0)
+	if _, _, ok := scorchEpochs(map[string]interface{}{
+		"CurRootEpoch": 9, "LastPersistedEpoch": 8}); ok {
+		t.Errorf("expected non-uint64 epochs to be ignored")
+	}
+}
+
+func TestAppHerderQueryQuotaFloor(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.SetQueryQuotaFloor(300)
+
+	// indexing leaves room for the floor, even with no queries running
+	idx := &testIndex{size: 800}
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+	a.SetQueryQuotaFloor(200)
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected batch to be admitted below the lowered floor")
+	}
+
+	// indexing growing past its share still leaves queries the floor
+	idx.grow(150)
+	s := a.Stats()
+	if s.QueryQuotaFloor != 200 || s.EffectiveQueryQuota != 200 {
+		t.Errorf("expected floor and effective query quota: 200, got: %d, %d",
+			s.QueryQuotaFloor, s.EffectiveQueryQuota)
+	}
+	if err := a.StartQuery(200); err != nil {
+		t.Errorf("expected the floor to admit the query, err: %v", err)
+	}
+	if err := a.StartQuery(1); err == nil {
+		t.Errorf("expected a query past the floor to be rejected")
+	}
+
+	// bounded by queryQuota
+	a = newAppHerder(1000, 1, 1, 0.5)
+	a.SetQueryQuotaFloor(800)
+	if s = a.Stats(); s.QueryQuotaFloor != 500 {
+		t.Errorf("expected the floor bounded by queryQuota, got: %d",
+			s.QueryQuotaFloor)
+	}
+}
+
+func TestAppHerderVerifyCloseKeys(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.verifyCloseKeys = true
+	idx := &testIndex{size: 100}
+	a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+
+	// a key other than the one registered, such as after a restart
+	a.onClose(&testIndex{size: 100})
+	if s := a.Stats(); s.CloseKeyMismatches != 1 || len(s.PerIndex) != 1 {
+		t.Errorf("expected a mismatch with the index still tracked,"+
+			" got: %d, %d", s.CloseKeyMismatches, len(s.PerIndex))
+	}
+	a.onClose(idx)
+	if s := a.Stats(); s.CloseKeyMismatches != 1 || len(s.PerIndex) != 0 {
+		t.Errorf("expected a clean close, got: %d, %d",
+			s.CloseKeyMismatches, len(s.PerIndex))
+	}
+
+	// only verified when enabled
+	a.verifyCloseKeys = false
+	a.onClose(idx)
+	if s := a.Stats(); s.CloseKeyMismatches != 1 {
+		t.Errorf("expected no verification, got: %d", s.CloseKeyMismatches)
+	}
+}
@@ -0,0 +1,748 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppHerderQueryAccountedElsewhere(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.checkInvariants = true
+
+	a.StartQueryAccountedElsewhere()
+	s := a.Stats()
+	if s.RunningQueries != 1 || s.RunningQueriesElsewhere != 1 ||
+		s.RunningQueryUsed != 0 {
+		t.Errorf("expected a running query without memory, got: %+v", s)
+	}
+
+	// its memory isn't counted, so the whole quota is still available
+	if err := a.StartQuery(1000); err != nil {
+		t.Errorf("expected full quota query to be admitted, err: %v", err)
+	}
+	a.EndQuery(1000)
+
+	a.EndQueryAccountedElsewhere()
+	s = a.Stats()
+	if s.RunningQueries != 0 || s.RunningQueriesElsewhere != 0 ||
+		s.InvariantViolations != 0 {
+		t.Errorf("expected no running queries, got: %+v", s)
+	}
+
+	// an unpaired end doesn't drive the counts negative
+	a.EndQueryAccountedElsewhere()
+	s = a.Stats()
+	if s.RunningQueries != 0 || s.RunningQueriesElsewhere != 0 ||
+		s.InvariantViolations != 0 {
+		t.Errorf("expected unpaired end to be ignored, got: %+v", s)
+	}
+}
+
+func TestAppHerderQueryAccountedElsewhereWakesWaiters(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.maxConcurrentQueries = 1
+
+	// the query accounted elsewhere takes the only concurrency slot
+	a.StartQueryAccountedElsewhere()
+	q := startWaitingQuery(t, a, 100, 5*time.Second, 0)
+	expectWaiting(t, q, "capped")
+
+	a.EndQueryAccountedElsewhere()
+	select {
+	case wq := <-q:
+		if wq.err != nil {
+			t.Fatalf("expected query to be admitted, err: %v", wq.err)
+		}
+		wq.r.End()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the capped query to be admitted once the" +
+			" query accounted elsewhere ended")
+	}
+}
+
+func TestAppHerderStartupGrace(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	a.SetStartupGrace(time.Hour)
+
+	// over queryQuota, but admitted and logged during the grace window
+	if err := a.StartQuery(800); err != nil {
+		t.Errorf("expected query to be admitted in the grace window,"+
+			" err: %v", err)
+	}
+	if d := a.GracePeriodRemaining(); d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("expected about an hour of grace, got: %s", d)
+	}
+	if s := a.Stats(); s.StartupGraceRemaining == 0 {
+		t.Errorf("expected the grace remaining in the stats")
+	}
+
+	a.SetStartupGrace(0)
+	if d := a.GracePeriodRemaining(); d != 0 {
+		t.Errorf("expected no grace remaining, got: %s", d)
+	}
+	if err := a.StartQuery(100); err == nil {
+		t.Errorf("expected quotas to be enforced after the grace window")
+	}
+}
+
+func TestAppHerderQueryBypassQuota(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+
+	if err := a.StartQuery(400); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	r, err := a.StartQueryWithOptions(400, queryOptions{BypassQuota: true})
+	if err != nil {
+		t.Fatalf("expected bypassing query to be admitted, err: %v", err)
+	}
+
+	// its memory is still counted
+	if s := a.Stats(); s.RunningQueryUsed != 800 {
+		t.Errorf("expected 800 bytes of queries, got: %d", s.RunningQueryUsed)
+	}
+	if err := a.StartQuery(1); err == nil {
+		t.Errorf("expected query over queryQuota to be rejected")
+	}
+
+	r.End()
+	a.EndQuery(400)
+	if s := a.Stats(); s.RunningQueryUsed != 0 {
+		t.Errorf("expected no queries, got: %d", s.RunningQueryUsed)
+	}
+}
+
+func TestAppHerderMaxAdmissibleQuerySize(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+
+	// bound by queryQuota
+	if n := a.MaxAdmissibleQuerySize(); n != 500 {
+		t.Errorf("expected queryQuota to bound the size, got: %d", n)
+	}
+	if err := a.StartQuery(200); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	if n := a.MaxAdmissibleQuerySize(); n != 300 {
+		t.Errorf("expected the rest of queryQuota, got: %d", n)
+	}
+
+	// bound by appQuota once indexing holds memory
+	idx := &testIndex{size: 700}
+	a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+	n := a.MaxAdmissibleQuerySize()
+	if n != 100 {
+		t.Errorf("expected the rest of appQuota, got: %d", n)
+	}
+	if err := a.StartQuery(n + 1); err == nil {
+		t.Errorf("expected query over the admissible size to be rejected")
+	}
+	if err := a.StartQuery(n); err != nil {
+		t.Errorf("expected admissible size query to be admitted, err: %v",
+			err)
+	}
+}
+
+func TestAppHerderQueryBestEffort(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	var buf bytes.Buffer
+	a.audit = newAuditLog(&buf)
+
+	// full, partial and zero grants
+	if granted, err := a.StartQueryBestEffort(300); err != nil ||
+		granted != 300 {
+		t.Fatalf("expected the full budget, got: %d, err: %v", granted, err)
+	}
+	if granted, err := a.StartQueryBestEffort(900); err != nil ||
+		granted != 700 {
+		t.Fatalf("expected a reduced budget of 700, got: %d, err: %v",
+			granted, err)
+	}
+	if _, err := a.StartQueryBestEffort(100); queryRejectReasonOf(err) !=
+		rejectQueryQuota {
+		t.Errorf("expected rejection with no budget left, got: %v", err)
+	}
+	if err := a.CloseAuditLog(); err != nil {
+		t.Fatalf("expected the audit log closed, err: %v", err)
+	}
+	var sizes []uint64
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec auditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("expected JSON records, got err: %v", err)
+		}
+		sizes = append(sizes, rec.Size)
+	}
+	if len(sizes) != 3 || sizes[0] != 300 || sizes[1] != 700 {
+		t.Errorf("expected the grants audited, got: %v", sizes)
+	}
+	a.EndQuery(300)
+	a.EndQuery(700)
+
+	// clamped by the index's query sub-quota
+	a.SetIndexQueryQuota("idx", 200)
+	r, err := a.StartQueryBestEffortWithOptions(500,
+		queryOptions{Index: "idx"})
+	if err != nil || r.Size() != 200 {
+		t.Fatalf("expected the index sub-quota to bound the budget, got: %v",
+			err)
+	}
+	if _, err = a.StartQueryBestEffortWithOptions(100,
+		queryOptions{Index: "idx"}); queryRejectReasonOf(err) !=
+		rejectIndexQueryQuota {
+		t.Errorf("expected the index sub-quota to reject, got: %v", err)
+	}
+	r.End()
+
+	// the admit hook judges the granted budget
+	var seen uint64
+	a.admit = func(size uint64, s appHerderStats) error {
+		seen = size
+		return nil
+	}
+	if r, err = a.StartQueryBestEffortWithOptions(500,
+		queryOptions{Index: "idx"}); err != nil || seen != 200 {
+		t.Errorf("expected the hook to see the grant, got: %d, err: %v",
+			seen, err)
+	}
+	r.End()
+	errBusy := fmt.Errorf("busy")
+	a.admit = func(size uint64, s appHerderStats) error { return errBusy }
+	if _, err = a.StartQueryBestEffort(100); err != errBusy {
+		t.Errorf("expected the hook's error, got: %v", err)
+	}
+	a.admit = nil
+
+	// only memory is reduced, the concurrency cap still rejects
+	a.maxConcurrentQueries = 1
+	if _, err = a.StartQueryBestEffort(100); err != nil {
+		t.Fatalf("expected admission, got err: %v", err)
+	}
+	if _, err = a.StartQueryBestEffort(100); queryRejectReasonOf(err) !=
+		rejectConcurrency {
+		t.Errorf("expected the concurrency cap to reject, got: %v", err)
+	}
+	a.EndQuery(100)
+	if s := a.Stats(); s.RunningQueryUsed != 0 || s.RunningQueries != 0 {
+		t.Errorf("expected usage to drain, got: %+v", s)
+	}
+}
+
+func TestAppHerderCombinedQuotaPressure(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	idx := &testIndex{size: 600}
+	a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+
+	// within the query quota, but not the combined appQuota
+	if err := a.StartQuery(600); queryRejectReasonOf(err) != rejectAppQuota {
+		t.Fatalf("expected the app quota to reject, got: %v", err)
+	}
+	if err := a.StartQuery(100); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	if err := a.StartQuery(900); queryRejectReasonOf(err) != rejectAppQuota {
+		t.Fatalf("expected the app quota to reject, got: %v", err)
+	}
+
+	s := a.Stats()
+	if s.TotCombinedQuotaExceeded != 2 {
+		t.Errorf("expected 2 combined quota rejections, got: %d",
+			s.TotCombinedQuotaExceeded)
+	}
+	if s.CombinedIndexShareLast != 0.375 || s.CombinedIndexShareAvg != 0.4375 {
+		t.Errorf("expected indexing's share last: 0.375, avg: 0.4375,"+
+			" got: %v, %v", s.CombinedIndexShareLast, s.CombinedIndexShareAvg)
+	}
+}
+
+func TestAppHerderEvaluate(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	if err := a.StartQuery(400); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	before := a.Stats()
+
+	// judged against the hypothetical usage, not the live one
+	if ok, reason := a.Evaluate(0, 0, 500); !ok {
+		t.Errorf("expected admission with nothing running, got: %s", reason)
+	}
+	if ok, reason := a.Evaluate(0, 300, 300); ok ||
+		!strings.Contains(reason, "query quota") {
+		t.Errorf("expected the query quota to reject, got: %s", reason)
+	}
+	if ok, reason := a.Evaluate(700, 200, 200); ok ||
+		!strings.Contains(reason, "app quota") {
+		t.Errorf("expected the app quota to reject, got: %s", reason)
+	}
+	if ok, _ := a.Evaluate(700, 100, 200); !ok {
+		t.Errorf("expected admission within both quotas")
+	}
+
+	// with the live checks agreeing
+	if ok, _ := a.Evaluate(0, 400, 100); !ok {
+		t.Errorf("expected the live usage to admit 100")
+	}
+	if err := a.StartQuery(101); err == nil {
+		t.Errorf("expected the live check to reject 101")
+	}
+	if ok, _ := a.Evaluate(0, 400, 101); ok {
+		t.Errorf("expected the live usage to reject 101")
+	}
+
+	if after := a.Stats(); after.RunningQueryUsed != before.RunningQueryUsed ||
+		after.TotQueryRejected != before.TotQueryRejected+1 {
+		t.Errorf("expected live state untouched by Evaluate, got: %+v", after)
+	}
+}
+
+func TestAppHerderHighlightQuota(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	a.SetHighlightRatio(0.2)
+
+	r, err := a.StartQueryWithOptions(100, queryOptions{HighlightSize: 80})
+	if err != nil || !r.Highlight() {
+		t.Fatalf("expected query with highlighting, err: %v", err)
+	}
+
+	// over the highlight sub-quota, downgraded rather than rejected
+	var denied bool
+	r2, err := a.StartQueryWithOptions(100, queryOptions{HighlightSize: 80,
+		OnHighlightDenied: func() { denied = true }})
+	if err != nil || r2.Highlight() || !denied {
+		t.Errorf("expected query without highlighting, err: %v", err)
+	}
+	if s := a.Stats(); s.RunningQueryUsed != 280 {
+		t.Errorf("expected the denied highlight not to be counted, got: %d",
+			s.RunningQueryUsed)
+	}
+
+	// or rejected without a downgrade callback
+	_, err = a.StartQueryWithOptions(100, queryOptions{HighlightSize: 80})
+	if queryRejectReasonOf(err) != rejectHighlightQuota {
+		t.Errorf("expected highlight quota rejection, got: %v", err)
+	}
+
+	r.End()
+	r2.End()
+	if s := a.Stats(); s.RunningQueryUsed != 0 {
+		t.Errorf("expected no queries, got: %d", s.RunningQueryUsed)
+	}
+}
+
+func TestAppHerderQueryCalibration(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.calibration = newCalibrationRecorder()
+
+	if err := a.StartQuery(100); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	a.EndQueryWithActual(100, 150)
+	r, err := a.StartQueryWithOptions(100, queryOptions{ID: "q"})
+	if err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	r.EndWithActual(50)
+
+	s := a.Stats()
+	if s.QueryCalibrationSamples != 2 || s.QueryCalibrationRatioMean != 1 ||
+		s.QueryCalibrationRatioP50 != 0.5 ||
+		s.QueryCalibrationRatioP95 != 0.5 {
+		t.Errorf("expected 2 samples averaging 1, got: %d, mean: %v,"+
+			" p50: %v, p95: %v", s.QueryCalibrationSamples,
+			s.QueryCalibrationRatioMean, s.QueryCalibrationRatioP50,
+			s.QueryCalibrationRatioP95)
+	}
+	if s.RunningQueryUsed != 0 {
+		t.Errorf("expected the estimates to be released, got: %d",
+			s.RunningQueryUsed)
+	}
+}
+
+func TestAppHerderReleaseWrongHerder(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	b := newAppHerder(1000, 1, 1, 1)
+
+	r, err := a.StartQueryWithOptions(100, queryOptions{ID: "q"})
+	if err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	if err := b.StartQuery(100); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+
+	err = b.Release(r)
+	if err == nil || !strings.Contains(err.Error(),
+		"reservation belongs to another herder") {
+		t.Errorf("expected wrong herder error, got: %v", err)
+	}
+	if sa, sb := a.Stats(), b.Stats(); sa.RunningQueryUsed != 100 ||
+		sb.RunningQueryUsed != 100 {
+		t.Errorf("expected both herders' accounting untouched, got: %d, %d",
+			sa.RunningQueryUsed, sb.RunningQueryUsed)
+	}
+
+	if err := a.Release(r); err != nil {
+		t.Errorf("expected release by its own herder, err: %v", err)
+	}
+	if err := a.Release(r); err == nil {
+		t.Errorf("expected a second release to fail")
+	}
+	if s := a.Stats(); s.RunningQueryUsed != 0 {
+		t.Errorf("expected no queries, got: %d", s.RunningQueryUsed)
+	}
+}
+
+func TestAppHerderMaxConcurrentQueries(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.maxConcurrentQueries = 2
+
+	for i := 0; i < 2; i++ {
+		if err := a.StartQuery(10); err != nil {
+			t.Fatalf("expected query to be admitted, err: %v", err)
+		}
+	}
+	err := a.StartQuery(10)
+	if queryRejectReasonOf(err) != rejectConcurrency {
+		t.Errorf("expected concurrency rejection, got: %v", err)
+	}
+	if s := a.Stats(); s.RunningQueries != 2 || s.MaxConcurrentQueries != 2 {
+		t.Errorf("expected 2 of 2 concurrent queries, got: %d, %d",
+			s.RunningQueries, s.MaxConcurrentQueries)
+	}
+
+	a.EndQuery(10)
+	if err := a.StartQuery(10); err != nil {
+		t.Errorf("expected query under the cap to be admitted, err: %v", err)
+	}
+}
+
+func TestAppHerderReleaseGroup(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.checkInvariants = true
+
+	var members []*queryReservation
+	for i := 0; i < 3; i++ {
+		r, err := a.StartQueryWithOptions(100, queryOptions{Group: "a"})
+		if err != nil {
+			t.Fatalf("expected query to be admitted, err: %v", err)
+		}
+		members = append(members, r)
+	}
+	other, err := a.StartQueryWithOptions(100, queryOptions{Group: "b"})
+	if err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+
+	a.m.Lock()
+	gen := a.wakeGen
+	a.m.Unlock()
+	if n := a.ReleaseGroup("a"); n != 3 {
+		t.Errorf("expected 3 released, got: %d", n)
+	}
+	a.m.Lock()
+	wakes := a.wakeGen - gen
+	a.m.Unlock()
+	if wakes != 1 {
+		t.Errorf("expected a single wakeup, got: %d", wakes)
+	}
+
+	// the other group is untouched
+	if s := a.Stats(); s.RunningQueryUsed != 100 || s.RunningQueries != 1 {
+		t.Errorf("expected only the other group running, got: %d, %d",
+			s.RunningQueryUsed, s.RunningQueries)
+	}
+	if rs, _ := a.ActiveReservations(); len(rs) != 1 || rs[0].Group != "b" {
+		t.Errorf("expected the other group's reservation, got: %+v", rs)
+	}
+	for _, r := range members {
+		if err := r.End(); err == nil {
+			t.Errorf("expected released member's end to fail")
+		}
+	}
+	if n := a.ReleaseGroup("a"); n != 0 {
+		t.Errorf("expected nothing left to release, got: %d", n)
+	}
+
+	if err := other.End(); err != nil {
+		t.Errorf("expected the other group's query to end, err: %v", err)
+	}
+	if s := a.Stats(); s.RunningQueryUsed != 0 || s.InvariantViolations != 0 {
+		t.Errorf("expected no queries, got: %+v", s)
+	}
+}
+
+func TestAppHerderQuerySmoothing(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	if err := a.StartQuery(400); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	if err := a.StartQuery(200); err == nil {
+		t.Errorf("expected instantaneous usage to reject the query")
+	}
+	a.EndQuery(400)
+
+	// the average lags behind the spike
+	a.querySmoothing = 0.5
+	if err := a.StartQuery(400); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	if err := a.StartQuery(200); err != nil {
+		t.Errorf("expected the averaged usage to admit the query, err: %v",
+			err)
+	}
+	if s := a.Stats(); s.RunningQueryUsed != 600 || s.RunningQueryAvg != 400 {
+		t.Errorf("expected 600 bytes used, averaging 400, got: %d, %d",
+			s.RunningQueryUsed, s.RunningQueryAvg)
+	}
+
+	// but still catches up with sustained usage
+	if err := a.StartQuery(200); err == nil {
+		t.Errorf("expected the averaged usage to reject the query")
+	}
+}
+
+// waitingQuery is the outcome of a query started by startWaitingQuery.
+type waitingQuery struct {
+	r   *queryReservation
+	err error
+}
+
+// startWaitingQuery starts a query that waits up to maxWait for memory
+// in the background, once the herder has queued queries queued,
+// returning a channel that receives its outcome.
+func startWaitingQuery(t *testing.T, a *appHerder, size uint64,
+	maxWait time.Duration, queued int) chan waitingQuery {
+	rv := make(chan waitingQuery, 1)
+	go func() {
+		r, err := a.StartQueryWithOptions(size,
+			queryOptions{MaxWait: maxWait})
+		rv <- waitingQuery{r, err}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().QueryWaiting != queued+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiting queries", queued+1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return rv
+}
+
+// expectWaiting checks that the query started by startWaitingQuery
+// hasn't been admitted or rejected yet.
+func expectWaiting(t *testing.T, q chan waitingQuery, name string) {
+	select {
+	case wq := <-q:
+		t.Fatalf("expected the %s query to keep waiting, err: %v", name,
+			wq.err)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestAppHerderQueryWaitOrder(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	if err := a.StartQuery(500); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	q1 := startWaitingQuery(t, a, 300, 5*time.Second, 0)
+	q2 := startWaitingQuery(t, a, 100, 5*time.Second, 1)
+	q3 := startWaitingQuery(t, a, 300, 5*time.Second, 2)
+
+	// admitted in arrival order, as far as they fit
+	a.EndQuery(500)
+	wq1, wq2 := <-q1, <-q2
+	if wq1.err != nil || wq2.err != nil {
+		t.Fatalf("expected the first two queries to be admitted, err: %v, %v",
+			wq1.err, wq2.err)
+	}
+	expectWaiting(t, q3, "third")
+
+	// a query that would fit still queues behind the head
+	q4 := startWaitingQuery(t, a, 100, 5*time.Second, 1)
+	expectWaiting(t, q4, "fourth")
+
+	wq1.r.End()
+	for i, q := range []chan waitingQuery{q3, q4} {
+		if wq := <-q; wq.err != nil {
+			t.Errorf("expected query %d to be admitted, err: %v", i+3, wq.err)
+		}
+	}
+	if s := a.Stats(); s.QueryWaiting != 0 || s.RunningQueryUsed != 500 {
+		t.Errorf("expected 500 bytes of queries admitted, got: %d, %d",
+			s.QueryWaiting, s.RunningQueryUsed)
+	}
+}
+
+func TestAppHerderQueryMaxWait(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	if err := a.StartQuery(300); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	head := startWaitingQuery(t, a, 400, 50*time.Millisecond, 0)
+	behind := startWaitingQuery(t, a, 300, 50*time.Millisecond, 1)
+	next := startWaitingQuery(t, a, 100, 5*time.Second, 2)
+
+	// the head is rejected for the memory it waited for, the others
+	// for being queued behind it
+	if wq := <-head; queryRejectReasonOf(wq.err) != rejectQueryQuota {
+		t.Errorf("expected the head to time out for the quota, got: %v",
+			wq.err)
+	}
+	if wq := <-behind; queryRejectReasonOf(wq.err) != rejectQueued &&
+		queryRejectReasonOf(wq.err) != rejectQueryQuota {
+		t.Errorf("expected the second query to time out, got: %v", wq.err)
+	}
+
+	// once they've left, the next query becomes the head, and fits
+	if wq := <-next; wq.err != nil {
+		t.Errorf("expected the next query to be admitted, err: %v", wq.err)
+	}
+	if s := a.Stats(); s.QueryWaiting != 0 || s.TotQueryRejected != 2 {
+		t.Errorf("expected 2 rejections and none waiting, got: %d, %d",
+			s.QueryWaiting, s.TotQueryRejected)
+	}
+}
+
+func TestAppHerderAdmitHook(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	errExpensive := fmt.Errorf("expensive query during peak indexing")
+	var seen appHerderStats
+	a.admit = func(size uint64, s appHerderStats) error {
+		seen = s
+		if size > 100 {
+			return errExpensive
+		}
+		return nil
+	}
+
+	if err := a.StartQuery(200); err != errExpensive {
+		t.Errorf("expected the hook's error as is, got: %v", err)
+	}
+	if err := a.StartQuery(50); err != nil {
+		t.Errorf("expected query to be admitted, err: %v", err)
+	}
+	if seen.QueryQuota != 1000 {
+		t.Errorf("expected the hook to see the stats, got: %+v", seen)
+	}
+
+	// only consulted once the quotas pass
+	if err := a.StartQuery(2000); queryRejectReasonOf(err) !=
+		rejectQueryQuota {
+		t.Errorf("expected the quota to reject first, got: %v", err)
+	}
+	if s := a.Stats(); s.TotQueryRejected != 2 || s.RunningQueryUsed != 50 {
+		t.Errorf("expected 2 rejections, got: %d, %d", s.TotQueryRejected,
+			s.RunningQueryUsed)
+	}
+}
+
+func TestAppHerderProtectedQueries(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.SetQueryFastPath(true)
+
+	// never taken by the fast path, so it's always tracked
+	pinned, err := a.StartQueryWithOptions(100, queryOptions{
+		HighlightSize: 20, Protected: true})
+	if err != nil || pinned.fast || !pinned.Protected() {
+		t.Fatalf("expected a protected locked admission, got: %v", err)
+	}
+	r, err := a.StartQueryWithOptions(50, queryOptions{ID: "q"})
+	if err != nil || r.Protected() {
+		t.Fatalf("expected an unprotected admission, got: %v", err)
+	}
+	if s := a.Stats(); s.ProtectedQueries != 1 ||
+		s.ProtectedQueryMemory != 120 {
+		t.Errorf("expected 1 protected query pinning 120, got: %d, %d",
+			s.ProtectedQueries, s.ProtectedQueryMemory)
+	}
+
+	pinned.End()
+	r.End()
+	if s := a.Stats(); s.ProtectedQueries != 0 ||
+		s.ProtectedQueryMemory != 0 {
+		t.Errorf("expected nothing pinned, got: %d, %d",
+			s.ProtectedQueries, s.ProtectedQueryMemory)
+	}
+}
+
+func TestAppHerderActiveReservations(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+
+	old, err := a.StartQueryWithOptions(100,
+		queryOptions{ID: "old", Group: "g"})
+	if err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err = a.StartQueryWithOptions(50, queryOptions{ID: "new",
+		HighlightSize: 20, Protected: true}); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	// queries without a handle aren't listed
+	if err = a.StartQuery(30); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+
+	rs, fast := a.ActiveReservations()
+	if len(rs) != 2 || fast != 0 {
+		t.Fatalf("expected 2 reservations, got: %+v, fast: %d", rs, fast)
+	}
+	if rs[0].ID != "old" || rs[0].Group != "g" || rs[0].Size != 100 ||
+		rs[0].Protected {
+		t.Errorf("expected the old reservation first, got: %+v", rs[0])
+	}
+	if rs[1].ID != "new" || rs[1].Size != 70 || rs[1].Highlight != 20 ||
+		!rs[1].Protected {
+		t.Errorf("expected the new reservation second, got: %+v", rs[1])
+	}
+	if rs[0].Age-rs[1].Age < 10*time.Millisecond {
+		t.Errorf("expected the old reservation to be 10ms older, got: %s,"+
+			" %s", rs[0].Age, rs[1].Age)
+	}
+
+	old.End()
+	if rs, _ := a.ActiveReservations(); len(rs) != 1 || rs[0].ID != "new" {
+		t.Errorf("expected only the new reservation, got: %+v", rs)
+	}
+}
+
+func TestAppHerderGracePeriodRemaining(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	if d := a.GracePeriodRemaining(); d != 0 {
+		t.Errorf("expected no grace without a window, got: %s", d)
+	}
+
+	a.SetStartupGrace(30 * time.Millisecond)
+	d := a.GracePeriodRemaining()
+	if d <= 0 || d > 30*time.Millisecond {
+		t.Errorf("expected up to 30ms of grace, got: %s", d)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if d2 := a.GracePeriodRemaining(); d2 >= d {
+		t.Errorf("expected the grace to count down, got: %s then %s", d, d2)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if d := a.GracePeriodRemaining(); d != 0 {
+		t.Errorf("expected zero once enforcing, got: %s", d)
+	}
+	if err := a.StartQuery(800); err == nil {
+		t.Errorf("expected quotas enforced once the grace is over")
+	}
+}
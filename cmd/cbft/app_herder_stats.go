@@ -0,0 +1,1486 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbase/clog"
+)
+
+// appHerderIndexStats is the per-index part of appHerderStats.
+type appHerderIndexStats struct {
+	Name     string `json:"name"`
+	Size     uint64 `json:"size"`
+	Exempt   bool   `json:"exempt"`
+	Excluded bool   `json:"excluded"`
+
+	// Bytes introduced by batches but not yet persisted, when in-flight
+	// tracking is enabled.
+	InFlight uint64 `json:"inFlight"`
+
+	// The epochs introduced but not yet persisted, and the memory they
+	// added, when epoch tracking is enabled.
+	UnpersistedEpochs int    `json:"unpersistedEpochs"`
+	BytesBehind       uint64 `json:"bytesBehind"`
+
+	// Whether the index's live size has reached its warmup floor,
+	// after which its Size is no longer floored.
+	WarmedUp bool `json:"warmedUp"`
+
+	// Persister progress events, and the memory they were observed to
+	// free, which lags for indexes that persist slowly.
+	PersisterProgress uint64 `json:"persisterProgress"`
+	PersistedBytes    uint64 `json:"persistedBytes"`
+
+	// Times the reported size changed by more than sizeJumpFactor.
+	SizeJumps uint64 `json:"sizeJumps"`
+
+	// The compressed and uncompressed bytes, for an index with a
+	// SizeBreakdown.
+	CompressedBytes   uint64 `json:"compressedBytes"`
+	UncompressedBytes uint64 `json:"uncompressedBytes"`
+
+	// Whether the index is beyond its alarm threshold.
+	Alarmed bool `json:"alarmed"`
+
+	// The cumulative time the index's batches spent waiting on
+	// backpressure, and the number of waits, where a share out of
+	// proportion to the other indexes' marks a starved index.
+	WaitTime time.Duration `json:"waitTime"`
+	Waits    uint64        `json:"waits"`
+
+	// Batches admitted, and per second since the first.
+	BatchesAdmitted uint64  `json:"batchesAdmitted"`
+	BatchAdmitRate  float64 `json:"batchAdmitRate"`
+}
+
+// appHerderStats is a point-in-time snapshot of the app herder's
+// configuration, accounting and instrumentation.
+type appHerderStats struct {
+	Time time.Time `json:"time"`
+
+	MemQuota   uint64 `json:"memQuota"`
+	AppQuota   uint64 `json:"appQuota"`
+	IndexQuota uint64 `json:"indexQuota"`
+	QueryQuota uint64 `json:"queryQuota"`
+	ReadOnly   bool   `json:"readOnly"`
+
+	// The memQuota that MemQuota is being ramped down to, equal to it
+	// when no ramp is in progress.
+	MemQuotaTarget uint64 `json:"memQuotaTarget"`
+
+	// The memQuota input from each source, and the source whose input
+	// is currently the tightest, setting MemQuotaTarget.
+	MemQuotaSources map[string]uint64 `json:"memQuotaSources"`
+	MemQuotaBinding string            `json:"memQuotaBinding"`
+
+	// memQuota updates superseded by a later one within the coalescing
+	// window, see memQuotaCoalesceWindow.
+	MemQuotaUpdatesCoalesced uint64 `json:"memQuotaUpdatesCoalesced"`
+
+	// Whether backpressure is enforced, see SetEnforcement.
+	Enforcing bool `json:"enforcing"`
+
+	// Whether indexing is paused by PauseIndexing, and queries with it.
+	IndexingPaused bool `json:"indexingPaused"`
+	QueriesHeld    bool `json:"queriesHeld"`
+
+	HighlightQuota uint64 `json:"highlightQuota"`
+
+	// The query memory guaranteed however much indexing holds, and
+	// the query memory available given the IndexingMemory, from
+	// QueryQuotaFloor up to QueryQuota.
+	QueryQuotaFloor     uint64 `json:"queryQuotaFloor"`
+	EffectiveQueryQuota uint64 `json:"effectiveQueryQuota"`
+
+	// The query quota queries are admitted against while warming up to
+	// a raised QueryQuota, see memQueryQuotaWarmup, equal to it
+	// otherwise.
+	WarmQueryQuota uint64 `json:"warmQueryQuota"`
+
+	// IndexQuota less PerIndexOverhead for each of the Indexes.
+	PerIndexOverhead    uint64 `json:"perIndexOverhead"`
+	EffectiveIndexQuota uint64 `json:"effectiveIndexQuota"`
+
+	// The part of appQuota shared by indexing and queries, included
+	// in both IndexQuota and QueryQuota.
+	SharedSlack uint64 `json:"sharedSlack"`
+
+	ArbitrationWeight float64 `json:"arbitrationWeight"`
+
+	// Time left before quotas are enforced, zero once enforcing.
+	StartupGraceRemaining time.Duration `json:"startupGraceRemaining"`
+
+	Indexes          int                   `json:"indexes"`
+	PerIndex         []appHerderIndexStats `json:"perIndex"`
+	IndexingMemory   uint64                `json:"indexingMemory"`
+	RunningQueryUsed uint64                `json:"runningQueryUsed"`
+	Waiting          int                   `json:"waiting"`
+	IngestRateHint   float64               `json:"ingestRateHint"`
+
+	// The size func sweeps run to sample the indexing memory, their
+	// average and latest durations, and the number of size funcs the
+	// latest ran, as with many indexes the sweep itself can add to
+	// admission latency.
+	SizeSweeps       uint64        `json:"sizeSweeps"`
+	SizeSweepAvg     time.Duration `json:"sizeSweepAvg"`
+	SizeSweepLast    time.Duration `json:"sizeSweepLast"`
+	SizeSweepIndexes int           `json:"sizeSweepIndexes"`
+
+	// The memory of indexes excluded from the quotas by
+	// SetIndexExcluded, not included in IndexingMemory.
+	ExcludedIndexingMemory uint64 `json:"excludedIndexingMemory"`
+
+	// The moving average of RunningQueryUsed that queries are admitted
+	// against when QuerySmoothing is non-zero.
+	QuerySmoothing  float64 `json:"querySmoothing"`
+	RunningQueryAvg uint64  `json:"runningQueryAvg"`
+
+	// The rate in bytes per second at which IndexingMemory rose over
+	// the trend window, and the IndexingMemory projected from it that
+	// queries are admitted against, when the trend check is enabled.
+	IndexingTrendRate       float64 `json:"indexingTrendRate"`
+	ProjectedIndexingMemory uint64  `json:"projectedIndexingMemory"`
+
+	// The part of IndexingMemory introduced by batches but not yet
+	// persisted, when in-flight tracking is enabled.
+	InFlightMemory uint64 `json:"inFlightMemory"`
+
+	// The memory added by unpersisted scorch epochs, when epoch
+	// tracking is enabled.
+	BytesBehind uint64 `json:"bytesBehind"`
+
+	// The heap in use as of the last Tick, and how much of it beyond
+	// the tracked usage is taken out of AppQuota, when reconciling.
+	HeapInuse     uint64 `json:"heapInuse"`
+	UntrackedHeap uint64 `json:"untrackedHeap"`
+
+	// The part of RunningQueryUsed reserved for highlighting.
+	RunningHighlightUsed uint64 `json:"runningHighlightUsed"`
+
+	// The query sizes are rounded up to QueryQuantum, when non-zero,
+	// before they're accounted in RunningQueryUsed, while
+	// RunningQueryRawUsed totals them as requested.
+	QueryQuantum        uint64 `json:"queryQuantum"`
+	RunningQueryRawUsed uint64 `json:"runningQueryRawUsed"`
+
+	// Zero size queries warned of or rejected by the zeroSizePolicy.
+	TotZeroSizeQueries uint64 `json:"totZeroSizeQueries"`
+
+	// The query sub-quotas by queryOptions.Index, and the memory held
+	// by the running queries against each index.
+	IndexQueryQuotas map[string]uint64 `json:"indexQueryQuotas"`
+	IndexQueryUsed   map[string]uint64 `json:"indexQueryUsed"`
+
+	// The query memory the lock-free fast path may admit in total,
+	// zero while it's disabled.  Its queries are included in
+	// RunningQueryUsed, RunningQueries and TotQueryAdmitted.
+	FastPathBudget uint64 `json:"fastPathBudget"`
+
+	// The feature currently needing locked query admissions, and so
+	// holding off the fast path, if any.
+	FastPathBlockedBy string `json:"fastPathBlockedBy"`
+
+	// Memory held by misc reservations, such as ReserveRemaining,
+	// including DecayingReserved, what's left of ReserveDecaying ones.
+	MiscReserved     uint64 `json:"miscReserved"`
+	DecayingReserved uint64 `json:"decayingReserved"`
+
+	// The cap on MiscReserved, zero when uncapped.
+	MiscMaxBytes uint64 `json:"miscMaxBytes"`
+
+	// Cumulative admission counters.
+	TotQueryAdmitted uint64 `json:"totQueryAdmitted"`
+	TotQueryRejected uint64 `json:"totQueryRejected"`
+	TotBatchAdmitted uint64 `json:"totBatchAdmitted"`
+
+	// The bytes of the admitted queries, and the queries ended and
+	// their bytes, leaving OutstandingQueries, which excludes those
+	// accounted elsewhere.  With the imbalance window enabled, the
+	// change in OutstandingQueries per second over the last complete
+	// window, and whether they grew throughout it, suspected of
+	// leaking, along with the windows so far that were.
+	TotQueryAdmittedBytes   uint64  `json:"totQueryAdmittedBytes"`
+	TotQueryEnded           uint64  `json:"totQueryEnded"`
+	TotQueryEndedBytes      uint64  `json:"totQueryEndedBytes"`
+	OutstandingQueries      uint64  `json:"outstandingQueries"`
+	OutstandingQueriesTrend float64 `json:"outstandingQueriesTrend"`
+	QueryImbalanceSuspected bool    `json:"queryImbalanceSuspected"`
+	QueryImbalanceWarnings  uint64  `json:"queryImbalanceWarnings"`
+
+	// The admitted batches that waited on backpressure, and their share
+	// of TotBatchAdmitted, where a high ratio signals an undersized
+	// indexing quota, and a ratio near zero one that's rarely binding.
+	TotBatchWaited uint64  `json:"totBatchWaited"`
+	BatchWaitRatio float64 `json:"batchWaitRatio"`
+
+	// The TotBatchWaited by what freed the memory behind the wakeup
+	// that last woke them, persister progress, queries ending, or
+	// anything else, such as quota changes.
+	WakeAdmitsPersister uint64 `json:"wakeAdmitsPersister"`
+	WakeAdmitsQuery     uint64 `json:"wakeAdmitsQuery"`
+	WakeAdmitsOther     uint64 `json:"wakeAdmitsOther"`
+
+	// Reservations released because their query's context was done
+	// first, see StartQueryWithContext.
+	TotQueryContextReleased uint64 `json:"totQueryContextReleased"`
+
+	// Reservations preempted by higher priority queries.
+	TotPreempted uint64 `json:"totPreempted"`
+
+	// RunningQueries includes RunningQueriesElsewhere, the queries
+	// whose memory is accounted for by another subsystem.
+	RunningQueries          int `json:"runningQueries"`
+	RunningQueriesElsewhere int `json:"runningQueriesElsewhere"`
+
+	// The running queries protected from eviction, and the memory they
+	// pin, which no memory relief can reclaim.
+	ProtectedQueries     int    `json:"protectedQueries"`
+	ProtectedQueryMemory uint64 `json:"protectedQueryMemory"`
+
+	// The response to indexing memory pinned at the index quota, from
+	// 0 for none to 3 once OnMemoryPressure has been fired.
+	EscalationLevel int `json:"escalationLevel"`
+
+	// The slice of EffectiveIndexQuota reserved for high priority
+	// batches, how much of it indexing is using, and the high priority
+	// batches waiting and admitted.
+	HighPriorityLaneQuota        uint64 `json:"highPriorityLaneQuota"`
+	HighPriorityLaneUsed         uint64 `json:"highPriorityLaneUsed"`
+	HighPriorityWaiting          int    `json:"highPriorityWaiting"`
+	TotHighPriorityBatchAdmitted uint64 `json:"totHighPriorityBatchAdmitted"`
+
+	// The cap on RunningQueries, zero when uncapped.
+	MaxConcurrentQueries int `json:"maxConcurrentQueries"`
+
+	// How long each currently blocked batch has been waiting, longest
+	// first.  MaxWaiterAge is a better stall signal than Waiting.
+	WaiterAges   []time.Duration `json:"waiterAges"`
+	MaxWaiterAge time.Duration   `json:"maxWaiterAge"`
+
+	// The queries blocked waiting for memory, and how long the one at
+	// the head of the queue has been waiting.
+	QueryWaiting      int           `json:"queryWaiting"`
+	MaxQueryWaiterAge time.Duration `json:"maxQueryWaiterAge"`
+
+	// Accounting invariant violations seen, when checking is enabled.
+	InvariantViolations uint64 `json:"invariantViolations"`
+
+	// Closes of untracked indexes, when close keys are verified.
+	CloseKeyMismatches uint64 `json:"closeKeyMismatches"`
+
+	// Audit records that couldn't be written, when auditing.
+	AuditErrors uint64 `json:"auditErrors"`
+
+	// Times an index crossed its alarm threshold.
+	TotIndexAlarms uint64 `json:"totIndexAlarms"`
+
+	// Persister progress events, and per second over the last Tick
+	// interval.
+	TotPersisterProgress  uint64  `json:"totPersisterProgress"`
+	PersisterProgressRate float64 `json:"persisterProgressRate"`
+
+	// Times the combined appQuota check was exceeded, by a batch or a
+	// query, and indexing's share of the indexing plus query memory at
+	// those times, on average and the last time.  Above 0.5 indexing is
+	// the larger contributor to combined quota pressure.
+	TotCombinedQuotaExceeded uint64  `json:"totCombinedQuotaExceeded"`
+	CombinedIndexShareAvg    float64 `json:"combinedIndexShareAvg"`
+	CombinedIndexShareLast   float64 `json:"combinedIndexShareLast"`
+
+	// Quota boundary crossings per second over the last complete
+	// thrashing detection interval.
+	QuotaCrossingRate float64 `json:"quotaCrossingRate"`
+
+	// Query rejections within the rejection window by reason, such as
+	// "queryQuota", "appQuota" or "concurrency", and the reason with
+	// the most, pointing at the knob to turn; only populated when the
+	// window is enabled.
+	RecentRejections        map[string]uint64 `json:"recentRejections"`
+	DominantRejectionReason string            `json:"dominantRejectionReason"`
+
+	// Queries admitted and rejected per second over the admission rate
+	// window; only populated when the window is enabled.
+	QueryAdmitRate  float64 `json:"queryAdmitRate"`
+	QueryRejectRate float64 `json:"queryRejectRate"`
+
+	// The ratio of actual to estimated memory of completed queries,
+	// where above 1 means queries are underestimated; only populated
+	// when calibration is enabled.
+	QueryCalibrationSamples   uint64  `json:"queryCalibrationSamples"`
+	QueryCalibrationRatioMean float64 `json:"queryCalibrationRatioMean"`
+	QueryCalibrationRatioP50  float64 `json:"queryCalibrationRatioP50"`
+	QueryCalibrationRatioP95  float64 `json:"queryCalibrationRatioP95"`
+
+	// Admission latency percentiles, including any time spent
+	// waiting; only populated when latency recording is enabled.
+	QueryAdmitLatencyP50 time.Duration `json:"queryAdmitLatencyP50"`
+	QueryAdmitLatencyP95 time.Duration `json:"queryAdmitLatencyP95"`
+	QueryAdmitLatencyP99 time.Duration `json:"queryAdmitLatencyP99"`
+	BatchAdmitLatencyP50 time.Duration `json:"batchAdmitLatencyP50"`
+	BatchAdmitLatencyP95 time.Duration `json:"batchAdmitLatencyP95"`
+	BatchAdmitLatencyP99 time.Duration `json:"batchAdmitLatencyP99"`
+
+	// Percentiles of how long the herder's lock is held per
+	// acquisition, which bounds admission latency, and the longest
+	// hold; only populated when lock hold recording is enabled.  The
+	// size funcs run with the lock released, so holds well below
+	// SizeSweepAvg point at the sweep, rather than the lock, as the
+	// latency culprit.
+	LockHoldP50 time.Duration `json:"lockHoldP50"`
+	LockHoldP95 time.Duration `json:"lockHoldP95"`
+	LockHoldP99 time.Duration `json:"lockHoldP99"`
+	LockHoldMax time.Duration `json:"lockHoldMax"`
+}
+
+func (a *appHerder) Stats() appHerderStats {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	// sampled first, as it releases the lock while the size funcs run
+	return a.statsLOCKED(a.indexingMemoryLOCKED())
+}
+
+// statsLOCKED returns the stats given an already sampled indexingMem,
+// without releasing the lock.
+func (a *appHerder) statsLOCKED(indexingMem uint64) appHerderStats {
+	rv := appHerderStats{
+		Time: time.Now(),
+
+		MemQuota:   a.memQuota,
+		AppQuota:   a.appQuota,
+		IndexQuota: a.indexQuota,
+		QueryQuota: a.queryQuota,
+		ReadOnly:   a.readOnly,
+
+		MemQuotaTarget:  a.memQuotaTarget,
+		MemQuotaBinding: a.memQuotaBinding,
+
+		MemQuotaUpdatesCoalesced: a.memQuotaUpdatesCoalesced,
+
+		Enforcing: !a.unenforced,
+
+		IndexingPaused: a.indexingPaused,
+		QueriesHeld:    a.queriesHeld,
+
+		HighlightQuota: a.highlightQuota,
+
+		QueryQuotaFloor:     a.queryFloorLOCKED(),
+		EffectiveQueryQuota: a.effectiveQueryQuotaLOCKED(indexingMem),
+
+		WarmQueryQuota: a.warmQueryQuota,
+
+		PerIndexOverhead:    a.perIndexOverhead,
+		EffectiveIndexQuota: a.effectiveIndexQuotaLOCKED(),
+
+		SharedSlack: a.sharedSlack,
+
+		ArbitrationWeight: a.arbitrationWeight,
+
+		StartupGraceRemaining: a.graceRemainingLOCKED(),
+
+		Indexes:          len(a.indexes),
+		IndexingMemory:   indexingMem,
+		RunningQueryUsed: a.runningQueryUsed + atomic.LoadUint64(&a.fastUsed),
+
+		RunningHighlightUsed: a.runningHighlightUsed,
+		FastPathBudget:       atomic.LoadUint64(&a.fastBudget),
+		FastPathBlockedBy:    a.lockedAdmissionNeededLOCKED(),
+		MiscReserved:         a.miscReserved,
+		Waiting:              a.waiting,
+		IngestRateHint:       a.ingestRateHintLOCKED(indexingMem),
+
+		QuerySmoothing:  a.querySmoothing,
+		RunningQueryAvg: uint64(a.runningQueryAvg),
+
+		IndexingTrendRate:       a.indexTrendRateLOCKED(),
+		ProjectedIndexingMemory: a.projectedIndexingMemoryLOCKED(indexingMem),
+
+		RunningQueries: a.runningQueries +
+			int(atomic.LoadInt64(&a.fastQueries)),
+		RunningQueriesElsewhere: a.runningQueriesElsewhere,
+		MaxConcurrentQueries:    a.maxConcurrentQueries,
+		EscalationLevel:         a.escalation,
+	}
+
+	rv.TotQueryAdmitted = a.totQueryAdmitted +
+		atomic.LoadUint64(&a.fastAdmitted)
+	rv.TotQueryRejected = a.totQueryRejected
+	rv.QueryQuantum = a.queryQuantum
+	rv.TotZeroSizeQueries = a.totZeroSizeQueries
+	rv.RunningQueryRawUsed = a.runningQueryRawUsed +
+		atomic.LoadUint64(&a.fastRawUsed)
+	var started uint64
+	started, rv.TotQueryEnded, rv.TotQueryAdmittedBytes,
+		rv.TotQueryEndedBytes = a.queryBalanceLOCKED()
+	rv.OutstandingQueries = outstandingQueries(started, rv.TotQueryEnded)
+	if a.imbalance != nil {
+		rv.OutstandingQueriesTrend = a.imbalance.trend
+		rv.QueryImbalanceSuspected = a.imbalance.suspected
+		rv.QueryImbalanceWarnings = a.imbalance.warnings
+	}
+	rv.TotBatchAdmitted = a.totBatchAdmitted
+	rv.TotBatchWaited = a.totBatchWaited
+	rv.WakeAdmitsPersister = a.wakeAdmits[wakeSourcePersister]
+	rv.WakeAdmitsQuery = a.wakeAdmits[wakeSourceQuery]
+	rv.WakeAdmitsOther = a.wakeAdmits[wakeSourceOther]
+	if a.totBatchAdmitted > 0 {
+		rv.BatchWaitRatio = float64(a.totBatchWaited) /
+			float64(a.totBatchAdmitted)
+	}
+	rv.TotQueryContextReleased = a.totQueryContextReleased
+	rv.TotPreempted = a.totPreempted
+
+	rv.DecayingReserved = a.decayingReservedLOCKED(rv.Time)
+	rv.MiscMaxBytes = a.miscMaxBytes
+	rv.MiscReserved += rv.DecayingReserved
+
+	for r := range a.reservations {
+		if r.protected {
+			rv.ProtectedQueries++
+			rv.ProtectedQueryMemory += r.size + r.highlight
+		}
+	}
+
+	normalIndexQuota := a.normalIndexQuotaLOCKED()
+	rv.HighPriorityLaneQuota = a.effectiveIndexQuotaLOCKED() - normalIndexQuota
+	if indexingMem > normalIndexQuota {
+		rv.HighPriorityLaneUsed = indexingMem - normalIndexQuota
+	}
+	rv.HighPriorityWaiting = a.waitingHighPriority
+	rv.TotHighPriorityBatchAdmitted = a.totHighPriorityBatchAdmitted
+
+	rv.ExcludedIndexingMemory = a.excludedIndexingMemory
+
+	rv.SizeSweeps = a.sizeSweeps
+	if a.sizeSweeps > 0 {
+		rv.SizeSweepAvg = a.sizeSweepTotal / time.Duration(a.sizeSweeps)
+	}
+	rv.SizeSweepLast = a.sizeSweepLast
+	rv.SizeSweepIndexes = a.sizeSweepIndexes
+
+	rv.InvariantViolations = a.invariantViolations
+	rv.CloseKeyMismatches = a.closeKeyMismatches
+	if a.audit != nil {
+		rv.AuditErrors = a.audit.Errors()
+	}
+	rv.TotIndexAlarms = a.totIndexAlarms
+
+	now := rv.Time
+
+	rv.PerIndex = make([]appHerderIndexStats, 0, len(a.indexes))
+	for index, entry := range a.indexes {
+		is := appHerderIndexStats{
+			Name:     indexName(index, entry),
+			Size:     entry.lastSize,
+			Exempt:   entry.opts.Exempt,
+			Excluded: entry.excluded,
+
+			InFlight: entry.inFlight,
+			WarmedUp: entry.warmedUp,
+
+			UnpersistedEpochs: len(entry.epochs),
+			BytesBehind:       entry.bytesBehind(),
+
+			PersisterProgress: entry.persisterProgress,
+			PersistedBytes:    entry.persistedBytes,
+
+			SizeJumps: entry.sizeJumps,
+
+			CompressedBytes:   entry.compressedBytes,
+			UncompressedBytes: entry.uncompressedBytes,
+
+			Alarmed: entry.alarmed,
+
+			WaitTime: entry.waitTime,
+			Waits:    entry.waits,
+
+			BatchesAdmitted: entry.batchesAdmitted,
+		}
+		if elapsed := now.Sub(entry.firstAdmit); entry.batchesAdmitted > 0 &&
+			elapsed > 0 {
+			is.BatchAdmitRate = float64(entry.batchesAdmitted) / elapsed.Seconds()
+		}
+		rv.PerIndex = append(rv.PerIndex, is)
+		rv.InFlightMemory += entry.inFlight
+		rv.BytesBehind += is.BytesBehind
+	}
+	sort.Slice(rv.PerIndex, func(i, j int) bool {
+		return rv.PerIndex[i].Size > rv.PerIndex[j].Size
+	})
+
+	if len(a.waiters) > 0 {
+		rv.WaiterAges = make([]time.Duration, 0, len(a.waiters))
+		for _, w := range a.waiters {
+			rv.WaiterAges = append(rv.WaiterAges, now.Sub(w.since))
+		}
+		sort.Slice(rv.WaiterAges, func(i, j int) bool {
+			return rv.WaiterAges[i] > rv.WaiterAges[j]
+		})
+		rv.MaxWaiterAge = rv.WaiterAges[0]
+	}
+
+	rv.QueryWaiting = len(a.queryWaiters)
+	if len(a.queryWaiters) > 0 {
+		rv.MaxQueryWaiterAge = now.Sub(a.queryWaiters[0].since)
+	}
+
+	rv.HeapInuse = a.heapInuse
+	rv.UntrackedHeap = a.untrackedHeap
+
+	rv.TotPersisterProgress = a.totPersisterProgress
+	rv.PersisterProgressRate = a.persisterProgressRate
+
+	rv.TotCombinedQuotaExceeded = a.totCombinedQuotaExceeded
+	if a.totCombinedQuotaExceeded > 0 {
+		rv.CombinedIndexShareAvg = a.combinedIndexShareSum /
+			float64(a.totCombinedQuotaExceeded)
+		rv.CombinedIndexShareLast = a.combinedIndexShareLast
+	}
+
+	if a.thrash != nil {
+		rv.QuotaCrossingRate = a.thrash.rate
+	}
+
+	rv.MemQuotaSources = make(map[string]uint64, len(a.memQuotaSources))
+	for source, q := range a.memQuotaSources {
+		rv.MemQuotaSources[source] = q
+	}
+
+	rv.IndexQueryQuotas = make(map[string]uint64, len(a.indexQueryQuotas))
+	for index, q := range a.indexQueryQuotas {
+		rv.IndexQueryQuotas[index] = q
+	}
+	rv.IndexQueryUsed = make(map[string]uint64, len(a.indexQueryUsed))
+	for index, n := range a.indexQueryUsed {
+		rv.IndexQueryUsed[index] = n
+	}
+
+	if a.rejections != nil {
+		rv.RecentRejections, rv.DominantRejectionReason =
+			a.rejections.breakdown(now)
+	}
+
+	if a.admissions != nil {
+		a.recordAdmissionsLOCKED(0, 0)
+		rv.QueryAdmitRate, rv.QueryRejectRate = a.admissions.rates(now)
+	}
+
+	if a.calibration != nil {
+		rv.QueryCalibrationSamples = a.calibration.count
+		rv.QueryCalibrationRatioMean = a.calibration.mean()
+		rv.QueryCalibrationRatioP50 = a.calibration.percentile(0.50)
+		rv.QueryCalibrationRatioP95 = a.calibration.percentile(0.95)
+	}
+
+	if a.queryAdmitLatency != nil {
+		rv.QueryAdmitLatencyP50 = a.queryAdmitLatency.percentile(0.50)
+		rv.QueryAdmitLatencyP95 = a.queryAdmitLatency.percentile(0.95)
+		rv.QueryAdmitLatencyP99 = a.queryAdmitLatency.percentile(0.99)
+	}
+	if a.batchAdmitLatency != nil {
+		rv.BatchAdmitLatencyP50 = a.batchAdmitLatency.percentile(0.50)
+		rv.BatchAdmitLatencyP95 = a.batchAdmitLatency.percentile(0.95)
+		rv.BatchAdmitLatencyP99 = a.batchAdmitLatency.percentile(0.99)
+	}
+	if a.m.holds != nil {
+		rv.LockHoldP50 = a.m.holds.percentile(0.50)
+		rv.LockHoldP95 = a.m.holds.percentile(0.95)
+		rv.LockHoldP99 = a.m.holds.percentile(0.99)
+		rv.LockHoldMax = a.m.maxHold
+	}
+
+	return rv
+}
+
+// ------------------------------------------------------------------
+
+// appHerderStatsDelta is the difference between two Stats snapshots,
+// for before/after comparisons: the net change of gauges, and the
+// increase of cumulative counters along with their per second rate
+// over the interval.
+type appHerderStatsDelta struct {
+	Interval time.Duration
+
+	MemQuota             int64
+	AppQuota             int64
+	IndexQuota           int64
+	QueryQuota           int64
+	Indexes              int
+	IndexingMemory       int64
+	RunningQueryUsed     int64
+	RunningHighlightUsed int64
+	RunningQueries       int
+	Waiting              int
+
+	TotQueryAdmitted             uint64
+	TotQueryAdmittedRate         float64
+	TotQueryRejected             uint64
+	TotQueryRejectedRate         float64
+	TotBatchAdmitted             uint64
+	TotBatchAdmittedRate         float64
+	TotPersisterProgress         uint64
+	TotPersisterProgressRate     float64
+	TotCombinedQuotaExceeded     uint64
+	TotCombinedQuotaExceededRate float64
+	InvariantViolations          uint64
+	QueryCalibrationSamples      uint64
+}
+
+// DeltaFrom returns the change from the earlier snapshot prev to s.
+func (s appHerderStats) DeltaFrom(prev appHerderStats) appHerderStatsDelta {
+	rv := appHerderStatsDelta{
+		Interval: s.Time.Sub(prev.Time),
+
+		MemQuota:             int64(s.MemQuota - prev.MemQuota),
+		AppQuota:             int64(s.AppQuota - prev.AppQuota),
+		IndexQuota:           int64(s.IndexQuota - prev.IndexQuota),
+		QueryQuota:           int64(s.QueryQuota - prev.QueryQuota),
+		Indexes:              s.Indexes - prev.Indexes,
+		IndexingMemory:       int64(s.IndexingMemory - prev.IndexingMemory),
+		RunningQueryUsed:     int64(s.RunningQueryUsed - prev.RunningQueryUsed),
+		RunningHighlightUsed: int64(s.RunningHighlightUsed - prev.RunningHighlightUsed),
+		RunningQueries:       s.RunningQueries - prev.RunningQueries,
+		Waiting:              s.Waiting - prev.Waiting,
+
+		TotQueryAdmitted:         s.TotQueryAdmitted - prev.TotQueryAdmitted,
+		TotQueryRejected:         s.TotQueryRejected - prev.TotQueryRejected,
+		TotBatchAdmitted:         s.TotBatchAdmitted - prev.TotBatchAdmitted,
+		TotPersisterProgress:     s.TotPersisterProgress - prev.TotPersisterProgress,
+		TotCombinedQuotaExceeded: s.TotCombinedQuotaExceeded - prev.TotCombinedQuotaExceeded,
+		InvariantViolations:      s.InvariantViolations - prev.InvariantViolations,
+		QueryCalibrationSamples:  s.QueryCalibrationSamples - prev.QueryCalibrationSamples,
+	}
+
+	if secs := rv.Interval.Seconds(); secs > 0 {
+		rv.TotQueryAdmittedRate = float64(rv.TotQueryAdmitted) / secs
+		rv.TotQueryRejectedRate = float64(rv.TotQueryRejected) / secs
+		rv.TotBatchAdmittedRate = float64(rv.TotBatchAdmitted) / secs
+		rv.TotPersisterProgressRate = float64(rv.TotPersisterProgress) / secs
+		rv.TotCombinedQuotaExceededRate =
+			float64(rv.TotCombinedQuotaExceeded) / secs
+	}
+
+	return rv
+}
+
+// ------------------------------------------------------------------
+
+// memoryBreakdown decomposes appQuota by category, such as for a
+// stacked chart, with Indexing, Queries, Misc and Free summing to
+// AppQuota, except when usage exceeds it, by Over.
+type memoryBreakdown struct {
+	AppQuota uint64
+
+	Indexing uint64
+	PerIndex []memoryBreakdownIndex // Largest first.
+	Queries  uint64
+	Misc     uint64
+	Free     uint64
+	Over     uint64
+}
+
+// memoryBreakdownIndex is an index's part of memoryBreakdown.Indexing.
+type memoryBreakdownIndex struct {
+	Name  string
+	Bytes uint64
+}
+
+// MemoryBreakdown returns the memory used by each index, the running
+// queries and misc reservations, and the free headroom, together
+// accounting for appQuota.  Indexes excluded by SetIndexExcluded
+// aren't included, as they don't count against it.
+func (a *appHerder) MemoryBreakdown() memoryBreakdown {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	var indexingMem uint64
+	if !a.readOnly {
+		indexingMem = a.indexingMemoryLOCKED()
+	}
+
+	rv := memoryBreakdown{
+		AppQuota: a.appQuota,
+		Indexing: indexingMem,
+		Queries:  a.queryUsedLOCKED(),
+		Misc:     a.miscUsedLOCKED(),
+	}
+	if !a.readOnly {
+		for index, entry := range a.indexes {
+			if entry.size == nil || entry.excluded {
+				continue
+			}
+			rv.PerIndex = append(rv.PerIndex, memoryBreakdownIndex{
+				Name:  indexName(index, entry),
+				Bytes: entry.lastSize,
+			})
+		}
+	}
+	sort.Slice(rv.PerIndex, func(i, j int) bool {
+		return rv.PerIndex[i].Bytes > rv.PerIndex[j].Bytes
+	})
+
+	used := rv.Indexing + rv.Queries + rv.Misc
+	rv.Free = headroom(rv.AppQuota, used)
+	rv.Over = headroom(used, rv.AppQuota)
+	return rv
+}
+
+// ------------------------------------------------------------------
+
+// appHerderStatsVersion identifies the layout of appHerderStatsBinary,
+// and must be bumped whenever that changes.
+const appHerderStatsVersion = 1
+
+// appHerderStatsBinary is the fixed binary layout of the numeric stats
+// written by Encode, cheap enough for sub-second sampling during load
+// tests where JSON marshaling would itself distort the measurements.
+// Fields are only ever appended, along with a version bump.
+type appHerderStatsBinary struct {
+	Version uint32
+	Flags   uint32 // See appHerderStatsFlag*.
+	Time    int64  // In Unix nanoseconds.
+
+	MemQuota            uint64
+	MemQuotaTarget      uint64
+	AppQuota            uint64
+	IndexQuota          uint64
+	EffectiveIndexQuota uint64
+	QueryQuota          uint64
+	EffectiveQueryQuota uint64
+	HighlightQuota      uint64
+
+	Indexes              int64
+	IndexingMemory       uint64
+	InFlightMemory       uint64
+	BytesBehind          uint64
+	HeapInuse            uint64
+	UntrackedHeap        uint64
+	RunningQueryUsed     uint64
+	RunningHighlightUsed uint64
+	MiscReserved         uint64
+	FastPathBudget       uint64
+
+	RunningQueries          int64
+	RunningQueriesElsewhere int64
+	ProtectedQueries        int64
+	Waiting                 int64
+	HighPriorityWaiting     int64
+	QueryWaiting            int64
+	MaxWaiterAge            int64 // In nanoseconds.
+	MaxQueryWaiterAge       int64 // In nanoseconds.
+	EscalationLevel         int64
+
+	TotQueryAdmitted             uint64
+	TotQueryRejected             uint64
+	TotBatchAdmitted             uint64
+	TotHighPriorityBatchAdmitted uint64
+	TotPersisterProgress         uint64
+	TotCombinedQuotaExceeded     uint64
+	InvariantViolations          uint64
+}
+
+const (
+	appHerderStatsFlagReadOnly = 1 << iota
+	appHerderStatsFlagEnforcing
+	appHerderStatsFlagIndexingPaused
+	appHerderStatsFlagQueriesHeld
+)
+
+// Encode writes the numeric fields of s to w in a fixed little-endian
+// binary layout, to be read back by Decode.  Per-index stats and other
+// variable length fields are left out.
+func (s appHerderStats) Encode(w io.Writer) error {
+	var flags uint32
+	for _, f := range []struct {
+		set  bool
+		flag uint32
+	}{
+		{s.ReadOnly, appHerderStatsFlagReadOnly},
+		{s.Enforcing, appHerderStatsFlagEnforcing},
+		{s.IndexingPaused, appHerderStatsFlagIndexingPaused},
+		{s.QueriesHeld, appHerderStatsFlagQueriesHeld},
+	} {
+		if f.set {
+			flags |= f.flag
+		}
+	}
+
+	return binary.Write(w, binary.LittleEndian, &appHerderStatsBinary{
+		Version: appHerderStatsVersion,
+		Flags:   flags,
+		Time:    s.Time.UnixNano(),
+
+		MemQuota:            s.MemQuota,
+		MemQuotaTarget:      s.MemQuotaTarget,
+		AppQuota:            s.AppQuota,
+		IndexQuota:          s.IndexQuota,
+		EffectiveIndexQuota: s.EffectiveIndexQuota,
+		QueryQuota:          s.QueryQuota,
+		EffectiveQueryQuota: s.EffectiveQueryQuota,
+		HighlightQuota:      s.HighlightQuota,
+
+		Indexes:              int64(s.Indexes),
+		IndexingMemory:       s.IndexingMemory,
+		InFlightMemory:       s.InFlightMemory,
+		BytesBehind:          s.BytesBehind,
+		HeapInuse:            s.HeapInuse,
+		UntrackedHeap:        s.UntrackedHeap,
+		RunningQueryUsed:     s.RunningQueryUsed,
+		RunningHighlightUsed: s.RunningHighlightUsed,
+		MiscReserved:         s.MiscReserved,
+		FastPathBudget:       s.FastPathBudget,
+
+		RunningQueries:          int64(s.RunningQueries),
+		RunningQueriesElsewhere: int64(s.RunningQueriesElsewhere),
+		ProtectedQueries:        int64(s.ProtectedQueries),
+		Waiting:                 int64(s.Waiting),
+		HighPriorityWaiting:     int64(s.HighPriorityWaiting),
+		QueryWaiting:            int64(s.QueryWaiting),
+		MaxWaiterAge:            int64(s.MaxWaiterAge),
+		MaxQueryWaiterAge:       int64(s.MaxQueryWaiterAge),
+		EscalationLevel:         int64(s.EscalationLevel),
+
+		TotQueryAdmitted:             s.TotQueryAdmitted,
+		TotQueryRejected:             s.TotQueryRejected,
+		TotBatchAdmitted:             s.TotBatchAdmitted,
+		TotHighPriorityBatchAdmitted: s.TotHighPriorityBatchAdmitted,
+		TotPersisterProgress:         s.TotPersisterProgress,
+		TotCombinedQuotaExceeded:     s.TotCombinedQuotaExceeded,
+		InvariantViolations:          s.InvariantViolations,
+	})
+}
+
+// Decode reads stats written by Encode from r into s, setting only the
+// fields Encode writes.
+func (s *appHerderStats) Decode(r io.Reader) error {
+	var b appHerderStatsBinary
+	if err := binary.Read(r, binary.LittleEndian, &b); err != nil {
+		return fmt.Errorf("app_herder: decoding stats, err: %v", err)
+	}
+	if b.Version != appHerderStatsVersion {
+		return fmt.Errorf("app_herder: decoding stats, unknown version: %d",
+			b.Version)
+	}
+
+	*s = appHerderStats{
+		Time: time.Unix(0, b.Time),
+
+		MemQuota:   b.MemQuota,
+		AppQuota:   b.AppQuota,
+		IndexQuota: b.IndexQuota,
+		QueryQuota: b.QueryQuota,
+		ReadOnly:   b.Flags&appHerderStatsFlagReadOnly != 0,
+
+		MemQuotaTarget: b.MemQuotaTarget,
+
+		Enforcing: b.Flags&appHerderStatsFlagEnforcing != 0,
+
+		IndexingPaused: b.Flags&appHerderStatsFlagIndexingPaused != 0,
+		QueriesHeld:    b.Flags&appHerderStatsFlagQueriesHeld != 0,
+
+		HighlightQuota: b.HighlightQuota,
+
+		EffectiveQueryQuota: b.EffectiveQueryQuota,
+		EffectiveIndexQuota: b.EffectiveIndexQuota,
+
+		Indexes:          int(b.Indexes),
+		IndexingMemory:   b.IndexingMemory,
+		RunningQueryUsed: b.RunningQueryUsed,
+		Waiting:          int(b.Waiting),
+
+		InFlightMemory: b.InFlightMemory,
+		BytesBehind:    b.BytesBehind,
+		HeapInuse:      b.HeapInuse,
+		UntrackedHeap:  b.UntrackedHeap,
+
+		RunningHighlightUsed: b.RunningHighlightUsed,
+		FastPathBudget:       b.FastPathBudget,
+		MiscReserved:         b.MiscReserved,
+
+		TotQueryAdmitted: b.TotQueryAdmitted,
+		TotQueryRejected: b.TotQueryRejected,
+		TotBatchAdmitted: b.TotBatchAdmitted,
+
+		RunningQueries:          int(b.RunningQueries),
+		RunningQueriesElsewhere: int(b.RunningQueriesElsewhere),
+		ProtectedQueries:        int(b.ProtectedQueries),
+
+		EscalationLevel: int(b.EscalationLevel),
+
+		HighPriorityWaiting:          int(b.HighPriorityWaiting),
+		TotHighPriorityBatchAdmitted: b.TotHighPriorityBatchAdmitted,
+
+		MaxWaiterAge:      time.Duration(b.MaxWaiterAge),
+		QueryWaiting:      int(b.QueryWaiting),
+		MaxQueryWaiterAge: time.Duration(b.MaxQueryWaiterAge),
+
+		InvariantViolations: b.InvariantViolations,
+
+		TotPersisterProgress:     b.TotPersisterProgress,
+		TotCombinedQuotaExceeded: b.TotCombinedQuotaExceeded,
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------
+
+// appHerderConfig is the herder's configuration, as in Describe, with
+// sizes in bytes and durations and enums as their strings, for
+// StateJSON.
+type appHerderConfig struct {
+	AppRatio       float64 `json:"appRatio"`
+	IndexRatio     float64 `json:"indexRatio"`
+	QueryRatio     float64 `json:"queryRatio"`
+	HighlightRatio float64 `json:"highlightRatio"`
+	ShareSlack     bool    `json:"shareSlack"`
+
+	IndexMaxBytes         uint64 `json:"indexMaxBytes"`
+	MemQuotaMaxShrinkRate uint64 `json:"memQuotaMaxShrinkRate"`
+	MemQuotaCoalesce      string `json:"memQuotaCoalesce"`
+	QueryQuotaWarmup      string `json:"queryQuotaWarmup"`
+	QueryCancelGrace      string `json:"queryCancelGrace"`
+	QueryPreemption       bool   `json:"queryPreemption"`
+
+	ReadOnly       bool `json:"readOnly"`
+	Enforcing      bool `json:"enforcing"`
+	IndexingPaused bool `json:"indexingPaused"`
+	QueriesHeld    bool `json:"queriesHeld"`
+
+	ArbitrationWeight    float64 `json:"arbitrationWeight"`
+	IngestThrottleStart  float64 `json:"ingestThrottleStart"`
+	HealthyStabilization string  `json:"healthyStabilization"`
+	OOMImminentRatio     float64 `json:"oomImminentRatio"`
+
+	MinBatchInterval  string  `json:"minBatchInterval"`
+	WarmupFloor       uint64  `json:"warmupFloor"`
+	SizeJumpFactor    float64 `json:"sizeJumpFactor"`
+	IndexAlarmRearm   float64 `json:"indexAlarmRearm"`
+	CompressedWeight  float64 `json:"compressedWeight"`
+	PerIndexOverhead  uint64  `json:"perIndexOverhead"`
+	HighPriorityRatio float64 `json:"highPriorityRatio"`
+
+	MaxConcurrentQueries int     `json:"maxConcurrentQueries"`
+	QuerySmoothing       float64 `json:"querySmoothing"`
+	QueryQuantum         uint64  `json:"queryQuantum"`
+	QueryFastPath        bool    `json:"queryFastPath"`
+	ZeroSizePolicy       string  `json:"zeroSizePolicy"`
+
+	IndexTrendWindow      string  `json:"indexTrendWindow"`
+	IndexTrendSensitivity float64 `json:"indexTrendSensitivity"`
+
+	EscalateThrottleAfter string `json:"escalateThrottleAfter"`
+	EscalatePauseAfter    string `json:"escalatePauseAfter"`
+	EscalateFlushAfter    string `json:"escalateFlushAfter"`
+	CombinedYield         string `json:"combinedYield"`
+
+	PersisterWakeMode      string `json:"persisterWakeMode"`
+	PersisterWakeBatchSize uint64 `json:"persisterWakeBatchSize"`
+	MossStatsErrPolicy     string `json:"mossStatsErrPolicy"`
+
+	HeapDivergence float64 `json:"heapDivergence"`
+	HeapScaleQuota bool    `json:"heapScaleQuota"`
+
+	CheckInvariants  bool `json:"checkInvariants"`
+	StrictAccounting bool `json:"strictAccounting"`
+	VerifyCloseKeys  bool `json:"verifyCloseKeys"`
+	Audit            bool `json:"audit"`
+}
+
+func (a *appHerder) configLOCKED() appHerderConfig {
+	return appHerderConfig{
+		AppRatio:       a.appRatio,
+		IndexRatio:     a.indexRatio,
+		QueryRatio:     a.queryRatio,
+		HighlightRatio: a.highlightRatio,
+		ShareSlack:     a.shareSlack,
+
+		IndexMaxBytes:         a.indexMaxBytes,
+		MemQuotaMaxShrinkRate: a.memQuotaMaxShrinkRate,
+		MemQuotaCoalesce:      a.memQuotaCoalesce.String(),
+		QueryQuotaWarmup:      a.queryQuotaWarmup.String(),
+		QueryCancelGrace:      a.queryCancelGrace.String(),
+		QueryPreemption:       a.queryPreemption,
+
+		ReadOnly:       a.readOnly,
+		Enforcing:      !a.unenforced,
+		IndexingPaused: a.indexingPaused,
+		QueriesHeld:    a.queriesHeld,
+
+		ArbitrationWeight:    a.arbitrationWeight,
+		IngestThrottleStart:  a.ingestThrottleStart,
+		HealthyStabilization: a.healthyStabilization.String(),
+		OOMImminentRatio:     a.oomImminentRatio,
+
+		MinBatchInterval:  a.minBatchInterval.String(),
+		WarmupFloor:       a.warmupFloor,
+		SizeJumpFactor:    a.sizeJumpFactor,
+		IndexAlarmRearm:   a.indexAlarmRearm,
+		CompressedWeight:  a.compressedWeight,
+		PerIndexOverhead:  a.perIndexOverhead,
+		HighPriorityRatio: a.highPriorityRatio,
+
+		MaxConcurrentQueries: a.maxConcurrentQueries,
+		QuerySmoothing:       a.querySmoothing,
+		QueryQuantum:         a.queryQuantum,
+		QueryFastPath:        a.queryFastPath,
+		ZeroSizePolicy:       a.zeroSizePolicy.String(),
+
+		IndexTrendWindow:      a.indexTrendWindow.String(),
+		IndexTrendSensitivity: a.indexTrendSensitivity,
+
+		EscalateThrottleAfter: a.escalateThrottleAfter.String(),
+		EscalatePauseAfter:    a.escalatePauseAfter.String(),
+		EscalateFlushAfter:    a.escalateFlushAfter.String(),
+		CombinedYield:         a.combinedYield.String(),
+
+		PersisterWakeMode:      a.persisterWakeMode.String(),
+		PersisterWakeBatchSize: a.persisterWakeBatchSize,
+		MossStatsErrPolicy:     a.mossStatsErrPolicy.String(),
+
+		HeapDivergence: a.heapDivergence,
+		HeapScaleQuota: a.heapScaleQuota,
+
+		CheckInvariants:  a.checkInvariants,
+		StrictAccounting: a.strictAccounting,
+		VerifyCloseKeys:  a.verifyCloseKeys,
+		Audit:            a.audit != nil,
+	}
+}
+
+// appHerderState is the herder's configuration and stats, as one
+// consistent snapshot, see StateJSON.
+type appHerderState struct {
+	Config appHerderConfig `json:"config"`
+	Stats  appHerderStats  `json:"stats"`
+}
+
+// StateJSON returns the herder's configuration and stats as a JSON
+// object, {"config": {...}, "stats": {...}}, meant to be served as is
+// by an admin endpoint.  The size funcs are run once, after which the
+// rest is snapshotted within a single hold of the lock.
+func (a *appHerder) StateJSON() ([]byte, error) {
+	a.m.Lock()
+	indexingMem := a.indexingMemoryLOCKED()
+	state := appHerderState{
+		Config: a.configLOCKED(),
+		Stats:  a.statsLOCKED(indexingMem),
+	}
+	a.m.Unlock()
+
+	return json.Marshal(state)
+}
+
+// MarshalJSON encodes the per-index stats like appHerderStats.
+func (s appHerderIndexStats) MarshalJSON() ([]byte, error) {
+	type stats appHerderIndexStats // Without the method.
+	rv := struct {
+		stats
+		WaitTime string `json:"waitTime"`
+	}{
+		stats:    stats(s),
+		WaitTime: s.WaitTime.String(),
+	}
+	return json.Marshal(rv)
+}
+
+// MarshalJSON encodes the stats with durations as their strings, such
+// as "1.5s", shadowing the embedded fields of the same names.
+func (s appHerderStats) MarshalJSON() ([]byte, error) {
+	type stats appHerderStats // Without the method.
+	rv := struct {
+		stats
+		StartupGraceRemaining string   `json:"startupGraceRemaining"`
+		SizeSweepAvg          string   `json:"sizeSweepAvg"`
+		SizeSweepLast         string   `json:"sizeSweepLast"`
+		WaiterAges            []string `json:"waiterAges"`
+		MaxWaiterAge          string   `json:"maxWaiterAge"`
+		MaxQueryWaiterAge     string   `json:"maxQueryWaiterAge"`
+		QueryAdmitLatencyP50  string   `json:"queryAdmitLatencyP50"`
+		QueryAdmitLatencyP95  string   `json:"queryAdmitLatencyP95"`
+		QueryAdmitLatencyP99  string   `json:"queryAdmitLatencyP99"`
+		BatchAdmitLatencyP50  string   `json:"batchAdmitLatencyP50"`
+		BatchAdmitLatencyP95  string   `json:"batchAdmitLatencyP95"`
+		BatchAdmitLatencyP99  string   `json:"batchAdmitLatencyP99"`
+		LockHoldP50           string   `json:"lockHoldP50"`
+		LockHoldP95           string   `json:"lockHoldP95"`
+		LockHoldP99           string   `json:"lockHoldP99"`
+		LockHoldMax           string   `json:"lockHoldMax"`
+	}{
+		stats:                 stats(s),
+		StartupGraceRemaining: s.StartupGraceRemaining.String(),
+		SizeSweepAvg:          s.SizeSweepAvg.String(),
+		SizeSweepLast:         s.SizeSweepLast.String(),
+		MaxWaiterAge:          s.MaxWaiterAge.String(),
+		MaxQueryWaiterAge:     s.MaxQueryWaiterAge.String(),
+		QueryAdmitLatencyP50:  s.QueryAdmitLatencyP50.String(),
+		QueryAdmitLatencyP95:  s.QueryAdmitLatencyP95.String(),
+		QueryAdmitLatencyP99:  s.QueryAdmitLatencyP99.String(),
+		BatchAdmitLatencyP50:  s.BatchAdmitLatencyP50.String(),
+		BatchAdmitLatencyP95:  s.BatchAdmitLatencyP95.String(),
+		BatchAdmitLatencyP99:  s.BatchAdmitLatencyP99.String(),
+		LockHoldP50:           s.LockHoldP50.String(),
+		LockHoldP95:           s.LockHoldP95.String(),
+		LockHoldP99:           s.LockHoldP99.String(),
+		LockHoldMax:           s.LockHoldMax.String(),
+	}
+	for _, d := range s.WaiterAges {
+		rv.WaiterAges = append(rv.WaiterAges, d.String())
+	}
+	return json.Marshal(rv)
+}
+
+// ------------------------------------------------------------------
+
+// Describe returns a multi-line, human-readable summary of the
+// herder's configuration followed by its current stats, as StateJSON
+// but a field per line, meant to be pasted as-is into support cases.
+func (a *appHerder) Describe() string {
+	a.m.Lock()
+	indexingMem := a.indexingMemoryLOCKED()
+	config, stats := a.configLOCKED(), a.statsLOCKED(indexingMem)
+	a.m.Unlock()
+
+	var b bytes.Buffer
+	describeSection(&b, "config", config)
+	describeSection(&b, "stats", stats)
+	return b.String()
+}
+
+// describeSection writes the fields of v under name, one per line in
+// the order of its JSON encoding, with the elements of a list each on
+// their own line.
+func describeSection(b *bytes.Buffer, name string, v interface{}) {
+	fmt.Fprintf(b, "%s:\n", name)
+	j, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintf(b, "  err: %v\n", err)
+		return
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	if _, err = dec.Token(); err != nil { // The opening brace.
+		fmt.Fprintf(b, "  err: %v\n", err)
+		return
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			fmt.Fprintf(b, "  err: %v\n", err)
+			return
+		}
+		var val json.RawMessage
+		if err = dec.Decode(&val); err != nil {
+			fmt.Fprintf(b, "  err: %v\n", err)
+			return
+		}
+
+		var elems []json.RawMessage
+		if val[0] == '[' && json.Unmarshal(val, &elems) == nil &&
+			len(elems) > 0 {
+			fmt.Fprintf(b, "  %s:\n", key)
+			for _, elem := range elems {
+				fmt.Fprintf(b, "    %s\n", elem)
+			}
+			continue
+		}
+		fmt.Fprintf(b, "  %-26s %s\n", fmt.Sprint(key)+":", val)
+	}
+}
+
+// oomSnapshot is the diagnostic state handed to OnOOMImminent.
+type oomSnapshot struct {
+	Time       time.Time        `json:"time"`
+	Stats      appHerderStats   `json:"stats"`
+	Waiters    []waiterSnapshot `json:"waiters"`
+	Goroutines string           `json:"goroutines"`
+}
+
+type waiterSnapshot struct {
+	Index string        `json:"index"`
+	Age   time.Duration `json:"age"`
+}
+
+// MarshalJSON encodes the waiter's age as a string, as in the stats.
+func (w waiterSnapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Index string `json:"index"`
+		Age   string `json:"age"`
+	}{w.Index, w.Age.String()})
+}
+
+func (a *appHerder) oomSnapshot() oomSnapshot {
+	rv := oomSnapshot{
+		Time:  time.Now(),
+		Stats: a.Stats(),
+	}
+
+	a.m.Lock()
+	for _, w := range a.waiters {
+		rv.Waiters = append(rv.Waiters, waiterSnapshot{
+			Index: indexName(w.index, a.indexes[w.index]),
+			Age:   rv.Time.Sub(w.since),
+		})
+	}
+	a.m.Unlock()
+
+	buf := make([]byte, 1<<20)
+	rv.Goroutines = string(buf[:runtime.Stack(buf, true)])
+
+	return rv
+}
+
+// dumpOOMSnapshot returns an OnOOMImminent callback that writes the
+// snapshot to a timestamped file in dir, for post-mortem analysis.
+func dumpOOMSnapshot(dir string) func(oomSnapshot) {
+	return func(s oomSnapshot) {
+		path := filepath.Join(dir, fmt.Sprintf("fts-oom-imminent-%s.json",
+			s.Time.Format("20060102T150405.000")))
+		b, err := json.MarshalIndent(s, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(path, b, 0600)
+		}
+		if err != nil {
+			log.Warnf("app_herder: OOM imminent, dump: %s, err: %v", path, err)
+			return
+		}
+		log.Warnf("app_herder: OOM imminent, dumped to: %s", path)
+	}
+}
+
+// ------------------------------------------------------------------
+
+// imbalanceDetector watches the outstanding queries, started but not
+// ended, over consecutive windows, flagging a window throughout which
+// they only grew, never dropping back, as reservations leaking do,
+// whereas a busy but healthy node's queries keep ending.  It relies on
+// the herder's lock.
+type imbalanceDetector struct {
+	window time.Duration
+
+	windowStart time.Time
+	baseline    uint64 // The outstanding queries as the window started.
+	last        uint64
+	dropped     bool
+
+	// The change in outstanding queries per second over the last
+	// complete window, and whether it grew throughout.
+	trend     float64
+	suspected bool
+	warnings  uint64
+}
+
+func newImbalanceDetector(window time.Duration) *imbalanceDetector {
+	return &imbalanceDetector{window: window}
+}
+
+// observe records the outstanding queries, returning true when a
+// window completes throughout which they only grew.
+func (d *imbalanceDetector) observe(outstanding uint64, now time.Time) bool {
+	if d.windowStart.IsZero() {
+		d.windowStart, d.baseline, d.last = now, outstanding, outstanding
+		return false
+	}
+	if outstanding < d.last {
+		d.dropped = true
+	}
+	d.last = outstanding
+
+	elapsed := now.Sub(d.windowStart)
+	if elapsed < d.window {
+		return false
+	}
+	d.trend = (float64(outstanding) - float64(d.baseline)) /
+		elapsed.Seconds()
+	d.suspected = !d.dropped && outstanding > d.baseline
+	if d.suspected {
+		d.warnings++
+	}
+	d.windowStart, d.baseline, d.dropped = now, outstanding, false
+	return d.suspected
+}
+
+// ------------------------------------------------------------------
+
+// windowBuckets is the number of buckets a bucketedWindow is split
+// into, which sets how smoothly old counts drop out.
+const windowBuckets = 10
+
+// bucketedWindow keeps a row of counters over a sliding window, in a
+// ring of windowBuckets buckets of a tenth of the window each, so old
+// counts drop out a bucket at a time.  It relies on the herder's lock.
+type bucketedWindow struct {
+	bucket      time.Duration
+	counts      [windowBuckets][]uint64
+	newest      int       // Index of the current bucket in counts.
+	newestStart time.Time // When the current bucket started.
+	start       time.Time // When the first count was recorded.
+}
+
+func newBucketedWindow(window time.Duration, width int) bucketedWindow {
+	bucket := window / windowBuckets
+	if bucket <= 0 {
+		bucket = 1
+	}
+	w := bucketedWindow{bucket: bucket}
+	for i := range w.counts {
+		w.counts[i] = make([]uint64, width)
+	}
+	return w
+}
+
+// advance moves the current bucket up to now, clearing the buckets
+// that fall out of the window.
+func (w *bucketedWindow) advance(now time.Time) {
+	if w.newestStart.IsZero() {
+		w.newestStart, w.start = now, now
+		return
+	}
+	for i := 0; now.Sub(w.newestStart) >= w.bucket; i++ {
+		if i >= windowBuckets {
+			// idle for the whole window, so everything's dropped
+			for j := range w.counts {
+				w.clear(j)
+			}
+			w.newestStart = now
+			return
+		}
+		w.newest = (w.newest + 1) % windowBuckets
+		w.clear(w.newest)
+		w.newestStart = w.newestStart.Add(w.bucket)
+	}
+}
+
+func (w *bucketedWindow) clear(bucket int) {
+	for i := range w.counts[bucket] {
+		w.counts[bucket][i] = 0
+	}
+}
+
+// add adds n to counter i of the current bucket.
+func (w *bucketedWindow) add(i int, n uint64, now time.Time) {
+	w.advance(now)
+	w.counts[w.newest][i] += n
+}
+
+// totals returns each counter summed over the window.
+func (w *bucketedWindow) totals(now time.Time) []uint64 {
+	w.advance(now)
+	rv := make([]uint64, len(w.counts[0]))
+	for _, bucket := range w.counts {
+		for i, n := range bucket {
+			rv[i] += n
+		}
+	}
+	return rv
+}
+
+// span returns how long the window covers as of now: the whole window,
+// or since the first count, if that's more recent, though at least a
+// bucket, so early rates aren't inflated.
+func (w *bucketedWindow) span(now time.Time) time.Duration {
+	span := w.bucket * windowBuckets
+	if since := now.Sub(w.start); since < span {
+		span = since
+	}
+	if span < w.bucket {
+		span = w.bucket
+	}
+	return span
+}
+
+// ------------------------------------------------------------------
+
+// rejectionWindow counts query rejections by reason over a sliding
+// window.
+type rejectionWindow struct {
+	bucketedWindow
+}
+
+func newRejectionWindow(window time.Duration) *rejectionWindow {
+	return &rejectionWindow{
+		newBucketedWindow(window, int(numQueryRejectReasons))}
+}
+
+func (w *rejectionWindow) record(reason queryRejectReason, now time.Time) {
+	w.add(int(reason), 1, now)
+}
+
+// breakdown returns the rejections within the window by reason, and
+// the reason with the most of them, empty when there were none.
+func (w *rejectionWindow) breakdown(now time.Time) (map[string]uint64,
+	string) {
+	rv := map[string]uint64{}
+	var dominant string
+	var dominantCount uint64
+	for reason, n := range w.totals(now) {
+		if n == 0 {
+			continue
+		}
+		name := queryRejectReason(reason).String()
+		rv[name] = n
+		if n > dominantCount {
+			dominant, dominantCount = name, n
+		}
+	}
+	return rv, dominant
+}
+
+// ------------------------------------------------------------------
+
+// The counters of an admissionWindow.
+const (
+	admissionWindowAdmitted = iota
+	admissionWindowRejected
+	numAdmissionWindowCounts
+)
+
+// admissionWindow counts query admissions and rejections over a
+// sliding window, for their recent rates.
+type admissionWindow struct {
+	bucketedWindow
+
+	// The fast path admissions already recorded, as they're only
+	// counted atomically.
+	fastSeen uint64
+}
+
+func newAdmissionWindow(window time.Duration) *admissionWindow {
+	return &admissionWindow{
+		bucketedWindow: newBucketedWindow(window, numAdmissionWindowCounts),
+	}
+}
+
+func (w *admissionWindow) record(admitted, rejected uint64, now time.Time) {
+	w.add(admissionWindowAdmitted, admitted, now)
+	w.add(admissionWindowRejected, rejected, now)
+}
+
+// rates returns the admissions and rejections per second within the
+// window's span.
+func (w *admissionWindow) rates(now time.Time) (admitted, rejected float64) {
+	totals := w.totals(now)
+	span := w.span(now).Seconds()
+	return float64(totals[admissionWindowAdmitted]) / span,
+		float64(totals[admissionWindowRejected]) / span
+}
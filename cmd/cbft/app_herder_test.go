@@ -0,0 +1,2086 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/index/scorch"
+	"github.com/couchbase/moss"
+)
+
+// testIndex is a fake engine index whose size the test controls.
+type testIndex struct {
+	m    sync.Mutex
+	size uint64
+}
+
+func (ti *testIndex) sizeFunc(c interface{}) (uint64, error) {
+	ti.m.Lock()
+	defer ti.m.Unlock()
+	return ti.size, nil
+}
+
+func (ti *testIndex) grow(n uint64) {
+	ti.m.Lock()
+	ti.size += n
+	ti.m.Unlock()
+}
+
+// persist drops the index's size by up to n bytes.
+func (ti *testIndex) persist(n uint64) {
+	ti.m.Lock()
+	if n > ti.size {
+		n = ti.size
+	}
+	ti.size -= n
+	ti.m.Unlock()
+}
+
+// FuzzAppHerderInvariants hammers the herder with random concurrent
+// query, indexing and close operations, checking that the accounting
+// never violates its invariants and drains back to zero.  The
+// invariant checks rule out the query fast path, so with fast set it's
+// enabled instead, and only the drained totals are checked.
+func FuzzAppHerderInvariants(f *testing.F) {
+	for seed := int64(1); seed <= 5; seed++ {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+	f.Fuzz(testAppHerderInvariantsFuzz)
+}
+
+func testAppHerderInvariantsFuzz(t *testing.T, seed int64, fast bool) {
+	a := newAppHerder(1000, 1.0, 0.6, 0.6)
+	if fast {
+		a.SetQueryFastPath(true)
+	} else {
+		a.checkInvariants = true
+		a.strictAccounting = true
+	}
+	a.SetHighlightRatio(0.25)
+	a.highPriorityRatio = 0.1
+
+	indexes := make([]*testIndex, 4)
+	for i := range indexes {
+		indexes[i] = &testIndex{}
+	}
+
+	// the persister keeps draining the indexes until the workers are
+	// done, so blocked batches always make progress
+	done := make(chan struct{})
+	var persisterWG sync.WaitGroup
+	persisterWG.Add(1)
+	go func() {
+		defer persisterWG.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Microsecond):
+			}
+			for _, ti := range indexes {
+				ti.persist(50)
+				a.onPersisterProgress(ti)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(r *rand.Rand) {
+			defer wg.Done()
+
+			var sizes []uint64
+			var reservations []*queryReservation
+			elsewhere := 0
+
+			for i := 0; i < 500; i++ {
+				ti := indexes[r.Intn(len(indexes))]
+				switch r.Intn(8) {
+				case 0:
+					size := uint64(r.Intn(100))
+					if a.StartQuery(size) == nil {
+						sizes = append(sizes, size)
+					}
+				case 1:
+					if len(sizes) > 0 {
+						a.EndQuery(sizes[len(sizes)-1])
+						sizes = sizes[:len(sizes)-1]
+					}
+				case 2:
+					qr, err := a.StartQueryWithOptions(uint64(r.Intn(100)),
+						queryOptions{
+							HighlightSize:     uint64(r.Intn(100)),
+							OnHighlightDenied: func() {},
+							MaxWait: time.Duration(r.Intn(2)) *
+								time.Millisecond,
+						})
+					if err == nil {
+						reservations = append(reservations, qr)
+					}
+				case 3:
+					if len(reservations) > 0 {
+						reservations[len(reservations)-1].End()
+						reservations = reservations[:len(reservations)-1]
+					}
+				case 4:
+					a.onBatchExecuteStart(ti, ti.sizeFunc, statsErrFailOpen,
+						batchPriority(r.Intn(2)))
+					ti.grow(uint64(r.Intn(200)))
+				case 5:
+					a.onClose(ti)
+				case 6:
+					a.StartQueryAccountedElsewhere()
+					elsewhere++
+				case 7:
+					// plain enough for the fast path, when it's enabled
+					qr, err := a.StartQueryWithOptions(uint64(r.Intn(50)),
+						queryOptions{})
+					if err == nil {
+						reservations = append(reservations, qr)
+					}
+				}
+			}
+
+			for _, size := range sizes {
+				a.EndQuery(size)
+			}
+			for _, qr := range reservations {
+				qr.End()
+			}
+			for ; elsewhere > 0; elsewhere-- {
+				a.EndQueryAccountedElsewhere()
+			}
+		}(rand.New(rand.NewSource(seed*100 + int64(w))))
+	}
+
+	wg.Wait()
+	close(done)
+	persisterWG.Wait()
+
+	s := a.Stats()
+	if s.RunningQueryUsed != 0 || s.RunningHighlightUsed != 0 ||
+		s.RunningQueries != 0 || s.RunningQueriesElsewhere != 0 ||
+		s.Waiting != 0 || s.QueryWaiting != 0 {
+		t.Errorf("seed: %d, fast: %t, expected stats to drain, got: %+v",
+			seed, fast, s)
+	}
+	if s.TotQueryEnded != s.TotQueryAdmitted ||
+		s.TotQueryEndedBytes != s.TotQueryAdmittedBytes {
+		t.Errorf("seed: %d, fast: %t, expected every admitted query to"+
+			" end, admitted: %d (%d bytes), ended: %d (%d bytes)", seed,
+			fast, s.TotQueryAdmitted, s.TotQueryAdmittedBytes,
+			s.TotQueryEnded, s.TotQueryEndedBytes)
+	}
+	if fast && atomic.LoadUint64(&a.fastAdmitted) == 0 {
+		t.Errorf("seed: %d, expected some fast path admissions", seed)
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.invariantViolations != 0 {
+		t.Errorf("seed: %d, expected no invariant violations, got: %d",
+			seed, a.invariantViolations)
+	}
+	if a.runningQueryUsed != 0 || a.runningHighlightUsed != 0 ||
+		a.runningQueries != 0 || a.runningQueriesElsewhere != 0 {
+		t.Errorf("seed: %d, expected query accounting to drain, got"+
+			" runningQueryUsed: %d, runningHighlightUsed: %d,"+
+			" runningQueries: %d, runningQueriesElsewhere: %d", seed,
+			a.runningQueryUsed, a.runningHighlightUsed,
+			a.runningQueries, a.runningQueriesElsewhere)
+	}
+	if len(a.reservations) != 0 {
+		t.Errorf("seed: %d, expected no active reservations, got: %d",
+			seed, len(a.reservations))
+	}
+	if a.waiting != 0 || len(a.waiters) != 0 || len(a.queryWaiters) != 0 {
+		t.Errorf("seed: %d, expected no waiters, got waiting: %d,"+
+			" waiters: %d, queryWaiters: %d", seed, a.waiting,
+			len(a.waiters), len(a.queryWaiters))
+	}
+}
+
+func TestAppHerderReserveMiscDeadline(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.5, 0.5)
+	if err := a.StartQuery(400); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+
+	if _, err := a.ReserveMisc(ctx, 700); err == nil {
+		t.Fatalf("expected misc reservation to time out")
+	}
+
+	// the reservation fits once the query ends
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.EndQuery(400)
+	}()
+
+	r, err := a.ReserveMisc(context.Background(), 700)
+	if err != nil {
+		t.Fatalf("expected misc reservation, err: %v", err)
+	}
+	if s := a.Stats(); s.MiscReserved != 700 {
+		t.Errorf("expected misc reserved: 700, got: %d", s.MiscReserved)
+	}
+	if err = r.Release(); err != nil {
+		t.Errorf("expected release, err: %v", err)
+	}
+	if s := a.Stats(); s.MiscReserved != 0 {
+		t.Errorf("expected misc reserved: 0, got: %d", s.MiscReserved)
+	}
+}
+
+// TestAppHerderConcurrentQuotaUpdates races quota and ratio updates,
+// checking that the derived quotas always match the stored memQuota
+// and ratios rather than mixing values from different updates.
+func TestAppHerderConcurrentQuotaUpdates(t *testing.T) {
+	a := newAppHerder(1000, 0.8, 0.5, 0.5)
+
+	consistent := func() bool {
+		a.m.Lock()
+		defer a.m.Unlock()
+		appQuota := uint64(float64(a.memQuota) * a.appRatio)
+		return a.appQuota == appQuota &&
+			a.indexQuota == uint64(float64(appQuota)*a.indexRatio) &&
+			a.queryQuota == uint64(float64(appQuota)*a.queryRatio)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(r *rand.Rand) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if r.Intn(2) == 0 {
+					a.UpdateMemQuota(uint64(1000 + r.Intn(100000)))
+				} else {
+					ratio := 0.5 + float64(r.Intn(50))/100
+					a.UpdateRatios(ratio, 0.5, 0.5)
+				}
+				if !consistent() {
+					t.Errorf("expected consistent quotas during updates")
+					return
+				}
+			}
+		}(rand.New(rand.NewSource(int64(w))))
+	}
+	wg.Wait()
+
+	if !consistent() {
+		t.Errorf("expected consistent quotas at rest")
+	}
+}
+
+func TestAppHerderQueryFastPath(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.SetQueryFastPath(true)
+
+	if s := a.Stats(); s.FastPathBudget != 500 || s.FastPathBlockedBy != "" {
+		t.Fatalf("expected fast path budget: 500, got: %d, blocked by: %q",
+			s.FastPathBudget, s.FastPathBlockedBy)
+	}
+
+	r, err := a.StartQueryWithOptions(400, queryOptions{})
+	if err != nil || !r.fast {
+		t.Fatalf("expected fast path admission, got: %v", err)
+	}
+	if s := a.Stats(); s.RunningQueryUsed != 400 || s.RunningQueries != 1 {
+		t.Errorf("expected fast path query in stats, got: %+v", s)
+	}
+	// it's counted, but not listed, by ActiveReservations
+	if rs, fast := a.ActiveReservations(); len(rs) != 0 || fast != 1 {
+		t.Errorf("expected one unlisted fast path query, got: %+v, %d",
+			rs, fast)
+	}
+
+	// a locked admission may use the fast path's unused budget
+	r2, err := a.StartQueryWithOptions(600, queryOptions{ID: "q"})
+	if err != nil || r2.fast {
+		t.Fatalf("expected locked admission, got: %v", err)
+	}
+	if budget := a.Stats().FastPathBudget; budget != 0 {
+		t.Errorf("expected fast path disabled over half quota, got: %d", budget)
+	}
+	if _, err = a.StartQueryWithOptions(1, queryOptions{}); err == nil {
+		t.Errorf("expected query over quota to be rejected")
+	}
+
+	r.End()
+	if err = r.End(); err == nil {
+		t.Errorf("expected error releasing twice")
+	}
+	r2.End()
+	if s := a.Stats(); s.RunningQueryUsed != 0 || s.FastPathBudget != 500 {
+		t.Errorf("expected drained usage and restored budget, got: %+v", s)
+	}
+}
+
+func TestAppHerderQueryFastPathRuledOut(t *testing.T) {
+	for name, configure := range map[string]func(a *appHerder){
+		"indexQueryQuotas": func(a *appHerder) {
+			a.SetIndexQueryQuota("idx", 100)
+		},
+		"zeroSizePolicy":   func(a *appHerder) { a.zeroSizePolicy = zeroSizeWarn },
+		"queryPreemption":  func(a *appHerder) { a.queryPreemption = true },
+		"strictAccounting": func(a *appHerder) { a.strictAccounting = true },
+		"unenforced":       func(a *appHerder) { a.unenforced = true },
+		"startupGrace": func(a *appHerder) {
+			a.SetStartupGrace(time.Minute)
+		},
+		"queryQuantum": func(a *appHerder) { a.queryQuantum = 64 },
+	} {
+		a := newAppHerder(1000, 1, 1, 1)
+		configure(a)
+		a.SetQueryFastPath(true)
+		if s := a.Stats(); s.FastPathBudget != 0 ||
+			s.FastPathBlockedBy != name {
+			t.Errorf("%s: expected the fast path ruled out, got budget: %d,"+
+				" blocked by: %q", name, s.FastPathBudget, s.FastPathBlockedBy)
+		}
+		r, err := a.StartQueryWithOptions(100, queryOptions{})
+		if err != nil || r.fast {
+			t.Errorf("%s: expected locked admission, got: %v", name, err)
+		}
+	}
+
+	// turned off again with its budget returned
+	a := newAppHerder(1000, 1, 1, 1)
+	a.SetQueryFastPath(true)
+	a.SetQueryFastPath(false)
+	if budget := a.Stats().FastPathBudget; budget != 0 {
+		t.Errorf("expected the fast path disabled, got budget: %d", budget)
+	}
+}
+
+func BenchmarkAppHerderStartQuery(b *testing.B) {
+	for _, fast := range []bool{false, true} {
+		name := "locked"
+		if fast {
+			name = "fast"
+		}
+		b.Run(name, func(b *testing.B) {
+			a := newAppHerder(1<<40, 1, 1, 1)
+			a.SetQueryFastPath(fast)
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					r, err := a.StartQueryWithOptions(1024, queryOptions{})
+					if err != nil {
+						b.Fatal(err)
+					}
+					r.End()
+				}
+			})
+		})
+	}
+}
+
+func TestAppHerderMemQuotaShrinkRamp(t *testing.T) {
+	a := newAppHerder(10000, 1, 1, 1)
+	a.memQuotaMaxShrinkRate = 1000
+
+	a.UpdateMemQuota(7000)
+	s := a.Stats()
+	if s.MemQuota != 10000 || s.MemQuotaTarget != 7000 {
+		t.Fatalf("expected shrink to be ramped, got: %d, target: %d",
+			s.MemQuota, s.MemQuotaTarget)
+	}
+
+	start := a.memQuotaRampAt
+	a.Tick(start.Add(time.Second))
+	if s = a.Stats(); s.MemQuota != 9000 || s.AppQuota != 9000 {
+		t.Errorf("expected memQuota: 9000 after a second, got: %d,"+
+			" appQuota: %d", s.MemQuota, s.AppQuota)
+	}
+	// the steps in between are quiet
+	a.Tick(start.Add(2 * time.Second))
+	if s = a.Stats(); s.MemQuota != 8000 ||
+		a.memQuotaRampLoggedAt != start.Add(time.Second) {
+		t.Errorf("expected an unlogged step to 8000, got: %d, logged at: %s",
+			s.MemQuota, a.memQuotaRampLoggedAt.Sub(start))
+	}
+	a.Tick(start.Add(10 * time.Second))
+	if s = a.Stats(); s.MemQuota != 7000 ||
+		a.memQuotaRampLoggedAt != start.Add(10*time.Second) {
+		t.Errorf("expected ramp to stop at target, logged, got: %d",
+			s.MemQuota)
+	}
+
+	// growth isn't ramped
+	a.UpdateMemQuota(20000)
+	if s = a.Stats(); s.MemQuota != 20000 || s.MemQuotaTarget != 20000 {
+		t.Errorf("expected immediate growth, got: %d", s.MemQuota)
+	}
+}
+
+func TestAppHerderCompressedWeight(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.compressedWeight = 0.5
+	idx := &testIndex{size: 1200}
+	a.RegisterIndex(idx, indexOptions{
+		SizeBreakdown: func(c interface{}) (uint64, uint64, error) {
+			return 800, 400, nil
+		},
+	})
+
+	// half of the 800 compressed bytes count, fitting the quota
+	a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+	s := a.Stats()
+	if s.IndexingMemory != 800 {
+		t.Errorf("expected weighted indexing memory: 800, got: %d",
+			s.IndexingMemory)
+	}
+	is := s.PerIndex[0]
+	if is.CompressedBytes != 800 || is.UncompressedBytes != 400 {
+		t.Errorf("expected split of 800 compressed, 400 uncompressed,"+
+			" got: %d, %d", is.CompressedBytes, is.UncompressedBytes)
+	}
+}
+
+func TestAppHerderSizeJumps(t *testing.T) {
+	a := newAppHerder(10000, 1, 1, 1)
+	a.sizeJumpFactor = 2
+	idx := &testIndex{size: 100}
+	a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+
+	idx.grow(300) // 100 to 400, a jump
+	if s := a.Stats(); s.PerIndex[0].SizeJumps != 1 {
+		t.Errorf("expected a jump growing 4x, got: %d",
+			s.PerIndex[0].SizeJumps)
+	}
+	idx.grow(50) // 400 to 450, plausible
+	if s := a.Stats(); s.PerIndex[0].SizeJumps != 1 {
+		t.Errorf("expected no jump growing 1.125x, got: %d",
+			s.PerIndex[0].SizeJumps)
+	}
+	idx.persist(400) // 450 to 50, a jump
+	if s := a.Stats(); s.PerIndex[0].SizeJumps != 2 {
+		t.Errorf("expected a jump shrinking 9x, got: %d",
+			s.PerIndex[0].SizeJumps)
+	}
+
+	// nothing is flagged unless enabled
+	a = newAppHerder(10000, 1, 1, 1)
+	idx = &testIndex{size: 100}
+	a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+	idx.grow(900)
+	if s := a.Stats(); s.PerIndex[0].SizeJumps != 0 {
+		t.Errorf("expected no jumps when disabled, got: %d",
+			s.PerIndex[0].SizeJumps)
+	}
+}
+
+func TestAppHerderIndexAlarm(t *testing.T) {
+	a := newAppHerder(10000, 1, 1, 1)
+	alarms := make(chan uint64, 4)
+	a.onIndexAlarm = func(c interface{}, size, threshold uint64) {
+		alarms <- size
+	}
+	idx := &testIndex{size: 300}
+	a.RegisterIndex(idx, indexOptions{AlarmBytes: 500})
+	a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+
+	idx.grow(300)
+	if s := a.Stats(); !s.PerIndex[0].Alarmed || s.TotIndexAlarms != 1 {
+		t.Errorf("expected alarm at 600, got: %t, %d",
+			s.PerIndex[0].Alarmed, s.TotIndexAlarms)
+	}
+	select {
+	case size := <-alarms:
+		if size != 600 {
+			t.Errorf("expected alarm for size 600, got: %d", size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected onIndexAlarm")
+	}
+
+	// hovering just under the threshold doesn't re-arm it
+	idx.persist(120)
+	a.Stats()
+	idx.grow(120)
+	if s := a.Stats(); s.TotIndexAlarms != 1 {
+		t.Errorf("expected no flapping, got alarms: %d", s.TotIndexAlarms)
+	}
+
+	idx.persist(200)
+	if s := a.Stats(); s.PerIndex[0].Alarmed {
+		t.Errorf("expected alarm re-armed at 400")
+	}
+	idx.grow(200)
+	if s := a.Stats(); s.TotIndexAlarms != 2 {
+		t.Errorf("expected a second alarm, got: %d", s.TotIndexAlarms)
+	}
+}
+
+func TestAppHerderStartQueryWithContext(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := a.StartQueryWithContext(ctx, 300, queryOptions{ID: "q"})
+	if err != nil {
+		t.Fatalf("expected admission, got err: %v", err)
+	}
+	cancel()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().RunningQueryUsed != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected reservation released on cancel")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s := a.Stats(); s.TotQueryContextReleased != 1 {
+		t.Errorf("expected 1 context release, got: %d",
+			s.TotQueryContextReleased)
+	}
+	if err = r.End(); err == nil {
+		t.Errorf("expected err ending an auto-released reservation")
+	}
+
+	// ending first stops the watch, leaving nothing to release
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	r, err = a.StartQueryWithContext(ctx, 300, queryOptions{})
+	if err != nil {
+		t.Fatalf("expected admission, got err: %v", err)
+	}
+	if err = r.End(); err != nil {
+		t.Errorf("expected end, got err: %v", err)
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if s := a.Stats(); s.TotQueryContextReleased != 1 ||
+		s.RunningQueryUsed != 0 {
+		t.Errorf("expected no further release, got: %d, used: %d",
+			s.TotQueryContextReleased, s.RunningQueryUsed)
+	}
+
+	if _, err = a.StartQueryWithContext(ctx, 300, queryOptions{}); err == nil {
+		t.Errorf("expected err with a done context")
+	}
+}
+
+func TestAppHerderQueryCancelGrace(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.queryCancelGrace = time.Hour
+
+	// a query cleaning up within the grace ends its own reservation
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := a.StartQueryWithContext(ctx, 300, queryOptions{})
+	if err != nil {
+		t.Fatalf("expected admission, got err: %v", err)
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if s := a.Stats(); s.RunningQueryUsed != 300 {
+		t.Errorf("expected reservation held during the grace, got: %d",
+			s.RunningQueryUsed)
+	}
+	if err = r.End(); err != nil {
+		t.Errorf("expected end within the grace, got err: %v", err)
+	}
+
+	// otherwise it's released once the grace is up
+	a.queryCancelGrace = 10 * time.Millisecond
+	ctx, cancel = context.WithCancel(context.Background())
+	if _, err = a.StartQueryWithContext(ctx, 300,
+		queryOptions{}); err != nil {
+		t.Fatalf("expected admission, got err: %v", err)
+	}
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().TotQueryContextReleased != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected release after the grace")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s := a.Stats(); s.RunningQueryUsed != 0 {
+		t.Errorf("expected reservation released, got: %d",
+			s.RunningQueryUsed)
+	}
+}
+
+func TestAppHerderQueryPreemption(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.queryPreemption = true
+
+	cancelled := make(chan string, 3)
+	start := func(id string, size uint64, prio queryPriority,
+		protected bool) (*queryReservation, error) {
+		return a.StartQueryWithOptions(size, queryOptions{ID: id,
+			Priority: prio, Protected: protected,
+			Cancel: func() { cancelled <- id }})
+	}
+	if _, err := start("small", 200, queryPriorityBackground,
+		false); err != nil {
+		t.Fatalf("expected admission, err: %v", err)
+	}
+	if _, err := start("large", 400, queryPriorityBackground,
+		false); err != nil {
+		t.Fatalf("expected admission, err: %v", err)
+	}
+	if _, err := start("pinned", 300, queryPriorityBackground,
+		true); err != nil {
+		t.Fatalf("expected admission, err: %v", err)
+	}
+
+	// background queries can't preempt their peers
+	if _, err := start("peer", 300, queryPriorityBackground,
+		false); err == nil {
+		t.Fatalf("expected peer to be rejected")
+	}
+
+	// the largest unprotected background query is enough to make room
+	if _, err := start("critical", 400, queryPriorityCritical,
+		false); err != nil {
+		t.Fatalf("expected critical query to preempt, err: %v", err)
+	}
+	select {
+	case id := <-cancelled:
+		if id != "large" {
+			t.Errorf("expected large to be preempted, got: %q", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a cancel func to be called")
+	}
+	if s := a.Stats(); s.TotPreempted != 1 || s.RunningQueryUsed != 900 {
+		t.Errorf("expected 1 preempted, used: 900, got: %d, %d",
+			s.TotPreempted, s.RunningQueryUsed)
+	}
+
+	// preempting can't touch the protected query, so it isn't enough
+	if _, err := start("critical2", 500, queryPriorityCritical,
+		false); err == nil {
+		t.Errorf("expected critical query to be rejected")
+	}
+	if s := a.Stats(); s.TotPreempted != 1 {
+		t.Errorf("expected nothing further preempted, got: %d",
+			s.TotPreempted)
+	}
+}
+
+func TestAppHerderAudit(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	var buf bytes.Buffer
+	a.audit = newAuditLog(&buf)
+
+	if _, err := a.StartQueryWithOptions(600,
+		queryOptions{ID: "q1"}); err != nil {
+		t.Fatalf("expected admission, got err: %v", err)
+	}
+	if _, err := a.StartQueryWithOptions(600,
+		queryOptions{ID: "q2"}); err == nil {
+		t.Fatalf("expected rejection")
+	}
+	if err := a.CloseAuditLog(); err != nil {
+		t.Fatalf("expected the audit log closed, err: %v", err)
+	}
+
+	dec := json.NewDecoder(&buf)
+	var recs []auditRecord
+	for dec.More() {
+		var rec auditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("expected JSON records, got err: %v", err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 records, got: %d", len(recs))
+	}
+	if !recs[0].Admitted || recs[0].ID != "q1" || recs[0].QueryUsed != 600 {
+		t.Errorf("expected q1 admitted using 600, got: %+v", recs[0])
+	}
+	if recs[1].Admitted || recs[1].ID != "q2" ||
+		recs[1].RejectReason != rejectQueryQuota.String() {
+		t.Errorf("expected q2 rejected by the query quota, got: %+v",
+			recs[1])
+	}
+}
+
+func TestAppHerderAuditLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("expected the audit log opened, err: %v", err)
+	}
+	a := newAppHerder(1000, 1, 1, 1)
+	a.audit = l
+	if err = a.StartQuery(100); err != nil {
+		t.Fatalf("expected admission, got err: %v", err)
+	}
+	if err = a.CloseAuditLog(); err != nil {
+		t.Fatalf("expected the audit log synced and closed, err: %v", err)
+	}
+	if _, err = l.file.Write([]byte("x")); err == nil {
+		t.Errorf("expected the audit log's file closed")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected the audit log readable, err: %v", err)
+	}
+	var rec auditRecord
+	if err = json.Unmarshal(b, &rec); err != nil || !rec.Admitted ||
+		rec.Size != 100 {
+		t.Errorf("expected the admission written, got: %s, err: %v", b, err)
+	}
+
+	// auditing is off once closed
+	if err = a.CloseAuditLog(); err != nil {
+		t.Errorf("expected closing again to be a no-op, err: %v", err)
+	}
+	if s := a.Stats(); s.FastPathBlockedBy == "audit" {
+		t.Errorf("expected auditing no longer to need locked admissions")
+	}
+}
+
+func TestAppHerderQueryQuotaWarmup(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.queryQuotaWarmup = 10 * time.Second
+
+	a.UpdateMemQuota(11000)
+	s := a.Stats()
+	if s.QueryQuota != 11000 || s.WarmQueryQuota != 1000 {
+		t.Fatalf("expected warmup from 1000 to 11000, got: %d, warm: %d",
+			s.QueryQuota, s.WarmQueryQuota)
+	}
+	if err := a.StartQuery(2000); err == nil {
+		t.Errorf("expected query over the warm quota to be rejected")
+	}
+
+	start := a.queryWarmupStart
+	a.Tick(start.Add(5 * time.Second))
+	if s = a.Stats(); s.WarmQueryQuota != 6000 {
+		t.Errorf("expected warm quota: 6000 halfway, got: %d",
+			s.WarmQueryQuota)
+	}
+	if err := a.StartQuery(2000); err != nil {
+		t.Errorf("expected query within the warm quota, got err: %v", err)
+	}
+	a.EndQuery(2000)
+
+	a.Tick(start.Add(time.Minute))
+	if s = a.Stats(); s.WarmQueryQuota != 11000 {
+		t.Errorf("expected warmup to finish, got: %d", s.WarmQueryQuota)
+	}
+
+	// shrinking isn't warmed up
+	a.UpdateMemQuota(500)
+	if s = a.Stats(); s.WarmQueryQuota != 500 {
+		t.Errorf("expected immediate shrink, got: %d", s.WarmQueryQuota)
+	}
+}
+
+func TestAppHerderMemQuotaSources(t *testing.T) {
+	a := newAppHerder(10000, 1, 1, 1)
+
+	a.UpdateMemQuotaSource("cgroup", 6000)
+	s := a.Stats()
+	if s.MemQuota != 6000 || s.AppQuota != 6000 ||
+		s.MemQuotaBinding != "cgroup" {
+		t.Errorf("expected cgroup to bind at 6000, got: %d, appQuota: %d,"+
+			" binding: %q", s.MemQuota, s.AppQuota, s.MemQuotaBinding)
+	}
+
+	// a looser default source doesn't lift the cgroup limit
+	a.UpdateMemQuota(20000)
+	if s = a.Stats(); s.MemQuota != 6000 {
+		t.Errorf("expected cgroup to still bind, got: %d", s.MemQuota)
+	}
+	a.UpdateMemQuota(5000)
+	if s = a.Stats(); s.MemQuota != 5000 ||
+		s.MemQuotaBinding != defaultMemQuotaSource {
+		t.Errorf("expected default source to bind at 5000, got: %d,"+
+			" binding: %q", s.MemQuota, s.MemQuotaBinding)
+	}
+
+	if err := a.RemoveMemQuotaSource(defaultMemQuotaSource); err != nil {
+		t.Fatalf("expected removal, got err: %v", err)
+	}
+	if s = a.Stats(); s.MemQuota != 6000 || len(s.MemQuotaSources) != 1 {
+		t.Errorf("expected cgroup alone at 6000, got: %d, sources: %v",
+			s.MemQuota, s.MemQuotaSources)
+	}
+	if err := a.RemoveMemQuotaSource("cgroup"); err == nil {
+		t.Errorf("expected err removing the only source")
+	}
+}
+
+func TestAppHerderMemQuotaCoalesce(t *testing.T) {
+	a := newAppHerder(10000, 1, 1, 1)
+	a.memQuotaCoalesce = 20 * time.Millisecond
+
+	for _, q := range []uint64{9000, 3000, 7000} {
+		a.UpdateMemQuota(q)
+	}
+	s := a.Stats()
+	if s.MemQuota != 10000 || s.MemQuotaUpdatesCoalesced != 2 {
+		t.Errorf("expected updates pending with 2 coalesced, got: %d, %d",
+			s.MemQuota, s.MemQuotaUpdatesCoalesced)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().MemQuota == 10000 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected coalesced update to be applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s = a.Stats(); s.MemQuota != 7000 || s.AppQuota != 7000 {
+		t.Errorf("expected the latest update applied, got: %d, appQuota: %d",
+			s.MemQuota, s.AppQuota)
+	}
+}
+
+func TestAppHerderPauseIndexing(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	idx := &testIndex{}
+
+	a.PauseIndexing(false)
+	admitted := startBatch(a, idx)
+	waitForWaiting(t, a, 1)
+	if err := a.StartQuery(100); err != nil {
+		t.Errorf("expected queries to continue, got: %v", err)
+	}
+	a.EndQuery(100)
+
+	a.PauseIndexing(true)
+	if err := a.StartQuery(100); err == nil {
+		t.Errorf("expected queries to be held")
+	}
+	if s := a.Stats(); !s.IndexingPaused || !s.QueriesHeld {
+		t.Errorf("expected paused stats, got: %+v", s)
+	}
+
+	a.ResumeIndexing()
+	select {
+	case <-admitted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected batch to be admitted on resume")
+	}
+	if err := a.StartQuery(100); err != nil {
+		t.Errorf("expected queries after resume, got: %v", err)
+	}
+}
+
+func TestAppHerderStatsEncodeDecode(t *testing.T) {
+	a := newAppHerder(1000, 0.8, 0.5, 0.5)
+	a.PauseIndexing(true)
+	if _, err := a.StartQueryWithOptions(100, queryOptions{}); err == nil {
+		t.Fatalf("expected held query to be rejected")
+	}
+	s := a.Stats()
+
+	var buf bytes.Buffer
+	if err := s.Encode(&buf); err != nil {
+		t.Fatalf("expected encode to succeed, got: %v", err)
+	}
+	encoded := append([]byte(nil), buf.Bytes()...)
+
+	var d appHerderStats
+	if err := d.Decode(&buf); err != nil {
+		t.Fatalf("expected decode to succeed, got: %v", err)
+	}
+	if !d.Time.Equal(s.Time) || d.AppQuota != s.AppQuota ||
+		d.TotQueryRejected != 1 || !d.QueriesHeld || !d.Enforcing {
+		t.Errorf("expected decoded stats to match, got: %+v", d)
+	}
+
+	// all encoded fields survive the round trip
+	var again bytes.Buffer
+	if err := d.Encode(&again); err != nil ||
+		!bytes.Equal(again.Bytes(), encoded) {
+		t.Errorf("expected re-encoding to match, err: %v", err)
+	}
+
+	encoded[0]++
+	if err := d.Decode(bytes.NewReader(encoded)); err == nil {
+		t.Errorf("expected unknown version to fail")
+	}
+}
+
+func TestAppHerderIndexTrendProjection(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.indexTrendWindow = time.Second
+	a.indexTrendSensitivity = 0.5
+
+	start := time.Now()
+	a.m.Lock()
+	a.noteIndexTrendLOCKED(start, 100)
+	a.noteIndexTrendLOCKED(start.Add(500*time.Millisecond), 300)
+	rate := a.indexTrendRateLOCKED()
+	projected := a.projectedIndexingMemoryLOCKED(300)
+
+	// samples older than the window are dropped
+	a.noteIndexTrendLOCKED(start.Add(2*time.Second), 200)
+	falling := a.indexTrendRateLOCKED()
+	a.m.Unlock()
+
+	if rate != 400 || projected != 500 {
+		t.Errorf("expected rate: 400, projected: 500, got: %v, %d",
+			rate, projected)
+	}
+	if falling != 0 {
+		t.Errorf("expected no trend without rising history, got: %v", falling)
+	}
+}
+
+func TestAppHerderRejectionBreakdown(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	a.rejections = newRejectionWindow(time.Minute)
+	a.maxConcurrentQueries = 1
+
+	if err := a.StartQuery(600); err == nil {
+		t.Fatalf("expected query over query quota to be rejected")
+	}
+	if err := a.StartQuery(100); err != nil {
+		t.Fatalf("expected query to be admitted, got: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := a.StartQuery(100); err == nil {
+			t.Fatalf("expected query over concurrency cap to be rejected")
+		}
+	}
+
+	s := a.Stats()
+	if s.RecentRejections["queryQuota"] != 1 ||
+		s.RecentRejections["concurrency"] != 2 ||
+		s.DominantRejectionReason != "concurrency" {
+		t.Errorf("expected rejection breakdown, got: %v, dominant: %q",
+			s.RecentRejections, s.DominantRejectionReason)
+	}
+
+	a.m.Lock()
+	recent, dominant := a.rejections.breakdown(time.Now().Add(time.Hour))
+	a.m.Unlock()
+	if len(recent) != 0 || dominant != "" {
+		t.Errorf("expected rejections to age out, got: %v", recent)
+	}
+}
+
+func TestAppHerderAdmissionRates(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	a.admissions = newAdmissionWindow(10 * time.Second)
+
+	for i := 0; i < 3; i++ {
+		if err := a.StartQuery(100); err != nil {
+			t.Fatalf("expected query to be admitted, got: %v", err)
+		}
+	}
+	if err := a.StartQuery(600); err == nil {
+		t.Fatalf("expected query over query quota to be rejected")
+	}
+
+	// under a second in, the rates are over the first 1s bucket
+	if s := a.Stats(); s.QueryAdmitRate != 3 || s.QueryRejectRate != 1 {
+		t.Errorf("expected 3 admitted and 1 rejected per second, got: %v, %v",
+			s.QueryAdmitRate, s.QueryRejectRate)
+	}
+
+	a.m.Lock()
+	admitted, rejected := a.admissions.rates(time.Now().Add(time.Minute))
+	a.m.Unlock()
+	if admitted != 0 || rejected != 0 {
+		t.Errorf("expected rates to age out, got: %v, %v", admitted, rejected)
+	}
+}
+
+// testExternal is a fake external flow control system.
+type testExternal struct {
+	m        sync.Mutex
+	reports  int
+	throttle bool
+}
+
+func (e *testExternal) Report(state appHerderStats) {
+	e.m.Lock()
+	e.reports++
+	e.m.Unlock()
+}
+
+func (e *testExternal) ShouldThrottle() bool {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.throttle
+}
+
+func TestAppHerderExternalBackpressure(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.rejections = newRejectionWindow(time.Minute)
+	e := &testExternal{}
+	a.SetExternalBackpressure(e)
+
+	a.Tick(time.Now())
+	if e.reports != 1 {
+		t.Errorf("expected a report per tick, got: %d", e.reports)
+	}
+
+	e.m.Lock()
+	e.throttle = true
+	e.m.Unlock()
+	if err := a.StartQuery(100); err == nil {
+		t.Fatalf("expected query to be throttled despite local room")
+	}
+	if _, err := a.StartQueryBestEffort(100); err == nil {
+		t.Errorf("expected best effort query to be throttled")
+	}
+	if s := a.Stats(); s.RecentRejections["external"] != 2 {
+		t.Errorf("expected 2 external rejections, got: %v",
+			s.RecentRejections)
+	}
+
+	e.m.Lock()
+	e.throttle = false
+	e.m.Unlock()
+	if err := a.StartQuery(100); err != nil {
+		t.Errorf("expected query to be admitted, got: %v", err)
+	}
+}
+
+func TestAppHerderIndexQueryQuota(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.strictAccounting = true
+	a.SetIndexQueryQuota("analytics", 300)
+
+	heavy, err := a.StartQueryWithOptions(200,
+		queryOptions{Index: "analytics"})
+	if err != nil {
+		t.Fatalf("expected query within its index quota, got: %v", err)
+	}
+	if _, err = a.StartQueryWithOptions(200,
+		queryOptions{Index: "analytics"}); err == nil {
+		t.Fatalf("expected query over its index quota to be rejected")
+	}
+
+	// the global pool still has room for other indexes
+	light, err := a.StartQueryWithOptions(400,
+		queryOptions{Index: "interactive"})
+	if err != nil {
+		t.Fatalf("expected query on another index, got: %v", err)
+	}
+	s := a.Stats()
+	if s.IndexQueryUsed["analytics"] != 200 ||
+		s.IndexQueryUsed["interactive"] != 400 {
+		t.Errorf("expected per-index query usage, got: %v", s.IndexQueryUsed)
+	}
+
+	heavy.End()
+	light.End()
+	if s = a.Stats(); len(s.IndexQueryUsed) != 0 {
+		t.Errorf("expected usage to drain, got: %v", s.IndexQueryUsed)
+	}
+	if _, err = a.StartQueryWithOptions(300,
+		queryOptions{Index: "analytics"}); err != nil {
+		t.Errorf("expected query to fit once usage drained, got: %v", err)
+	}
+}
+
+func TestAppHerderQueryImbalance(t *testing.T) {
+	a := newAppHerder(10000, 1, 1, 1)
+	a.imbalance = newImbalanceDetector(time.Minute)
+	now := time.Now()
+
+	// queries that keep ending don't trip the detector, even when busy
+	a.Tick(now)
+	for i := 0; i < 3; i++ {
+		a.StartQuery(100)
+	}
+	a.Tick(now.Add(20 * time.Second))
+	a.EndQuery(100)
+	a.Tick(now.Add(time.Minute))
+	if s := a.Stats(); s.QueryImbalanceSuspected ||
+		s.OutstandingQueries != 2 {
+		t.Errorf("expected no imbalance with 2 outstanding, got: %t, %d",
+			s.QueryImbalanceSuspected, s.OutstandingQueries)
+	}
+
+	// leaked reservations only accumulate
+	for i := 1; i <= 3; i++ {
+		a.StartQuery(100)
+		a.Tick(now.Add(time.Minute + time.Duration(i)*20*time.Second))
+	}
+	s := a.Stats()
+	if !s.QueryImbalanceSuspected || s.QueryImbalanceWarnings != 1 ||
+		s.OutstandingQueriesTrend != 0.05 {
+		t.Errorf("expected imbalance growing 3 per minute, got: %t, %d, %v",
+			s.QueryImbalanceSuspected, s.QueryImbalanceWarnings,
+			s.OutstandingQueriesTrend)
+	}
+	if s.TotQueryAdmittedBytes != 600 || s.TotQueryEnded != 1 ||
+		s.TotQueryEndedBytes != 100 || s.OutstandingQueries != 5 {
+		t.Errorf("expected 600 started, 1 ending 100, got: %d, %d, %d, %d",
+			s.TotQueryAdmittedBytes, s.TotQueryEnded, s.TotQueryEndedBytes,
+			s.OutstandingQueries)
+	}
+}
+
+func TestAppHerderQueryQuantum(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.queryQuantum = 100
+	a.strictAccounting = true
+
+	if err := a.StartQuery(150); err != nil {
+		t.Fatalf("expected query to be admitted, got: %v", err)
+	}
+	r, err := a.StartQueryWithOptions(201, queryOptions{ID: "q"})
+	if err != nil {
+		t.Fatalf("expected query to be admitted, got: %v", err)
+	}
+	s := a.Stats()
+	if s.RunningQueryUsed != 500 || s.RunningQueryRawUsed != 351 {
+		t.Errorf("expected 500 accounted for 351 requested, got: %d, %d",
+			s.RunningQueryUsed, s.RunningQueryRawUsed)
+	}
+
+	// a reduced best effort budget is whole quanta, so it ends cleanly
+	granted, err := a.StartQueryBestEffort(650)
+	if err != nil || granted != 500 {
+		t.Fatalf("expected a reduced budget of 500, got: %d, err: %v",
+			granted, err)
+	}
+	a.EndQuery(granted)
+	a.EndQuery(150)
+	r.End()
+	if s = a.Stats(); s.RunningQueryUsed != 0 || s.RunningQueryRawUsed != 0 {
+		t.Errorf("expected usage to drain, got: %d, raw: %d",
+			s.RunningQueryUsed, s.RunningQueryRawUsed)
+	}
+}
+
+func TestAppHerderLockHolds(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.m.holds = newLatencyHistogram()
+
+	// a slow size func runs with the lock released
+	slow := func(c interface{}) (uint64, error) {
+		time.Sleep(5 * time.Millisecond)
+		return 100, nil
+	}
+	a.onBatchExecuteStart(&testIndex{}, slow, statsErrFailOpen,
+		batchPriorityNormal)
+	if s := a.Stats(); s.LockHoldMax >= 5*time.Millisecond ||
+		s.SizeSweepLast < 5*time.Millisecond {
+		t.Errorf("expected the sweep, not the lock, to be slow, got"+
+			" hold: %s, sweep: %s", s.LockHoldMax, s.SizeSweepLast)
+	}
+
+	a.m.Lock()
+	time.Sleep(5 * time.Millisecond)
+	a.m.Unlock()
+	if s := a.Stats(); s.LockHoldMax < 5*time.Millisecond ||
+		s.LockHoldP99 > s.LockHoldMax*2 {
+		t.Errorf("expected a 5ms hold, got max: %s, p99: %s",
+			s.LockHoldMax, s.LockHoldP99)
+	}
+}
+
+func TestAppHerderZeroSizePolicy(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	if err := a.StartQuery(0); err != nil {
+		t.Fatalf("expected zero size query allowed by default, got: %v", err)
+	}
+	a.EndQuery(0)
+
+	a.zeroSizePolicy = zeroSizeWarn
+	r, err := a.StartQueryWithOptions(0, queryOptions{ID: "q"})
+	if err != nil {
+		t.Fatalf("expected zero size query admitted with a warning,"+
+			" got: %v", err)
+	}
+	r.End()
+
+	a.zeroSizePolicy = zeroSizeReject
+	a.SetQueryFastPath(true)
+	if _, err = a.StartQueryWithOptions(0, queryOptions{}); err == nil {
+		t.Errorf("expected zero size query rejected, despite the fast path")
+	}
+	if _, err = a.StartQueryBestEffort(0); err == nil {
+		t.Errorf("expected zero size best effort query rejected")
+	}
+	if err = a.StartQuery(1); err != nil {
+		t.Errorf("expected sized query admitted, got: %v", err)
+	}
+	if s := a.Stats(); s.TotZeroSizeQueries != 3 || s.RunningQueries != 1 {
+		t.Errorf("expected 3 zero size queries and 1 running, got: %d, %d",
+			s.TotZeroSizeQueries, s.RunningQueries)
+	}
+}
+
+func TestAppHerderMiscMaxBytes(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.5, 0.5)
+	a.miscMaxBytes = 300
+
+	if _, err := a.ReserveMisc(context.Background(), 400); err == nil {
+		t.Fatalf("expected reservation over the cap to be rejected")
+	}
+	r, err := a.ReserveMisc(context.Background(), 200)
+	if err != nil {
+		t.Fatalf("expected misc reservation, err: %v", err)
+	}
+
+	// the cap, rather than appQuota, makes this one wait
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	if _, err = a.ReserveMisc(ctx, 200); err == nil {
+		t.Errorf("expected reservation to wait on the cap")
+	}
+
+	rest := a.ReserveRemaining()
+	if s := a.Stats(); s.MiscReserved != 300 || s.MiscMaxBytes != 300 {
+		t.Errorf("expected remaining capped at 300 in total, got: %d, cap: %d",
+			s.MiscReserved, s.MiscMaxBytes)
+	}
+	rest.Release()
+
+	// decaying reservations are capped too, and count towards the cap
+	if _, err = a.ReserveDecaying(200, time.Hour); err == nil {
+		t.Errorf("expected decaying reservation over the cap rejected")
+	}
+	d, err := a.ReserveDecaying(100, time.Hour)
+	if err != nil {
+		t.Fatalf("expected decaying reservation under the cap, err: %v", err)
+	}
+	// bar the little that has decayed meanwhile
+	if rest = a.ReserveRemaining(); rest.Size() > 1 {
+		t.Errorf("expected no room left under the cap, got: %d", rest.Size())
+	}
+	rest.Release()
+	d.Release()
+	r.Release()
+}
+
+func TestAppHerderSizeSweepCost(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	slow := func(c interface{}) (uint64, error) {
+		time.Sleep(5 * time.Millisecond)
+		return 100, nil
+	}
+	for i := 0; i < 2; i++ {
+		a.onBatchExecuteStart(&testIndex{}, slow, statsErrFailOpen,
+			batchPriorityNormal)
+	}
+
+	s := a.Stats()
+	if s.SizeSweeps == 0 || s.SizeSweepIndexes != 2 ||
+		s.SizeSweepLast < 10*time.Millisecond ||
+		s.SizeSweepAvg <= 0 {
+		t.Errorf("expected sweeps of 2 slow size funcs to be timed, got:"+
+			" sweeps: %d, indexes: %d, last: %s, avg: %s", s.SizeSweeps,
+			s.SizeSweepIndexes, s.SizeSweepLast, s.SizeSweepAvg)
+	}
+}
+
+func TestAppHerderWakeSourceQuery(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	if err := a.StartQuery(600); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+
+	// over appQuota only while the query runs
+	idx := &testIndex{size: 600}
+	admitted := make(chan struct{})
+	go func() {
+		a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+			batchPriorityNormal)
+		close(admitted)
+	}()
+	for a.Stats().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	a.EndQuery(600)
+	<-admitted
+	if s := a.Stats(); s.WakeAdmitsQuery != 1 || s.WakeAdmitsPersister != 0 {
+		t.Errorf("expected admission woken by the query ending, got:"+
+			" query: %d, persister: %d", s.WakeAdmitsQuery,
+			s.WakeAdmitsPersister)
+	}
+}
+
+func TestAppHerderStateJSON(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.5, 0.5)
+	idx := &testIndex{size: 300}
+	var sizes int
+	a.RegisterIndex(idx, indexOptions{Name: "idx"})
+	a.onBatchExecuteStart(idx, func(c interface{}) (uint64, error) {
+		sizes++
+		return idx.sizeFunc(c)
+	}, statsErrFailOpen, batchPriorityNormal)
+	a.queryCancelGrace = 1500 * time.Millisecond
+
+	sizes = 0
+	b, err := a.StateJSON()
+	if err != nil {
+		t.Fatalf("expected state JSON, err: %v", err)
+	}
+	if sizes != 1 {
+		t.Errorf("expected the size func run once, got: %d", sizes)
+	}
+
+	var state struct {
+		Config map[string]interface{} `json:"config"`
+		Stats  struct {
+			IndexQuota     uint64 `json:"indexQuota"`
+			IndexingMemory uint64 `json:"indexingMemory"`
+			SizeSweepLast  string `json:"sizeSweepLast"`
+			PerIndex       []struct {
+				Name string `json:"name"`
+				Size uint64 `json:"size"`
+			} `json:"perIndex"`
+		} `json:"stats"`
+	}
+	if err = json.Unmarshal(b, &state); err != nil {
+		t.Fatalf("expected valid JSON, err: %v, got: %s", err, b)
+	}
+	if state.Config["queryCancelGrace"] != "1.5s" ||
+		state.Config["oomImminentRatio"] != 0.0 ||
+		state.Config["persisterWakeMode"] != "broadcast" {
+		t.Errorf("expected durations and enums as strings, got: %v",
+			state.Config)
+	}
+	if state.Stats.IndexQuota != 500 || state.Stats.IndexingMemory != 300 ||
+		len(state.Stats.PerIndex) != 1 ||
+		state.Stats.PerIndex[0].Name != "idx" ||
+		state.Stats.PerIndex[0].Size != 300 {
+		t.Errorf("expected quotas, usage and per-index stats, got: %s", b)
+	}
+	if _, err = time.ParseDuration(state.Stats.SizeSweepLast); err != nil {
+		t.Errorf("expected stats durations as strings, got: %q",
+			state.Stats.SizeSweepLast)
+	}
+
+	// the stats have one schema, however they're marshaled
+	sb, err := json.Marshal(a.Stats())
+	if err != nil {
+		t.Fatalf("expected stats JSON, err: %v", err)
+	}
+	var stats map[string]interface{}
+	if err = json.Unmarshal(sb, &stats); err != nil {
+		t.Fatalf("expected valid JSON, err: %v, got: %s", err, sb)
+	}
+	if stats["indexQuota"] != 500.0 || stats["lockHoldMax"] != "0s" {
+		t.Errorf("expected lower camel keys and duration strings, got: %s",
+			sb)
+	}
+	st := reflect.TypeOf(appHerderStats{})
+	for i := 0; i < st.NumField(); i++ {
+		if tag := st.Field(i).Tag.Get("json"); tag == "" {
+			t.Errorf("expected a json tag on %s", st.Field(i).Name)
+		} else if _, exists := stats[tag]; !exists {
+			t.Errorf("expected %s in the stats JSON", tag)
+		}
+	}
+}
+
+func TestAppHerderMemoryBreakdown(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	small, large := &testIndex{size: 100}, &testIndex{size: 300}
+	for _, idx := range []*testIndex{small, large} {
+		a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+			batchPriorityNormal)
+	}
+	if err := a.StartQuery(200); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	r, err := a.ReserveDecaying(50, time.Hour)
+	if err != nil {
+		t.Fatalf("expected decaying reservation, err: %v", err)
+	}
+	defer r.Release()
+
+	b := a.MemoryBreakdown()
+	if b.Indexing != 400 || b.Queries != 200 || b.Misc < 49 ||
+		b.Indexing+b.Queries+b.Misc+b.Free != b.AppQuota || b.Over != 0 {
+		t.Errorf("expected breakdown summing to appQuota, got: %+v", b)
+	}
+	if len(b.PerIndex) != 2 || b.PerIndex[0].Bytes != 300 ||
+		b.PerIndex[1].Bytes != 100 {
+		t.Errorf("expected indexes largest first, got: %+v", b.PerIndex)
+	}
+
+	large.grow(500)
+	if b = a.MemoryBreakdown(); b.Free != 0 || b.Over == 0 {
+		t.Errorf("expected usage over appQuota, got: %+v", b)
+	}
+}
+
+func TestAppHerderReserveDecaying(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+
+	r, err := a.ReserveDecaying(800, time.Hour)
+	if err != nil {
+		t.Fatalf("expected decaying reservation, err: %v", err)
+	}
+	if err := a.StartQuery(500); err == nil {
+		t.Errorf("expected decaying reservation to hold app memory")
+	}
+	if half := r.remaining(r.start.Add(30 * time.Minute)); half != 400 {
+		t.Errorf("expected half decayed after half the period, got: %d", half)
+	}
+	if gone := r.remaining(r.start.Add(time.Hour)); gone != 0 {
+		t.Errorf("expected fully decayed after the period, got: %d", gone)
+	}
+
+	if err := r.Release(); err != nil {
+		t.Fatalf("expected release to succeed, got: %v", err)
+	}
+	if s := a.Stats(); s.MiscReserved != 0 || s.DecayingReserved != 0 {
+		t.Errorf("expected no misc memory after release, got: %+v", s)
+	}
+	if err := a.StartQuery(500); err != nil {
+		t.Errorf("expected query after release, got: %v", err)
+	}
+}
+
+func TestAppHerderStatsErrPolicy(t *testing.T) {
+	broken := func(c interface{}) (uint64, error) {
+		return 0, fmt.Errorf("stats unavailable")
+	}
+
+	for _, test := range []struct {
+		policy statsErrPolicy
+		expect uint64
+	}{
+		{statsErrFailOpen, 0},
+		{statsErrFailClosed, 500},
+	} {
+		a := newAppHerder(1000, 1, 0.5, 0.5)
+		a.m.Lock()
+		entry := a.indexEntryLOCKED(&testIndex{})
+		entry.size, entry.onStatsErr = broken, test.policy
+		got := a.indexingMemoryLOCKED()
+		a.m.Unlock()
+		if got != test.expect {
+			t.Errorf("policy: %s, expected indexing memory: %d, got: %d",
+				test.policy, test.expect, got)
+		}
+	}
+
+	for _, s := range []string{"failOpen", "failClosed"} {
+		p, err := parseStatsErrPolicy(s)
+		if err != nil || p.String() != s {
+			t.Errorf("expected policy: %s, got: %s, err: %v", s, p, err)
+		}
+	}
+	if _, err := parseStatsErrPolicy("failSometimes"); err == nil {
+		t.Errorf("expected unknown policy to be an error")
+	}
+}
+
+func TestAppHerderAdmissionLatency(t *testing.T) {
+	h := newLatencyHistogram()
+	for i := 0; i < 90; i++ {
+		h.record(time.Microsecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.record(100 * time.Millisecond)
+	}
+	if p50 := h.percentile(0.50); p50 != time.Microsecond {
+		t.Errorf("expected p50: 1us, got: %s", p50)
+	}
+	// reported as the upper bound of its power-of-two bucket
+	if p99 := h.percentile(0.99); p99 < 100*time.Millisecond ||
+		p99 > 200*time.Millisecond {
+		t.Errorf("expected p99 in [100ms, 200ms], got: %s", p99)
+	}
+
+	a := newAppHerder(1000, 1, 1, 1)
+	if s := a.Stats(); s.QueryAdmitLatencyP50 != 0 {
+		t.Errorf("expected no latencies while disabled, got: %s",
+			s.QueryAdmitLatencyP50)
+	}
+	a.queryAdmitLatency = newLatencyHistogram()
+	a.batchAdmitLatency = newLatencyHistogram()
+	if err := a.StartQuery(100); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	idx := &testIndex{}
+	a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+	s := a.Stats()
+	if s.QueryAdmitLatencyP50 == 0 || s.QueryAdmitLatencyP99 == 0 ||
+		s.BatchAdmitLatencyP50 == 0 || s.BatchAdmitLatencyP99 == 0 {
+		t.Errorf("expected admission latencies, got: %+v", s)
+	}
+}
+
+// testCollection is a fake moss collection, of which only Options and
+// Stats are used by the herder.
+type testCollection struct {
+	moss.Collection
+	options moss.CollectionOptions
+	dirty   uint64
+}
+
+func (c *testCollection) Options() moss.CollectionOptions {
+	return c.options
+}
+
+func (c *testCollection) Stats() (*moss.CollectionStats, error) {
+	return &moss.CollectionStats{CurDirtyBytes: c.dirty}, nil
+}
+
+func TestAppHerderAttach(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+
+	var prevEvents int
+	options := moss.CollectionOptions{
+		OnEvent: func(event moss.Event) { prevEvents++ },
+	}
+	a.AttachMoss(&options)
+
+	c := &testCollection{dirty: 100}
+	c.options.LowerLevelUpdate = func(higher moss.Snapshot) (
+		moss.Snapshot, error) {
+		return nil, nil
+	}
+	options.OnEvent(moss.Event{Kind: moss.EventKindBatchExecuteStart,
+		Collection: c})
+	if s := a.Stats(); s.Indexes != 1 || s.IndexingMemory != 100 {
+		t.Errorf("expected the collection tracked, got: %+v", s)
+	}
+	options.OnEvent(moss.Event{Kind: moss.EventKindClose, Collection: c})
+	if s := a.Stats(); s.Indexes != 0 {
+		t.Errorf("expected the collection closed, got: %+v", s)
+	}
+	if prevEvents != 2 {
+		t.Errorf("expected the previous OnEvent chained, got: %d events",
+			prevEvents)
+	}
+
+	config := map[string]interface{}{}
+	a.AttachScorch("testAttach", config)
+	defer delete(scorch.RegistryEventCallbacks, "testAttach")
+	if scorch.RegistryEventCallbacks["testAttach"] == nil ||
+		config["eventCallbackName"] != "testAttach" {
+		t.Errorf("expected the scorch callback registered, config: %v",
+			config)
+	}
+}
+
+func TestAppHerderReadOnly(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.5, 0.5)
+	a.SetReadOnly(true)
+
+	// queries get the whole appQuota
+	if err := a.StartQuery(1000); err != nil {
+		t.Errorf("expected appQuota sized query to be admitted, err: %v", err)
+	}
+	a.EndQuery(1000)
+
+	// batches aren't held back or registered
+	idx := &testIndex{size: 5000}
+	a.onBatchExecuteStart(idx, idx.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+	if s := a.Stats(); len(s.PerIndex) != 0 || s.Waiting != 0 {
+		t.Errorf("expected no indexes in read-only mode, got: %+v", s.PerIndex)
+	}
+
+	a.SetReadOnly(false)
+	if err := a.StartQuery(1000); err == nil {
+		t.Errorf("expected queryQuota to apply again")
+	}
+}
+
+func TestAppHerderArbitrationWeight(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	idx := &testIndex{size: 400}
+	<-startBatch(a, idx)
+
+	overForIndexing := func() bool {
+		a.m.Lock()
+		defer a.m.Unlock()
+		return a.overMemQuotaForIndexingLOCKED(batchPriorityNormal)
+	}
+
+	// favoring indexing shrinks the appQuota queries see
+	if n := a.MaxAdmissibleQuerySize(); n != 600 {
+		t.Errorf("expected first-come 600 bytes for queries, got: %d", n)
+	}
+	a.arbitrationWeight = -0.5
+	if n := a.MaxAdmissibleQuerySize(); n != 100 {
+		t.Errorf("expected 100 bytes for queries favoring indexing, got: %d",
+			n)
+	}
+
+	// favoring queries shrinks the appQuota indexing sees
+	a.arbitrationWeight = 0.5
+	if err := a.StartQuery(100); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	if overForIndexing() {
+		t.Errorf("expected indexing at the shrunk appQuota to be admitted")
+	}
+	idx.grow(50)
+	if !overForIndexing() {
+		t.Errorf("expected indexing to yield to queries")
+	}
+	a.arbitrationWeight = 0
+	if overForIndexing() {
+		t.Errorf("expected first-come indexing to be admitted")
+	}
+}
+
+func TestAppHerderQuotaThrashing(t *testing.T) {
+	d := newThrashDetector(time.Second, 2)
+	t0 := time.Now()
+	var warned int
+	for i, over := range []bool{false, true, false, true, false, true} {
+		if d.observe(over, t0.Add(time.Duration(i)*time.Millisecond)) {
+			warned++
+		}
+	}
+	if warned != 1 || d.crossings != 5 {
+		t.Errorf("expected 1 warning for 5 crossings, got: %d, %d",
+			warned, d.crossings)
+	}
+	d.roll(t0.Add(time.Second))
+	if d.rate != 5 || d.crossings != 0 {
+		t.Errorf("expected a rate of 5/s in a new interval, got: %v, %d",
+			d.rate, d.crossings)
+	}
+
+	// the herder feeds it its query quota checks
+	a := newAppHerder(1000, 1, 1, 0.5)
+	a.thrash = newThrashDetector(time.Hour, 2)
+	for i := 0; i < 3; i++ {
+		if err := a.StartQuery(1000); err == nil {
+			t.Fatalf("expected query over queryQuota to be rejected")
+		}
+		if err := a.StartQuery(100); err != nil {
+			t.Fatalf("expected query to be admitted, err: %v", err)
+		}
+		a.EndQuery(100)
+	}
+	if a.thrash.crossings != 5 {
+		t.Errorf("expected 5 crossings, got: %d", a.thrash.crossings)
+	}
+	a.Tick(time.Now().Add(2 * time.Hour))
+	if s := a.Stats(); s.QuotaCrossingRate <= 0 {
+		t.Errorf("expected a crossing rate, got: %v", s.QuotaCrossingRate)
+	}
+}
+
+func TestAppHerderTick(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	idx := &testIndex{size: 100}
+	<-startBatch(a, idx)
+
+	// driven entirely by the caller's clock
+	t0 := time.Now()
+	a.Tick(t0)
+	a.onPersisterProgress(idx)
+	a.onPersisterProgress(idx)
+	a.Tick(t0.Add(2 * time.Second))
+	if s := a.Stats(); s.PersisterProgressRate != 1 {
+		t.Errorf("expected 1 progress/s, got: %v", s.PersisterProgressRate)
+	}
+
+	r, err := a.ReserveDecaying(500, time.Minute)
+	if err != nil {
+		t.Fatalf("expected decaying reservation, err: %v", err)
+	}
+	a.Tick(r.start.Add(time.Minute))
+	if s := a.Stats(); s.DecayingReserved != 0 {
+		t.Errorf("expected the tick to prune the decayed reservation,"+
+			" got: %d", s.DecayingReserved)
+	}
+}
+
+func TestAppHerderIngestRateHint(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.ingestThrottleStart = 0.5
+	idx := &testIndex{size: 400}
+	<-startBatch(a, idx)
+
+	for _, test := range []struct {
+		size uint64
+		hint float64
+	}{
+		{400, 1},
+		{750, 0.5},
+		{1000, 0},
+		{1200, 0},
+	} {
+		idx.m.Lock()
+		idx.size = test.size
+		idx.m.Unlock()
+		if hint := a.IngestRateHint(); hint != test.hint {
+			t.Errorf("expected hint: %v at size: %d, got: %v", test.hint,
+				test.size, hint)
+		}
+	}
+}
+
+func TestFmtBytes(t *testing.T) {
+	for _, test := range []struct {
+		b   uint64
+		exp string
+	}{
+		{0, "0 (0 B)"},
+		{1023, "1023 (1023 B)"},
+		{1024, "1024 (1.0 KiB)"},
+		{1536, "1536 (1.5 KiB)"},
+		{1 << 30, "1073741824 (1.0 GiB)"},
+		{1 << 60, "1152921504606846976 (1.0 EiB)"},
+	} {
+		if got := fmtBytes(test.b); got != test.exp {
+			t.Errorf("expected: %q, got: %q", test.exp, got)
+		}
+	}
+}
+
+func TestAppHerderForRAMFraction(t *testing.T) {
+	ram, err := systemMemory()
+	if err != nil {
+		t.Skipf("system memory unavailable, err: %v", err)
+	}
+	if ram == 0 {
+		t.Fatalf("expected some system memory")
+	}
+
+	a, err := newAppHerderForRAMFraction(0.5, 1, 1, 1)
+	if err != nil {
+		t.Fatalf("expected herder, err: %v", err)
+	}
+	if exp := uint64(float64(ram) * 0.5); a.memQuota != exp {
+		t.Errorf("expected memQuota: %d, got: %d", exp, a.memQuota)
+	}
+}
+
+func TestAppHerderOOMImminent(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.oomImminentRatio = 0.9
+	snapshots := make(chan oomSnapshot, 2)
+	a.onOOMImminent = func(s oomSnapshot) { snapshots <- s }
+
+	if err := a.StartQuery(950); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	// usage is checked ahead of each admission, firing once per crossing
+	for i := 0; i < 2; i++ {
+		if err := a.StartQuery(10); err != nil {
+			t.Fatalf("expected query to be admitted, err: %v", err)
+		}
+	}
+	select {
+	case s := <-snapshots:
+		if s.Stats.RunningQueryUsed < 950 || s.Goroutines == "" {
+			t.Errorf("expected a snapshot of the usage, got: %+v", s.Stats)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected OnOOMImminent to fire")
+	}
+	select {
+	case <-snapshots:
+		t.Errorf("expected OnOOMImminent to fire once per crossing")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// re-armed once usage drops back below
+	a.EndQuery(950)
+	a.EndQuery(10)
+	a.EndQuery(10)
+	if err := a.StartQuery(950); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	if err := a.StartQuery(10); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	select {
+	case <-snapshots:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected OnOOMImminent to fire again")
+	}
+}
+
+func TestAppHerderShareSlack(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.4, 0.4)
+
+	// the gap between the ratios is unreachable by default
+	if err := a.StartQuery(500); err == nil {
+		t.Errorf("expected query over queryQuota to be rejected")
+	}
+	if s := a.Stats(); s.SharedSlack != 0 {
+		t.Errorf("expected no shared slack, got: %d", s.SharedSlack)
+	}
+
+	a.SetShareSlack(true)
+	s := a.Stats()
+	if s.SharedSlack != 200 || s.IndexQuota != 600 || s.QueryQuota != 600 {
+		t.Errorf("expected 200 bytes shared by both sides, got: %d, %d, %d",
+			s.SharedSlack, s.IndexQuota, s.QueryQuota)
+	}
+	if err := a.StartQuery(500); err != nil {
+		t.Errorf("expected query borrowing the slack, err: %v", err)
+	}
+	a.EndQuery(500)
+
+	a.SetShareSlack(false)
+	if s := a.Stats(); s.SharedSlack != 0 || s.QueryQuota != 400 {
+		t.Errorf("expected the slack unshared again, got: %d, %d",
+			s.SharedSlack, s.QueryQuota)
+	}
+}
+
+func TestAppHerderStatsDeltaFrom(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 0.5)
+	prev := a.Stats()
+
+	if err := a.StartQuery(300); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	if err := a.StartQuery(300); err == nil {
+		t.Fatalf("expected query over queryQuota to be rejected")
+	}
+	a.UpdateMemQuota(800)
+	cur := a.Stats()
+	cur.Time = prev.Time.Add(2 * time.Second)
+
+	d := cur.DeltaFrom(prev)
+	if d.Interval != 2*time.Second || d.TotQueryAdmitted != 1 ||
+		d.TotQueryRejected != 1 || d.TotQueryAdmittedRate != 0.5 {
+		t.Errorf("expected 1 admission and rejection in 2s, got: %+v", d)
+	}
+	// gauges show their net change, which may be negative
+	if d.RunningQueryUsed != 300 || d.RunningQueries != 1 ||
+		d.MemQuota != -200 {
+		t.Errorf("expected gauge changes, got: %+v", d)
+	}
+}
+
+func TestAppHerderWarmupFloor(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	idx := &testIndex{}
+	a.RegisterIndex(idx, indexOptions{WarmupFloor: 300})
+	<-startBatch(a, idx)
+
+	// a warming index reserves its floor
+	if is := a.Stats().PerIndex[0]; is.Size != 300 || is.WarmedUp {
+		t.Errorf("expected the 300 byte floor while warming, got: %d, %t",
+			is.Size, is.WarmedUp)
+	}
+
+	// and is sized as is once it exceeds the floor, for good
+	idx.grow(400)
+	if is := a.Stats().PerIndex[0]; is.Size != 400 || !is.WarmedUp {
+		t.Errorf("expected the live size once warmed up, got: %d, %t",
+			is.Size, is.WarmedUp)
+	}
+	idx.persist(300)
+	if is := a.Stats().PerIndex[0]; is.Size != 100 {
+		t.Errorf("expected no floor once warmed up, got: %d", is.Size)
+	}
+}
+
+func TestAppHerderDescribe(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.5, 0.5)
+	if err := a.StartQuery(100); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	idx := &testIndex{size: 200}
+	a.RegisterIndex(idx, indexOptions{Name: "idx"})
+	<-startBatch(a, idx)
+
+	d := a.Describe()
+	for _, exp := range []string{
+		"config:\n",
+		"stats:\n",
+		"  indexRatio:                0.5\n",
+		"  queryCancelGrace:          \"0s\"\n",
+		"  queryQuota:                500\n",
+		"  runningQueryUsed:          100\n",
+		"  perIndex:\n    {\"name\":\"idx\",\"size\":200,",
+	} {
+		if !strings.Contains(d, exp) {
+			t.Errorf("expected description to contain: %q, got:\n%s", exp, d)
+		}
+	}
+}
+
+func TestAppHerderReserveRemainingRace(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.checkInvariants = true
+	idx := &testIndex{size: 200}
+	bs := &blockingSize{idx: idx}
+	a.onBatchExecuteStart(idx, bs.sizeFunc, statsErrFailOpen,
+		batchPriorityNormal)
+
+	// a query grows the usage while the index sizes are sampled
+	bs.arm()
+	reserved := make(chan *miscReservation, 1)
+	go func() { reserved <- a.ReserveRemaining() }()
+	<-bs.sizing
+	if err := a.StartQuery(300); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	bs.proceed <- 200
+	r := <-reserved
+
+	if r.Size() != 500 {
+		t.Errorf("expected the remaining 500 bytes net of the query,"+
+			" got: %d", r.Size())
+	}
+	if n := a.MaxAdmissibleQuerySize(); n != 0 {
+		t.Errorf("expected no room left, got: %d", n)
+	}
+
+	if err := r.Release(); err != nil {
+		t.Errorf("expected release, err: %v", err)
+	}
+	if n := a.MaxAdmissibleQuerySize(); n != 500 {
+		t.Errorf("expected the reserved room back, got: %d", n)
+	}
+}
+
+// stepQuotaPolicy halves the indexQuota once there are 3 or more
+// indexes, giving the rest to queries.
+type stepQuotaPolicy struct{}
+
+func (stepQuotaPolicy) Quotas(memQuota uint64, state quotaPolicyState) (
+	appQuota, indexQuota, queryQuota uint64) {
+	indexQuota = memQuota / 2
+	if state.Indexes >= 3 {
+		indexQuota = memQuota / 4
+	}
+	return memQuota, indexQuota, memQuota - indexQuota
+}
+
+func TestAppHerderQuotaPolicy(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.SetQuotaPolicy(stepQuotaPolicy{})
+
+	wakeGen := func() uint64 {
+		a.m.Lock()
+		defer a.m.Unlock()
+		return a.wakeGen
+	}
+
+	// index count changes that leave the quotas as is change nothing
+	indexes := []*testIndex{{}, {}, {}}
+	gen := wakeGen()
+	a.RegisterIndex(indexes[0], indexOptions{})
+	a.RegisterIndex(indexes[1], indexOptions{})
+	if s := a.Stats(); s.IndexQuota != 500 || wakeGen() != gen {
+		t.Errorf("expected unchanged quotas for 2 indexes, got: %d, wakes: %d",
+			s.IndexQuota, wakeGen()-gen)
+	}
+
+	a.RegisterIndex(indexes[2], indexOptions{})
+	if s := a.Stats(); s.IndexQuota != 250 || s.QueryQuota != 750 ||
+		wakeGen() == gen {
+		t.Errorf("expected the step at 3 indexes, got: %d, %d",
+			s.IndexQuota, s.QueryQuota)
+	}
+
+	a.onClose(indexes[2])
+	if s := a.Stats(); s.IndexQuota != 500 || s.QueryQuota != 500 {
+		t.Errorf("expected the step back at 2 indexes, got: %d, %d",
+			s.IndexQuota, s.QueryQuota)
+	}
+
+	a.m.Lock()
+	changed := a.recomputeQuotasLOCKED()
+	a.m.Unlock()
+	if changed {
+		t.Errorf("expected rederiving the same quotas not to change them")
+	}
+}
+
+func TestAppHerderReconcileHeap(t *testing.T) {
+	a := newAppHerder(1000, 1, 1, 1)
+	a.heapDivergence = 0.5
+	a.heapScaleQuota = true
+	if err := a.StartQuery(200); err != nil {
+		t.Fatalf("expected query to be admitted, err: %v", err)
+	}
+	reconcile := func(heapInuse uint64) {
+		a.m.Lock()
+		a.reconcileHeapLOCKED(heapInuse)
+		a.m.Unlock()
+	}
+
+	// within the divergence of the tracked usage, nothing changes
+	reconcile(250)
+	if n := a.MaxAdmissibleQuerySize(); n != 800 {
+		t.Errorf("expected the whole appQuota, got: %d", n)
+	}
+
+	// beyond it, the untracked heap is taken out of appQuota
+	reconcile(500)
+	if n := a.MaxAdmissibleQuerySize(); n != 500 {
+		t.Errorf("expected 300 untracked bytes taken out, got: %d", n)
+	}
+
+	// until the two converge again
+	reconcile(250)
+	if n := a.MaxAdmissibleQuerySize(); n != 800 {
+		t.Errorf("expected the whole appQuota back, got: %d", n)
+	}
+}
+
+func TestAppHerderIndexMaxBytes(t *testing.T) {
+	a := newAppHerder(1000, 1, 0.5, 0.5)
+	a.SetIndexMaxBytes(300)
+	if s := a.Stats(); s.IndexQuota != 300 {
+		t.Errorf("expected the cap to bind, got: %d", s.IndexQuota)
+	}
+
+	// the cap survives memQuota changes either way
+	a.UpdateMemQuota(4000)
+	if s := a.Stats(); s.IndexQuota != 300 || s.QueryQuota != 2000 {
+		t.Errorf("expected the cap to bind after growing, got: %d, %d",
+			s.IndexQuota, s.QueryQuota)
+	}
+	a.UpdateMemQuota(400)
+	if s := a.Stats(); s.IndexQuota != 200 {
+		t.Errorf("expected the lower ratio quota after shrinking, got: %d",
+			s.IndexQuota)
+	}
+	a.UpdateMemQuota(2000)
+	if s := a.Stats(); s.IndexQuota != 300 {
+		t.Errorf("expected the cap to bind again, got: %d", s.IndexQuota)
+	}
+
+	a.SetIndexMaxBytes(0)
+	if s := a.Stats(); s.IndexQuota != 1000 {
+		t.Errorf("expected the ratio quota uncapped, got: %d", s.IndexQuota)
+	}
+}
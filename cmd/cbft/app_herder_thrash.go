@@ -0,0 +1,70 @@
+//  Copyright (c) 2018 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"time"
+)
+
+// thrashDetector counts how often quota checks flip between admitting
+// and rejecting, which signals usage oscillating across the quota
+// boundary.  It relies on the herder's lock.
+type thrashDetector struct {
+	interval  time.Duration
+	threshold int
+
+	windowStart time.Time
+	crossings   int
+	warned      bool
+
+	checked  bool
+	lastOver bool
+
+	// Crossings per second over the last complete interval.
+	rate float64
+}
+
+func newThrashDetector(interval time.Duration, threshold int) *thrashDetector {
+	return &thrashDetector{interval: interval, threshold: threshold}
+}
+
+// observe records the outcome of a quota check, returning true the
+// first time the crossings within the current interval exceed the
+// threshold.
+func (t *thrashDetector) observe(over bool, now time.Time) bool {
+	t.roll(now)
+
+	if t.checked && over != t.lastOver {
+		t.crossings++
+	}
+	t.checked = true
+	t.lastOver = over
+
+	if t.crossings > t.threshold && !t.warned {
+		t.warned = true
+		return true
+	}
+	return false
+}
+
+// roll starts a new interval once the current one has elapsed.
+func (t *thrashDetector) roll(now time.Time) {
+	if now.Sub(t.windowStart) < t.interval {
+		return
+	}
+	if !t.windowStart.IsZero() {
+		t.rate = float64(t.crossings) / now.Sub(t.windowStart).Seconds()
+	}
+	t.windowStart = now
+	t.crossings = 0
+	t.warned = false
+}
@@ -73,8 +73,7 @@ func initBleveOptions(options map[string]string) error {
 	bleve.Config.SetAnalysisQueueSize(bleveAnalysisQueueSize)
 
 	// set scorch index's OnEvent callbacks using the app herder
-	scorch.RegistryEventCallbacks["scorchEventCallbacks"] =
-		ftsHerder.ScorchHerderOnEvent()
+	ftsHerder.AttachScorch("scorchEventCallbacks", nil)
 
 	scorch.RegistryAsyncErrorCallbacks["scorchAsyncErrorCallbacks"] =
 		func(err error) {
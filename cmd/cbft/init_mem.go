@@ -15,6 +15,7 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -47,11 +48,6 @@ func initMemOptions(options map[string]string) (err error) {
 		}
 	}
 
-	if memCheckInterval > 0 {
-		g := NewGoverseer(memCheckInterval, memQuota)
-		go g.Run()
-	}
-
 	ftsApplicationFraction, err := parseFTSMemApplicationFraction(options)
 	if err != nil {
 		return err
@@ -65,12 +61,636 @@ func initMemOptions(options map[string]string) (err error) {
 		return err
 	}
 
-	ftsHerder = newAppHerder(memQuota, ftsApplicationFraction,
-		ftsIndexingFraction, ftsQueryingFraction)
+	// The quota may instead be given as a fraction of the system's RAM,
+	// so it stays right across hardware changes.
+	v, exists = options["ftsMemoryQuotaFraction"]
+	if exists {
+		ramFraction, err2 := strconv.ParseFloat(v, 64)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing ftsMemoryQuotaFraction: %q, err: %v", v, err2)
+		}
+		ftsHerder, err = newAppHerderForRAMFraction(ramFraction,
+			ftsApplicationFraction, ftsIndexingFraction, ftsQueryingFraction)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" ftsMemoryQuotaFraction: %q, err: %v", v, err)
+		}
+		memQuota = ftsHerder.memQuota
+	} else {
+		ftsHerder = newAppHerder(memQuota, ftsApplicationFraction,
+			ftsIndexingFraction, ftsQueryingFraction)
+	}
+
+	if memCheckInterval > 0 {
+		g := NewGoverseer(memCheckInterval, memQuota)
+		go g.Run()
+	}
+
+	if _, exists = options["memIngestThrottleFraction"]; exists {
+		ftsHerder.ingestThrottleStart, err = parseFraction(
+			"memIngestThrottleFraction", defaultIngestThrottleStart, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, exists = options["memHighlightFraction"]; exists {
+		highlightFraction, err2 := parseFraction("memHighlightFraction", 0,
+			options)
+		if err2 != nil {
+			return err2
+		}
+		ftsHerder.SetHighlightRatio(highlightFraction)
+	}
+
+	// As comma separated index:bytes pairs.
+	v, exists = options["memIndexQueryQuotas"]
+	if exists && v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			i := strings.LastIndex(pair, ":")
+			if i < 0 {
+				return fmt.Errorf("init_mem:"+
+					" parsing memIndexQueryQuotas: %q, missing quota for: %q",
+					v, pair)
+			}
+			quota, err2 := strconv.ParseUint(pair[i+1:], 10, 64)
+			if err2 != nil {
+				return fmt.Errorf("init_mem:"+
+					" parsing memIndexQueryQuotas: %q, err: %v", v, err2)
+			}
+			ftsHerder.SetIndexQueryQuota(pair[:i], quota)
+		}
+	}
+
+	if _, exists = options["memHighPriorityFraction"]; exists {
+		hpf, err2 := parseFraction("memHighPriorityFraction", 0, options)
+		if err2 != nil {
+			return err2
+		}
+		if hpf < 0 || hpf > 1 {
+			return fmt.Errorf("init_mem:"+
+				" memHighPriorityFraction: %v out of range [0, 1]", hpf)
+		}
+		ftsHerder.highPriorityRatio = hpf
+	}
+
+	if _, exists = options["memQuerySmoothing"]; exists {
+		qs, err2 := parseFraction("memQuerySmoothing", 0, options)
+		if err2 != nil {
+			return err2
+		}
+		if qs < 0 || qs > 1 {
+			return fmt.Errorf("init_mem:"+
+				" memQuerySmoothing: %v out of range [0, 1]", qs)
+		}
+		ftsHerder.querySmoothing = qs
+	}
+
+	v, exists = options["memIndexTrendWindow"] // In Go duration format.
+	if exists {
+		ftsHerder.indexTrendWindow, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memIndexTrendWindow: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memIndexTrendSensitivity"]
+	if exists {
+		ftsHerder.indexTrendSensitivity, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memIndexTrendSensitivity: %q, err: %v", v, err)
+		}
+	}
+
+	if _, exists = options["memHeapDivergenceFraction"]; exists {
+		ftsHerder.heapDivergence, err = parseFraction(
+			"memHeapDivergenceFraction", 0, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	v, exists = options["memHeapScaleQuota"]
+	if exists {
+		ftsHerder.heapScaleQuota, err = strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memHeapScaleQuota: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memTrackEpochs"]
+	if exists {
+		ftsHerder.trackEpochs, err = strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memTrackEpochs: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memTrackInFlight"]
+	if exists {
+		ftsHerder.trackInFlight, err = strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memTrackInFlight: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memQueryQuantum"] // In bytes.
+	if exists {
+		ftsHerder.queryQuantum, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memQueryQuantum: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memMaxConcurrentQueries"]
+	if exists {
+		ftsHerder.maxConcurrentQueries, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memMaxConcurrentQueries: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memArbitrationWeight"] // In [-1, 1].
+	if exists {
+		aw, err2 := strconv.ParseFloat(v, 64)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memArbitrationWeight: %q, err: %v", v, err2)
+		}
+		if aw < -1 || aw > 1 {
+			return fmt.Errorf("init_mem:"+
+				" memArbitrationWeight: %q, must be in [-1, 1]", v)
+		}
+		ftsHerder.arbitrationWeight = aw
+	}
+
+	var thrashInterval time.Duration
+	v, exists = options["memThrashInterval"] // In Go duration format.
+	if exists {
+		var err2 error
+		thrashInterval, err2 = time.ParseDuration(v)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memThrashInterval: %q, err: %v", v, err2)
+		}
+	}
+
+	thrashThreshold := defaultMemThrashThreshold
+	v, exists = options["memThrashThreshold"] // Crossings per interval.
+	if exists {
+		thrashThreshold, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memThrashThreshold: %q, err: %v", v, err)
+		}
+	}
+
+	if thrashInterval > 0 {
+		ftsHerder.thrash = newThrashDetector(thrashInterval, thrashThreshold)
+	}
+
+	v, exists = options["memQueryImbalanceWindow"] // In Go duration format.
+	if exists {
+		window, err2 := time.ParseDuration(v)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memQueryImbalanceWindow: %q, err: %v", v, err2)
+		}
+		if window > 0 {
+			ftsHerder.imbalance = newImbalanceDetector(window)
+		}
+	}
+
+	rejectionWindow := defaultMemRejectionWindow
+	v, exists = options["memRejectionWindow"] // In Go duration format.
+	if exists {
+		rejectionWindow, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memRejectionWindow: %q, err: %v", v, err)
+		}
+	}
+	if rejectionWindow > 0 {
+		ftsHerder.rejections = newRejectionWindow(rejectionWindow)
+	}
+
+	v, exists = options["memBatchAdmissionHistory"] // Records kept.
+	if exists {
+		n, err2 := strconv.Atoi(v)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memBatchAdmissionHistory: %q, err: %v", v, err2)
+		}
+		if n > 0 {
+			ftsHerder.batchAdmissions = make([]batchAdmission, n)
+		}
+	}
+
+	admissionRateWindow := defaultMemAdmissionRateWindow
+	v, exists = options["memAdmissionRateWindow"] // In Go duration format.
+	if exists {
+		admissionRateWindow, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memAdmissionRateWindow: %q, err: %v", v, err)
+		}
+	}
+	if admissionRateWindow > 0 {
+		ftsHerder.admissions = newAdmissionWindow(admissionRateWindow)
+	}
+
+	v, exists = options["memQuotaMaxShrinkRate"] // In bytes per second.
+	if exists {
+		ftsHerder.memQuotaMaxShrinkRate, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memQuotaMaxShrinkRate: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memQuotaCoalesceWindow"] // In Go duration format.
+	if exists {
+		ftsHerder.memQuotaCoalesce, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memQuotaCoalesceWindow: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memQueryCancelGrace"] // In Go duration format.
+	if exists {
+		ftsHerder.queryCancelGrace, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memQueryCancelGrace: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memQueryQuotaWarmup"] // In Go duration format.
+	if exists {
+		ftsHerder.queryQuotaWarmup, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memQueryQuotaWarmup: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memHealthyStabilization"] // In Go duration format.
+	if exists {
+		ftsHerder.healthyStabilization, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memHealthyStabilization: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memIndexMaxBytes"]
+	if exists {
+		imb, err2 := strconv.ParseUint(v, 10, 64)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memIndexMaxBytes: %q, err: %v", v, err2)
+		}
+		ftsHerder.SetIndexMaxBytes(imb)
+	}
+
+	v, exists = options["memMiscMaxBytes"] // In bytes.
+	if exists {
+		ftsHerder.miscMaxBytes, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memMiscMaxBytes: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memQueryQuotaFloor"] // In bytes.
+	if exists {
+		qqf, err2 := strconv.ParseUint(v, 10, 64)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memQueryQuotaFloor: %q, err: %v", v, err2)
+		}
+		ftsHerder.SetQueryQuotaFloor(qqf)
+	}
+
+	v, exists = options["memPerIndexOverhead"] // In bytes.
+	if exists {
+		ftsHerder.perIndexOverhead, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memPerIndexOverhead: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memSizeJumpFactor"]
+	if exists {
+		ftsHerder.sizeJumpFactor, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memSizeJumpFactor: %q, err: %v", v, err)
+		}
+		if ftsHerder.sizeJumpFactor <= 1 {
+			return fmt.Errorf("init_mem:"+
+				" memSizeJumpFactor: %v must be above 1",
+				ftsHerder.sizeJumpFactor)
+		}
+	}
+
+	if _, exists = options["memCompressedWeight"]; exists {
+		ftsHerder.compressedWeight, err = parseFraction(
+			"memCompressedWeight", 1, options)
+		if err != nil {
+			return err
+		}
+		if ftsHerder.compressedWeight < 0 || ftsHerder.compressedWeight > 1 {
+			return fmt.Errorf("init_mem:"+
+				" memCompressedWeight: %v out of range [0, 1]",
+				ftsHerder.compressedWeight)
+		}
+	}
+
+	if _, exists = options["memIndexAlarmRearmFraction"]; exists {
+		ftsHerder.indexAlarmRearm, err = parseFraction(
+			"memIndexAlarmRearmFraction", defaultIndexAlarmRearm, options)
+		if err != nil {
+			return err
+		}
+		if ftsHerder.indexAlarmRearm <= 0 || ftsHerder.indexAlarmRearm > 1 {
+			return fmt.Errorf("init_mem:"+
+				" memIndexAlarmRearmFraction: %v out of range (0, 1]",
+				ftsHerder.indexAlarmRearm)
+		}
+	}
+
+	v, exists = options["memIndexWarmupFloor"] // In bytes.
+	if exists {
+		ftsHerder.warmupFloor, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memIndexWarmupFloor: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memMinBatchInterval"] // In Go duration format.
+	if exists {
+		ftsHerder.minBatchInterval, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memMinBatchInterval: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memStartupGrace"] // In Go duration format.
+	if exists {
+		grace, err2 := time.ParseDuration(v)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memStartupGrace: %q, err: %v", v, err2)
+		}
+		ftsHerder.SetStartupGrace(grace)
+	}
+
+	for _, e := range []struct {
+		option string
+		after  *time.Duration
+	}{
+		{"memEscalateThrottleAfter", &ftsHerder.escalateThrottleAfter},
+		{"memEscalatePauseAfter", &ftsHerder.escalatePauseAfter},
+		{"memEscalateFlushAfter", &ftsHerder.escalateFlushAfter},
+	} {
+		v, exists = options[e.option] // In Go duration format.
+		if exists {
+			*e.after, err = time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("init_mem:"+
+					" parsing %s: %q, err: %v", e.option, v, err)
+			}
+		}
+	}
+
+	v, exists = options["memShareRatioSlack"]
+	if exists {
+		ss, err2 := strconv.ParseBool(v)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memShareRatioSlack: %q, err: %v", v, err2)
+		}
+		ftsHerder.SetShareSlack(ss)
+	}
+
+	v, exists = options["memReadOnlyReplica"]
+	if exists {
+		ro, err2 := strconv.ParseBool(v)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memReadOnlyReplica: %q, err: %v", v, err2)
+		}
+		ftsHerder.SetReadOnly(ro)
+	}
+
+	if _, exists = options["memOOMImminentFraction"]; exists {
+		ftsHerder.oomImminentRatio, err = parseFraction(
+			"memOOMImminentFraction", 0, options)
+		if err != nil {
+			return err
+		}
+		// Dumps go to memOOMImminentDumpDir, or the working directory.
+		ftsHerder.onOOMImminent =
+			dumpOOMSnapshot(options["memOOMImminentDumpDir"])
+	}
+
+	v, exists = options["memCheckInvariants"]
+	if exists {
+		ci, err2 := strconv.ParseBool(v)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memCheckInvariants: %q, err: %v", v, err2)
+		}
+		ftsHerder.checkInvariants = ci
+	}
+
+	// Strict accounting is meant for staging, as it panics on any
+	// accounting mistake rather than only logging it.
+	v, exists = options["memStrictAccounting"]
+	if exists {
+		ftsHerder.strictAccounting, err = strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memStrictAccounting: %q, err: %v", v, err)
+		}
+		if ftsHerder.strictAccounting {
+			ftsHerder.checkInvariants = true
+		}
+	}
+
+	v, exists = options["memQueryPreemption"]
+	if exists {
+		ftsHerder.queryPreemption, err = strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memQueryPreemption: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memVerifyCloseKeys"]
+	if exists {
+		ftsHerder.verifyCloseKeys, err = strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memVerifyCloseKeys: %q, err: %v", v, err)
+		}
+	}
+
+	// The audit log is kept apart from the operational log, as a
+	// durable record of every admission decision.
+	v, exists = options["memAuditLog"]
+	if exists && v != "" {
+		ftsHerder.audit, err = openAuditLog(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" opening memAuditLog: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memQueryCalibration"]
+	if exists {
+		qc, err2 := strconv.ParseBool(v)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memQueryCalibration: %q, err: %v", v, err2)
+		}
+		if qc {
+			ftsHerder.calibration = newCalibrationRecorder()
+		}
+	}
+
+	v, exists = options["memAdmissionLatencyStats"]
+	if exists {
+		als, err2 := strconv.ParseBool(v)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memAdmissionLatencyStats: %q, err: %v", v, err2)
+		}
+		if als {
+			ftsHerder.queryAdmitLatency = newLatencyHistogram()
+			ftsHerder.batchAdmitLatency = newLatencyHistogram()
+		}
+	}
+
+	v, exists = options["memLockHoldStats"]
+	if exists {
+		lhs, err2 := strconv.ParseBool(v)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memLockHoldStats: %q, err: %v", v, err2)
+		}
+		if lhs {
+			ftsHerder.m.holds = newLatencyHistogram()
+		}
+	}
+
+	v, exists = options["memPersisterWakeMode"] // broadcast or signal.
+	if exists {
+		ftsHerder.persisterWakeMode, err = parseWakeMode(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memPersisterWakeMode: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memCombinedQuotaYield"] // indexing or queries.
+	if exists {
+		ftsHerder.combinedYield, err = parseCombinedYield(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memCombinedQuotaYield: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memZeroSizeQueries"] // allow, warn or reject.
+	if exists {
+		ftsHerder.zeroSizePolicy, err = parseZeroSizePolicy(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memZeroSizeQueries: %q, err: %v", v, err)
+		}
+	}
+
+	v, exists = options["memPersisterWakeBatchSize"] // In bytes.
+	if exists {
+		wbs, err2 := strconv.ParseUint(v, 10, 64)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memPersisterWakeBatchSize: %q, err: %v", v, err2)
+		}
+		ftsHerder.persisterWakeBatchSize = wbs
+	}
+
+	v, exists = options["memMossStatsErrPolicy"] // failOpen or failClosed.
+	if exists {
+		ftsHerder.mossStatsErrPolicy, err = parseStatsErrPolicy(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memMossStatsErrPolicy: %q, err: %v", v, err)
+		}
+	}
+
+	// The fast path is enabled last, once the options that rule it out
+	// are all configured.
+	v, exists = options["memQueryFastPath"]
+	if exists {
+		fastPath, err2 := strconv.ParseBool(v)
+		if err2 != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memQueryFastPath: %q, err: %v", v, err2)
+		}
+		ftsHerder.SetQueryFastPath(fastPath)
+	}
+
+	// The herder's periodic work is driven by its own goroutine unless
+	// memHerderTickInterval is 0, in which case it's up to the embedder
+	// to call ftsHerder.Tick().
+	herderTickInterval := defaultMemHerderTickInterval
+	v, exists = options["memHerderTickInterval"] // In Go duration format.
+	if exists {
+		herderTickInterval, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("init_mem:"+
+				" parsing memHerderTickInterval: %q, err: %v", v, err)
+		}
+	}
+
+	if herderTickInterval > 0 {
+		go ftsHerder.RunTicker(herderTickInterval)
+	}
 
 	return nil
 }
 
+// defaultMemHerderTickInterval is how often the app herder performs
+// its periodic work
+var defaultMemHerderTickInterval = time.Second
+
+// defaultMemThrashThreshold is the number of quota boundary crossings
+// per memThrashInterval beyond which the herder warns of thrashing
+var defaultMemThrashThreshold = 100
+
+// defaultMemRejectionWindow is how far back the breakdown of query
+// rejections by reason goes, with zero disabling it
+var defaultMemRejectionWindow = 5 * time.Minute
+
+// defaultMemAdmissionRateWindow is how far back the query admission
+// and rejection rates go, with zero disabling them
+var defaultMemAdmissionRateWindow = 10 * time.Second
+
 // defaultFTSMemIndexingFraction is the ratio of the application quota
 // to use for indexing (default 100%)
 var defaultFTSApplicationFraction = 1.0
@@ -57,14 +57,16 @@ func initMossOptions(options map[string]string) (err error) {
 		}
 	}
 
-	bleveMoss.RegistryCollectionOptions["fts"] = moss.CollectionOptions{
+	mossOptions := moss.CollectionOptions{
 		Debug: mossDebug,
 		Log:   log.Printf,
 		OnError: func(err error) {
 			log.Fatalf("moss OnError, treating this as fatal, err: %v", err)
 		},
-		OnEvent: ftsHerder.MossHerderOnEvent(),
 	}
+	ftsHerder.AttachMoss(&mossOptions)
+
+	bleveMoss.RegistryCollectionOptions["fts"] = mossOptions
 
 	return nil
 }